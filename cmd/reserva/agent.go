@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/results"
+	"github.com/calmitchell617/reserva/internal/stats"
+	"github.com/calmitchell617/reserva/internal/tracing"
+)
+
+// runAgent runs `reserva agent`, which joins a coordinator and runs its part
+// of a distributed run.
+func runAgent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+
+	addr := fs.String("coordinator", "localhost:7070", "Address of the coordinator")
+	name := fs.String("name", "", "Name of this agent (agent-N by default)")
+	pprofAddr := fs.String("pprof", "", "Serve pprof profiles of this agent at this address, such as localhost:6060")
+
+	fs.Parse(args)
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	if *pprofAddr != "" {
+		go servePprof(*pprofAddr, logger)
+	}
+
+	base := *addr
+	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+		base = "http://" + base
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// cancelled if the coordinator aborts the run
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
+
+	logger.Info(fmt.Sprintf("joining the coordinator at %v", base))
+
+	var join joinResponse
+
+	err := postJSON(ctx, base+"/join", joinRequest{Name: *name}, &join)
+	if err != nil {
+		logger.Error(fmt.Errorf("error joining the coordinator: %w", err).Error())
+		os.Exit(1)
+	}
+
+	logger.Info(fmt.Sprintf("joined as %v, %v of %v agents", join.Name, join.Index+1, join.Agents), "seed", join.Seed)
+
+	sendResult := func(result *results.Result) {
+		// the run's context may have been cancelled by an interrupt
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		err := postJSON(ctx, base+"/result", resultRequest{Index: join.Index, Result: result}, nil)
+		if err != nil {
+			logger.Error(fmt.Errorf("error sending the result to the coordinator: %w", err).Error())
+		}
+	}
+
+	cfg, err := agentConfig(join)
+	if err != nil {
+		logger.Error(err.Error())
+		sendResult(&results.Result{Name: join.Name, Seed: join.Seed, Error: err.Error()})
+		os.Exit(1)
+	}
+
+	var tracer *tracing.Tracer
+
+	if cfg.tracePath != "" {
+		exporter, err := tracing.NewExporter(cfg.tracePath)
+		if err != nil {
+			err = fmt.Errorf("error opening trace exporter: %w", err)
+			logger.Error(err.Error())
+			sendResult(&results.Result{Name: join.Name, Seed: join.Seed, Error: err.Error()})
+			os.Exit(1)
+		}
+
+		tracer = tracing.New(exporter, cfg.traceSample, cfg.traceSlow, tracing.String("service.name", "reserva"), tracing.String("service.instance.id", join.Name))
+	}
+
+	intervals := make(chan stats.Interval, 64)
+	sent := make(chan struct{})
+
+	go func() {
+		defer close(sent)
+
+		for interval := range intervals {
+			err := postJSON(ctx, base+"/interval", intervalRequest{Index: join.Index, Interval: interval}, nil)
+			switch {
+			case errors.Is(err, errAborted):
+				logger.Warn("the coordinator was interrupted, stopping")
+				abort()
+			case err != nil && ctx.Err() == nil:
+				logger.Warn(fmt.Errorf("error sending interval to the coordinator -> %w", err).Error())
+			}
+		}
+	}()
+
+	cfg.agent = &agentHooks{
+		ready: func(ctx context.Context) (time.Time, error) {
+			var ready readyResponse
+
+			logger.Info("ready, waiting for the other agents")
+
+			err := postJSON(ctx, base+"/ready", readyRequest{Index: join.Index}, &ready)
+			if err != nil {
+				return time.Time{}, err
+			}
+
+			logger.Info(fmt.Sprintf("starting at %v", ready.Start.Format(time.RFC3339Nano)))
+
+			return ready.Start, nil
+		},
+		interval: func(interval stats.Interval) {
+			select {
+			case intervals <- interval:
+			default:
+				logger.Warn("the coordinator isn't keeping up, dropping an interval")
+			}
+		},
+	}
+
+	result, err := run(ctx, stop, cfg, logger, nil, nil, tracer)
+
+	close(intervals)
+	<-sent
+
+	if tracer != nil {
+		err := tracer.Close()
+		if err != nil {
+			logger.Error(fmt.Errorf("error exporting traces: %w", err).Error())
+		}
+		if dropped := tracer.Dropped(); dropped > 0 {
+			logger.Warn(fmt.Sprintf("dropped %v traces the exporter couldn't keep up with", dropped))
+		}
+		logger.Info(fmt.Sprintf("traces exported to %v", cfg.tracePath))
+	}
+
+	if err != nil {
+		logger.Error(err.Error())
+		sendResult(&results.Result{Name: join.Name, Seed: join.Seed, Error: err.Error()})
+		os.Exit(1)
+	}
+
+	logResult(logger, result)
+	sendResult(result)
+
+	switch {
+	case result.Error != "":
+		os.Exit(1)
+	case result.Interrupted:
+		os.Exit(130)
+	}
+}
+
+// agentConfig parses the coordinator's flags into the config of this agent's
+// part of the run. Only the first agent measures what is about the database
+// rather than the load: replica lag, server stats and query plans, and only it
+// runs the failover hook. Files each agent writes are suffixed with its name,
+// so agents on the same host don't overwrite each other's.
+func agentConfig(join joinResponse) (config, error) {
+	fs := flag.NewFlagSet("coordinator", flag.ContinueOnError)
+	fs.SetOutput(new(strings.Builder))
+
+	flags := configFlags(fs)
+
+	err := fs.Parse(join.Args)
+	if err != nil {
+		return config{}, fmt.Errorf("error parsing the coordinator's flags: %w", err)
+	}
+
+	cfg := *flags
+
+	cfg.seed = join.Seed
+	cfg.name = join.Name
+	if flags.name != "" {
+		cfg.name = flags.name + "/" + join.Name
+	}
+
+	cfg.failover.ackLog = agentPath(cfg.failover.ackLog, join.Name)
+	cfg.recordPath = agentPath(cfg.recordPath, join.Name)
+	if !strings.HasPrefix(cfg.tracePath, "http://") && !strings.HasPrefix(cfg.tracePath, "https://") {
+		cfg.tracePath = agentPath(cfg.tracePath, join.Name)
+	}
+
+	if join.Index > 0 {
+		cfg.db.lagInterval = 0
+		cfg.serverStats = false
+		cfg.explain = false
+		cfg.failover.hook = ""
+	}
+
+	err = validate(&cfg)
+	if err != nil {
+		return config{}, err
+	}
+
+	return cfg, nil
+}
+
+// agentPath is the agent's own copy of a file given to the coordinator, or ""
+// if none was.
+func agentPath(path, agent string) string {
+	if path == "" {
+		return ""
+	}
+
+	return path + "." + agent
+}
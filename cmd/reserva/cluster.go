@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/results"
+	"github.com/calmitchell617/reserva/internal/stats"
+)
+
+// A distributed run is driven by `reserva coordinator`, which is started with
+// the flags of the run, and any number of `reserva agent` processes, which
+// connect to it over HTTP. Each agent:
+//
+//  1. joins, and is sent the coordinator's flags and its seed partition
+//  2. opens its connections and loads the users, then says it is ready, and
+//     is sent the time at which all agents start
+//  3. sends every interval of the measurement as it is sampled
+//  4. sends its result
+//
+// The coordinator merges the intervals as they arrive and the results at the
+// end. If it is interrupted, it answers the agents' next interval with 410
+// Gone, and they stop.
+
+// agentHooks connect a run to the coordinator of a distributed run.
+type agentHooks struct {
+	// ready is called once the run is set up, and returns when to start
+	ready func(ctx context.Context) (time.Time, error)
+
+	// interval is called with every interval of the measurement
+	interval func(stats.Interval)
+}
+
+type joinRequest struct {
+	Name string `json:"name"`
+}
+
+type joinResponse struct {
+	Index  int      `json:"index"`
+	Name   string   `json:"name"`
+	Agents int      `json:"agents"`
+	Args   []string `json:"args"`
+	Seed   int64    `json:"seed"`
+}
+
+type readyRequest struct {
+	Index int `json:"index"`
+}
+
+type readyResponse struct {
+	Start time.Time `json:"start"`
+}
+
+type intervalRequest struct {
+	Index    int            `json:"index"`
+	Interval stats.Interval `json:"interval"`
+}
+
+type resultRequest struct {
+	Index  int             `json:"index"`
+	Result *results.Result `json:"result"`
+}
+
+// errAborted is returned to an agent whose coordinator was interrupted.
+var errAborted = errors.New("the coordinator aborted the run")
+
+// postJSON posts in to url as JSON, and decodes the response into out, if it
+// is not nil.
+func postJSON(ctx context.Context, url string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		return errAborted
+	case resp.StatusCode != http.StatusOK:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("coordinator responded with %v: %s", resp.Status, bytes.TrimSpace(msg))
+	case out == nil:
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
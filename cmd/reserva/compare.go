@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/calmitchell617/reserva/internal/history"
+	"github.com/calmitchell617/reserva/internal/results"
+)
+
+// runCompare runs `reserva compare`, which compares two runs and exits with
+// status 2 if any metric regressed significantly. Runs are given as results
+// files or as IDs in the -history directory. Without arguments, the last two
+// comparable runs of -target in the history are compared.
+func runCompare(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+
+	historyDir := fs.String("history", "", "History directory to look runs up in")
+	target := fs.String("target", "", "Only compare this target")
+	alpha := fs.Float64("alpha", 0.01, "Significance level")
+	threshold := fs.Float64("threshold", 0.05, "Smallest relative change that counts as a regression or improvement")
+
+	fs.Parse(args)
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	var as, bs []*results.Result
+	var err error
+
+	switch fs.NArg() {
+	case 0:
+		if *historyDir == "" || *target == "" {
+			err = errors.New("either two runs, or -history and -target, are required")
+			break
+		}
+
+		var a, b history.Entry
+
+		a, b, err = history.Latest(*historyDir, *target)
+		if err != nil {
+			break
+		}
+
+		as, err = loadRun(*historyDir, a.ID)
+		if err != nil {
+			break
+		}
+		bs, err = loadRun(*historyDir, b.ID)
+
+	case 2:
+		as, err = loadRun(*historyDir, fs.Arg(0))
+		if err != nil {
+			break
+		}
+		bs, err = loadRun(*historyDir, fs.Arg(1))
+
+	default:
+		err = errors.New("usage: reserva compare [flags] [<runA> <runB>]")
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	pairs := pairRuns(as, bs, *target)
+	if len(pairs) == 0 {
+		logger.Error("no targets in common between the two runs")
+		os.Exit(1)
+	}
+
+	regressed := false
+
+	for i, pair := range pairs {
+		if i > 0 {
+			fmt.Println()
+		}
+
+		changes := results.Compare(pair[0], pair[1], *alpha, *threshold)
+
+		err = results.WriteChanges(os.Stdout, pair[0], pair[1], changes)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		regressed = regressed || results.Regressed(changes)
+	}
+
+	if regressed {
+		os.Exit(2)
+	}
+}
+
+// loadRun reads a run from a results file or, failing that, from the history.
+func loadRun(historyDir, run string) ([]*results.Result, error) {
+	rs, err := results.Read(run)
+	if err == nil || !errors.Is(err, os.ErrNotExist) || historyDir == "" {
+		return rs, err
+	}
+
+	result, err := history.Load(historyDir, run)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*results.Result{result}, nil
+}
+
+// pairRuns matches the targets of two runs by name. Single results are always
+// paired, so that differently named targets can be compared.
+func pairRuns(as, bs []*results.Result, target string) [][2]*results.Result {
+	if len(as) == 1 && len(bs) == 1 {
+		return [][2]*results.Result{{as[0], bs[0]}}
+	}
+
+	var pairs [][2]*results.Result
+
+	for _, a := range as {
+		if target != "" && a.Name != target {
+			continue
+		}
+
+		for _, b := range bs {
+			if a.Name == b.Name {
+				pairs = append(pairs, [2]*results.Result{a, b})
+			}
+		}
+	}
+
+	return pairs
+}
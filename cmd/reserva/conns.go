@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/data"
+	"github.com/calmitchell617/reserva/internal/replicas"
+	"github.com/calmitchell617/reserva/internal/stats"
+	"github.com/lib/pq"
+)
+
+// connCounter counts the database connections opened during a run, and how
+// long each took to open. Nothing is recorded until the run starts.
+type connCounter struct {
+	recorder atomic.Pointer[stats.Recorder]
+}
+
+func (c *connCounter) start(recorder *stats.Recorder) {
+	c.recorder.Store(recorder)
+}
+
+// countingConnector wraps a driver's connector to report every connection it
+// opens to a connCounter.
+type countingConnector struct {
+	driver.Connector
+	counter *connCounter
+}
+
+func newCountingConnector(driverName, dsn string, counter *connCounter) (driver.Connector, error) {
+	// lib/pq doesn't implement driver.DriverContext, but its connector
+	// honors the context's deadline and cancellation while connecting
+	if driverName == "postgres" {
+		connector, err := pq.NewConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+
+		return &countingConnector{Connector: connector, counter: counter}, nil
+	}
+
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	driverContext, ok := db.Driver().(driver.DriverContext)
+	if !ok {
+		return nil, fmt.Errorf("driver %v has no connector", driverName)
+	}
+
+	connector, err := driverContext.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &countingConnector{Connector: connector, counter: counter}, nil
+}
+
+func (c *countingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	start := time.Now()
+
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if recorder := c.counter.recorder.Load(); recorder != nil {
+		recorder.Connection(time.Since(start))
+	}
+
+	return conn, nil
+}
+
+// worker holds connections taken out of the pool, and the models that use
+// them, for the churn and dedicated connection modes.
+type worker struct {
+	writeConn *sql.Conn
+	readConn  *sql.Conn
+	prepared  []*data.PreparedDB
+	models    data.Models
+}
+
+func (app *application) openWorker(ctx context.Context) (*worker, error) {
+	w := &worker{}
+
+	var err error
+
+	w.writeConn, err = app.writeDb.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	w.readConn = w.writeConn
+
+	// each worker reads from one replica, chosen by the read policy when its
+	// connection is opened
+	var replica *replicas.Replica
+
+	if app.replicas != nil {
+		replica = app.replicas.Pick()
+
+		w.readConn, err = replica.Pool.Conn(ctx)
+		if err != nil {
+			w.writeConn.Close()
+			return nil, err
+		}
+	}
+
+	var writeDb, readDb data.DB = w.writeConn, w.readConn
+
+	if app.config.db.prepared {
+		reads, writes := data.WorkloadQueries(app.config.db.engine, app.config.db.txMode, false)
+
+		preparedWriteDb := data.NewPreparedDB(w.writeConn)
+		writeDb, readDb = preparedWriteDb, preparedWriteDb
+		w.prepared = append(w.prepared, preparedWriteDb)
+
+		err = preparedWriteDb.Prepare(ctx, append(reads, writes...)...)
+
+		if err == nil && replica != nil {
+			preparedReadDb := data.NewPreparedDB(w.readConn)
+			readDb = preparedReadDb
+			w.prepared = append(w.prepared, preparedReadDb)
+
+			err = preparedReadDb.Prepare(ctx, reads...)
+		}
+
+		if err != nil {
+			w.close()
+			return nil, err
+		}
+	}
+
+	if replica != nil {
+		readDb = replica.Track(readDb)
+	}
+
+	w.models = app.newModels(writeDb, readDb)
+
+	return w, nil
+}
+
+func (w *worker) close() {
+	for _, p := range w.prepared {
+		p.Close()
+	}
+
+	w.writeConn.Close()
+
+	if w.readConn != w.writeConn {
+		w.readConn.Close()
+	}
+}
+
+// acquireModels returns the models to run one transfer with, according to
+// the connection mode, and a function to hand them back once the transfer is
+// done:
+//
+//   - pool shares the connection pool between all transfers.
+//   - churn opens new connections for every transfer and closes them after.
+//   - dedicated pins connections to each of the concurrent workers for the
+//     whole run, only replacing them if they break.
+func (app *application) acquireModels(ctx context.Context) (data.Models, func(error), error) {
+	switch app.config.db.connMode {
+	case "churn":
+		w, err := app.openWorker(ctx)
+		if err != nil {
+			return data.Models{}, nil, err
+		}
+
+		return w.models, func(error) { w.close() }, nil
+
+	case "dedicated":
+		w := <-app.workers
+
+		if w == nil {
+			var err error
+
+			w, err = app.openWorker(ctx)
+			if err != nil {
+				app.workers <- nil
+				return data.Models{}, nil, err
+			}
+		}
+
+		release := func(err error) {
+			// a write in doubt lost its connection too
+			switch data.Classify(err) {
+			case data.ClassConnection, data.ClassInDoubt:
+				w.close()
+				w = nil
+			}
+			app.workers <- w
+		}
+
+		return w.models, release, nil
+	}
+
+	return app.models, func(error) {}, nil
+}
+
+// newModels returns models that use the given connections. With
+// -consistent-reads, the balance check is sent to the primary.
+func (app *application) newModels(writeDb, readDb data.DB) data.Models {
+	models := data.NewModels(writeDb, readDb, app.config.db.queryTimeout)
+
+	if app.config.db.consistentReads {
+		models.Accounts.ReadDb = writeDb
+	}
+
+	return models
+}
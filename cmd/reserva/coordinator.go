@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/results"
+	"github.com/calmitchell617/reserva/internal/stats"
+)
+
+// runCoordinator runs `reserva coordinator`, which takes the flags of a run,
+// waits for -agents agents to join, starts them together and merges their
+// results into one.
+func runCoordinator(args []string) {
+	fs := flag.NewFlagSet("coordinator", flag.ExitOnError)
+	flags := configFlags(fs)
+	fs.Parse(args)
+
+	cfg := *flags
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	switch {
+	case cfg.targetsPath != "":
+		logger.Error("-targets can't be used with a coordinator, run one coordinator per target")
+		os.Exit(1)
+	case cfg.cluster.agents < 1:
+		logger.Error("-agents must be at least 1")
+		os.Exit(1)
+	case cfg.interval <= 0:
+		logger.Error("-interval must be positive")
+		os.Exit(1)
+	case cfg.dashboard:
+		logger.Error("-dashboard can't be used with a coordinator, which logs the combined progress instead")
+		os.Exit(1)
+	case cfg.pprofAddr != "":
+		logger.Error("-pprof can't be used with a coordinator, give each agent its own -pprof address")
+		os.Exit(1)
+	}
+
+	err := validate(&cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if cfg.seed == 0 {
+		cfg.seed = time.Now().UnixNano()
+	}
+
+	var timeseries *timeseriesWriter
+
+	if cfg.timeseriesPath != "" {
+		timeseries, err = newTimeseriesWriter(cfg.timeseriesPath)
+		if err != nil {
+			logger.Error(fmt.Errorf("error opening time series: %w", err).Error())
+			os.Exit(1)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	c := newCoordinator(cfg, args, logger, timeseries)
+
+	ln, err := net.Listen("tcp", cfg.cluster.listen)
+	if err != nil {
+		logger.Error(fmt.Errorf("error listening for agents: %w", err).Error())
+		os.Exit(1)
+	}
+
+	server := &http.Server{Handler: c.handler()}
+	go server.Serve(ln)
+
+	logger.Info(fmt.Sprintf("waiting for %v agents at %v", cfg.cluster.agents, ln.Addr()), "seed", cfg.seed)
+
+	rs, interrupted := c.wait(ctx, stop)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	server.Shutdown(shutdownCtx)
+	cancel()
+
+	result := results.Merge(cfg.name, cfg.seed, c.names(), rs)
+	result.Interrupted = result.Interrupted || interrupted
+
+	if !result.StartedAt.IsZero() {
+		logResult(logger, result)
+	}
+	logAgents(logger, cfg.name, result.Agents)
+
+	finish(cfg, logger, []*results.Result{result}, timeseries, nil)
+}
+
+type coordinator struct {
+	cfg        config
+	args       []string
+	logger     *slog.Logger
+	timeseries *timeseriesWriter
+
+	mu        sync.Mutex
+	agents    []string
+	joined    chan struct{}
+	ready     []bool
+	nReady    int
+	start     time.Time
+	allReady  chan struct{}
+	intervals [][]stats.Interval
+	merged    int
+	results   []*results.Result
+	nResults  int
+	done      chan struct{}
+	aborted   bool
+}
+
+func newCoordinator(cfg config, args []string, logger *slog.Logger, timeseries *timeseriesWriter) *coordinator {
+	n := cfg.cluster.agents
+
+	return &coordinator{
+		cfg:        cfg,
+		args:       args,
+		logger:     logger,
+		timeseries: timeseries,
+		joined:     make(chan struct{}),
+		ready:      make([]bool, n),
+		allReady:   make(chan struct{}),
+		intervals:  make([][]stats.Interval, n),
+		results:    make([]*results.Result, n),
+		done:       make(chan struct{}),
+	}
+}
+
+func (c *coordinator) names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, c.cfg.cluster.agents)
+	for i := range names {
+		names[i] = fmt.Sprintf("agent-%d", i+1)
+		if i < len(c.agents) {
+			names[i] = c.agents[i]
+		}
+	}
+
+	return names
+}
+
+// wait waits for every agent's result. If ctx is done first, the agents are
+// told to stop, and given until the shutdown timeout to send what they have.
+func (c *coordinator) wait(ctx context.Context, stop func()) ([]*results.Result, bool) {
+	interrupted := false
+
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		interrupted = true
+
+		// restore default signal handling so a second interrupt exits immediately
+		stop()
+
+		c.mu.Lock()
+		c.aborted = true
+		c.mu.Unlock()
+
+		c.logger.Info(fmt.Sprintf("%v interrupted, waiting up to %v for the agents' results", c.cfg.name, c.cfg.shutdownTimeout))
+
+		// agents find out at their next interval
+		select {
+		case <-c.done:
+		case <-time.After(c.cfg.shutdownTimeout + 2*c.cfg.interval):
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]*results.Result(nil), c.results...), interrupted
+}
+
+func (c *coordinator) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /join", c.handleJoin)
+	mux.HandleFunc("POST /ready", c.handleReady)
+	mux.HandleFunc("POST /interval", c.handleInterval)
+	mux.HandleFunc("POST /result", c.handleResult)
+	return mux
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleJoin answers once every agent has joined.
+func (c *coordinator) handleJoin(w http.ResponseWriter, r *http.Request) {
+	var req joinRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	c.mu.Lock()
+
+	if c.aborted || len(c.agents) == c.cfg.cluster.agents {
+		c.mu.Unlock()
+		http.Error(w, "no more agents are expected", http.StatusConflict)
+		return
+	}
+
+	index := len(c.agents)
+
+	name := req.Name
+	if name == "" {
+		name = fmt.Sprintf("agent-%d", index+1)
+	}
+
+	c.agents = append(c.agents, name)
+
+	if len(c.agents) == c.cfg.cluster.agents {
+		close(c.joined)
+	}
+
+	c.mu.Unlock()
+
+	c.logger.Info(fmt.Sprintf("%v joined from %v", name, r.RemoteAddr), "index", index)
+
+	select {
+	case <-c.joined:
+	case <-r.Context().Done():
+		return
+	}
+
+	writeJSON(w, joinResponse{
+		Index:  index,
+		Name:   name,
+		Agents: c.cfg.cluster.agents,
+		Args:   c.args,
+		// each agent has its own partition of the seeds, so agents don't
+		// issue the same sequence of transfers
+		Seed: c.cfg.seed + int64(index),
+	})
+}
+
+// handleReady answers once every agent is ready, or has failed, with the time
+// they all start.
+func (c *coordinator) handleReady(w http.ResponseWriter, r *http.Request) {
+	var req readyRequest
+	if !readJSON(w, r, &req) || !c.validIndex(w, req.Index) {
+		return
+	}
+
+	c.mu.Lock()
+	c.markReady(req.Index)
+	c.mu.Unlock()
+
+	select {
+	case <-c.allReady:
+	case <-r.Context().Done():
+		return
+	}
+
+	c.mu.Lock()
+	aborted := c.aborted
+	c.mu.Unlock()
+
+	if aborted {
+		http.Error(w, "the run was interrupted", http.StatusGone)
+		return
+	}
+
+	writeJSON(w, readyResponse{Start: c.start})
+}
+
+// markReady must be called with mu held.
+func (c *coordinator) markReady(index int) {
+	if c.ready[index] {
+		return
+	}
+
+	c.ready[index] = true
+	c.nReady++
+
+	if c.nReady == c.cfg.cluster.agents {
+		c.start = time.Now().Add(c.cfg.cluster.startDelay)
+		close(c.allReady)
+
+		c.logger.Info(fmt.Sprintf("all agents ready, starting %v at %v", c.cfg.name, c.start.Format(time.RFC3339Nano)))
+	}
+}
+
+func (c *coordinator) handleInterval(w http.ResponseWriter, r *http.Request) {
+	var req intervalRequest
+	if !readJSON(w, r, &req) || !c.validIndex(w, req.Index) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.aborted {
+		http.Error(w, "the run was interrupted", http.StatusGone)
+		return
+	}
+
+	c.intervals[req.Index] = append(c.intervals[req.Index], req.Interval)
+	c.mergeIntervals()
+}
+
+// mergeIntervals merges and logs every interval all running agents have
+// sent. It must be called with mu held.
+func (c *coordinator) mergeIntervals() {
+	for {
+		var merged stats.Interval
+		var agents int
+
+		for i, intervals := range c.intervals {
+			// agents that failed to start send no intervals
+			if c.results[i] != nil && c.results[i].StartedAt.IsZero() {
+				continue
+			}
+
+			if len(intervals) <= c.merged {
+				// wait for agents that are still running
+				if c.results[i] == nil {
+					return
+				}
+				continue
+			}
+
+			merged = stats.MergeIntervals(merged, intervals[c.merged])
+			agents++
+		}
+
+		if agents == 0 {
+			return
+		}
+
+		c.merged++
+
+		if c.timeseries != nil {
+			window := stats.NewWindow(c.start, c.cfg.warmup, c.cfg.duration)
+
+			err := c.timeseries.write(c.cfg.name, window, merged)
+			if err != nil {
+				c.logger.Warn(fmt.Errorf("error writing time series -> %w", err).Error())
+			}
+		}
+
+		c.logger.Info(fmt.Sprintf("%v completing %.0f actions per second across %v agents", c.cfg.name, float64(merged.Transfers+merged.Deletes)/merged.Length.Seconds(), agents))
+	}
+}
+
+func (c *coordinator) handleResult(w http.ResponseWriter, r *http.Request) {
+	var req resultRequest
+	if !readJSON(w, r, &req) || !c.validIndex(w, req.Index) {
+		return
+	}
+
+	if req.Result == nil {
+		http.Error(w, "missing result", http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.results[req.Index] != nil {
+		http.Error(w, "result already received", http.StatusConflict)
+		return
+	}
+
+	c.results[req.Index] = req.Result
+	c.nResults++
+
+	// an agent that failed to set up never says it is ready
+	c.markReady(req.Index)
+	c.mergeIntervals()
+
+	if req.Result.Error != "" {
+		c.logger.Warn(fmt.Sprintf("%v failed: %v", c.agents[req.Index], req.Result.Error))
+	} else {
+		c.logger.Info(fmt.Sprintf("%v finished", c.agents[req.Index]))
+	}
+
+	if c.nResults == c.cfg.cluster.agents {
+		close(c.done)
+	}
+}
+
+func (c *coordinator) validIndex(w http.ResponseWriter, index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if index < 0 || index >= len(c.agents) {
+		http.Error(w, fmt.Sprintf("unknown agent %v", index), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func logAgents(logger *slog.Logger, name string, agents []results.Agent) {
+	for _, agent := range agents {
+		args := []any{
+			"seed", agent.Seed,
+			"concurrency", agent.Concurrency,
+			"actions", agent.Actions,
+			"rate", fmt.Sprintf("%.0f", agent.Rate),
+			"client_bound", agent.ClientBound,
+		}
+		if agent.Error != "" {
+			args = append(args, "error", agent.Error)
+		}
+
+		logger.Info(fmt.Sprintf("%v %v", name, agent.Name), args...)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// processCPU can't tell how much CPU the process has used on this platform.
+func processCPU() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dashboardRefresh = time.Second
+
+	// rollingWindow is how far back the rolling throughput looks.
+	rollingWindow = 10 * time.Second
+
+	// logTailLines is how many of the latest log lines the dashboard shows.
+	logTailLines = 8
+)
+
+// dashboard redraws a live view of every running target in the terminal.
+// While it runs, log lines are captured and the latest are shown below the
+// panels.
+type dashboard struct {
+	out *os.File
+
+	mu      sync.Mutex
+	panels  []*panel
+	logs    []string
+	partial []byte
+	running bool
+}
+
+// panel is the dashboard's view of one target.
+type panel struct {
+	app     *application
+	samples []actionSample
+	done    bool
+}
+
+type actionSample struct {
+	at      time.Time
+	actions int64
+}
+
+// isTerminal reports whether f is a terminal, rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func newDashboard(out *os.File) *dashboard {
+	return &dashboard{out: out, running: true}
+}
+
+// add shows a target on the dashboard, and returns a function to call when
+// its run is over.
+func (d *dashboard) add(app *application) func() {
+	p := &panel{app: app}
+
+	d.mu.Lock()
+	d.panels = append(d.panels, p)
+	d.mu.Unlock()
+
+	return func() {
+		d.mu.Lock()
+		p.done = true
+		d.mu.Unlock()
+	}
+}
+
+// Write captures log lines while the dashboard is running, and passes them
+// straight through once it has stopped.
+func (d *dashboard) Write(b []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.running {
+		return d.out.Write(b)
+	}
+
+	d.partial = append(d.partial, b...)
+
+	for {
+		i := bytes.IndexByte(d.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		d.logs = append(d.logs, string(d.partial[:i]))
+		d.partial = d.partial[i+1:]
+	}
+
+	if len(d.logs) > logTailLines {
+		d.logs = slices.Clone(d.logs[len(d.logs)-logTailLines:])
+	}
+
+	return len(b), nil
+}
+
+// run redraws the dashboard until ctx is done, then draws it one last time
+// and lets log lines through again.
+func (d *dashboard) run(ctx context.Context) {
+	io.WriteString(d.out, "\x1b[2J")
+
+	ticker := time.NewTicker(dashboardRefresh)
+	defer ticker.Stop()
+
+	for {
+		d.draw()
+
+		select {
+		case <-ctx.Done():
+			d.mu.Lock()
+			d.running = false
+			d.mu.Unlock()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *dashboard) draw() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var b strings.Builder
+
+	// move to the top left and redraw over the previous frame
+	b.WriteString("\x1b[H")
+
+	now := time.Now()
+
+	for _, p := range d.panels {
+		p.write(&b, now)
+		b.WriteString("\n")
+	}
+
+	for _, line := range d.logs {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+
+	// clear the end of every line, and whatever is left below
+	frame := strings.ReplaceAll(b.String(), "\n", "\x1b[K\n") + "\x1b[J"
+
+	io.WriteString(d.out, frame)
+}
+
+func (p *panel) write(b *strings.Builder, now time.Time) {
+	app := p.app
+	recorder := app.recorder
+	window := recorder.Window
+
+	actions := recorder.Actions()
+	p.samples = append(p.samples, actionSample{at: now, actions: actions})
+
+	for len(p.samples) > 2 && now.Sub(p.samples[1].at) >= rollingWindow {
+		p.samples = p.samples[1:]
+	}
+
+	var current, rolling float64
+
+	if n := len(p.samples); n >= 2 {
+		last, prev, first := p.samples[n-1], p.samples[n-2], p.samples[0]
+		current = float64(last.actions-prev.actions) / last.at.Sub(prev.at).Seconds()
+		rolling = float64(last.actions-first.actions) / last.at.Sub(first.at).Seconds()
+	}
+
+	phase := window.Phase(now).String()
+	if p.done {
+		phase = "done"
+	}
+
+	end := window.End.Add(app.config.cooldown)
+	start := window.Start.Add(-app.config.warmup)
+
+	elapsed := now.Sub(start)
+	if now.After(end) {
+		elapsed = end.Sub(start)
+	}
+	elapsed = elapsed.Round(time.Second)
+	remaining := max(end.Sub(now), 0).Round(time.Second)
+
+	fmt.Fprintf(b, "\x1b[1m%v\x1b[0m  %v  elapsed %v  remaining %v\n", app.config.name, phase, elapsed, remaining)
+	fmt.Fprintf(b, "  throughput  now %.0f/s  %v avg %.0f/s  in flight %v\n", current, rollingWindow, rolling, app.inFlight.Load())
+
+	pool := app.writeDb.Stats()
+	fmt.Fprintf(b, "  pool        open %v  in use %v  idle %v  waits %v (%v)\n", pool.OpenConnections, pool.InUse, pool.Idle, pool.WaitCount, pool.WaitDuration.Round(time.Millisecond))
+
+	failures := recorder.Failures()
+	b.WriteString("  errors     ")
+	if len(failures) == 0 {
+		b.WriteString(" none")
+	}
+	for _, class := range sortedKeys(failures) {
+		fmt.Fprintf(b, " %v %v", class, failures[class])
+	}
+	b.WriteString("\n")
+
+	interval, ok := recorder.LastInterval()
+	if !ok {
+		return
+	}
+
+	fmt.Fprintf(b, "  %-16v %10v %10v %10v %10v\n", fmt.Sprintf("latency (%v)", app.config.interval), "count", "p50", "p90", "p99")
+
+	for _, step := range steps {
+		l, ok := interval.Latencies[step]
+		if !ok {
+			continue
+		}
+
+		fmt.Fprintf(b, "  %-16v %10v %10v %10v %10v\n", step, l.Count, roundLatency(l.P50), roundLatency(l.P90), roundLatency(l.P99))
+	}
+}
+
+func roundLatency(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/data"
+	"github.com/calmitchell617/reserva/internal/stats"
+)
+
+// maxMissingIds caps how many missing transfer IDs are listed in the results.
+const maxMissingIds = 100
+
+// ackLog writes the ID of every transfer acknowledged to the client, and of
+// every transfer a delete was attempted for, so that after a failover it can
+// be checked whether any acknowledged transfer was lost.
+type ackLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	acks int64
+}
+
+func openAckLog(path string) (*ackLog, error) {
+	var f *os.File
+	var err error
+
+	if path == "" {
+		f, err = os.CreateTemp("", "reserva-acks-*.log")
+	} else {
+		f, err = os.Create(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &ackLog{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (l *ackLog) write(kind string, transferId int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if kind == "ack" {
+		l.acks++
+	}
+
+	fmt.Fprintf(l.w, "%v %v %v\n", kind, transferId, time.Now().UnixNano())
+}
+
+// ack records a transfer whose commit was acknowledged.
+func (l *ackLog) ack(transferId int64) {
+	l.write("ack", transferId)
+}
+
+// deleting records a transfer that is about to be deleted. It is recorded
+// before the delete is attempted, as a delete that fails may still have
+// taken effect.
+func (l *ackLog) deleting(transferId int64) {
+	l.write("delete", transferId)
+}
+
+func (l *ackLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.w.Flush()
+	if err != nil {
+		l.f.Close()
+		return err
+	}
+
+	return l.f.Close()
+}
+
+// checkAcknowledged reads the ack log back and looks up every acknowledged
+// transfer that wasn't deleted by the workload on the primary, returning the
+// number checked and the IDs of those that are missing.
+func (app *application) checkAcknowledged(ctx context.Context, path string) (int64, []int64, error) {
+	deleted := make(map[int64]bool)
+
+	err := readAckLog(path, func(kind string, transferId int64) error {
+		if kind == "delete" {
+			deleted[transferId] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	transfers := data.TransferModel{
+		WriteDb:      app.writeDb,
+		QueryTimeout: app.config.db.queryTimeout,
+	}
+
+	var checked int64
+	var missing []int64
+	batch := make([]int64, 0, 1000)
+
+	flush := func() error {
+		existing, err := transfers.Existing(ctx, batch, app.config.db.engine)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range batch {
+			if !existing[id] {
+				missing = append(missing, id)
+			}
+		}
+
+		checked += int64(len(batch))
+		batch = batch[:0]
+
+		return nil
+	}
+
+	err = readAckLog(path, func(kind string, transferId int64) error {
+		if kind != "ack" || deleted[transferId] {
+			return nil
+		}
+
+		batch = append(batch, transferId)
+		if len(batch) < cap(batch) {
+			return nil
+		}
+
+		return flush()
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = flush()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return checked, missing, nil
+}
+
+func readAckLog(path string, fn func(kind string, transferId int64) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		transferId, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed ack log line %q -> %w", scanner.Text(), err)
+		}
+
+		err = fn(fields[0], transferId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// runFailoverHook runs the -failover-hook command through the shell at t,
+// unless ctx is done first.
+func (app *application) runFailoverHook(ctx context.Context, t time.Time, failover *stats.FailoverRecorder) {
+	sleepUntil(ctx, t)
+	if ctx.Err() != nil {
+		return
+	}
+
+	app.logger.Info("running failover hook", "command", app.config.failover.hook)
+
+	run := stats.HookRun{
+		Command:   app.config.failover.hook,
+		StartedAt: time.Now(),
+	}
+
+	output, err := exec.CommandContext(ctx, "sh", "-c", app.config.failover.hook).CombinedOutput()
+
+	run.FinishedAt = time.Now()
+	run.Output = strings.TrimSpace(string(output))
+
+	if err != nil {
+		run.Error = err.Error()
+		app.logger.Warn(fmt.Errorf("failover hook failed -> %w", err).Error(), "output", run.Output)
+	} else {
+		app.logger.Info(fmt.Sprintf("failover hook finished in %v", run.FinishedAt.Sub(run.StartedAt)), "output", run.Output)
+	}
+
+	failover.Hook(run)
+}
@@ -1,7 +1,20 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/calmitchell617/reserva/internal/data"
+	"github.com/calmitchell617/reserva/internal/replicas"
+	"github.com/calmitchell617/reserva/internal/results"
+	"github.com/calmitchell617/reserva/internal/stats"
 )
 
 type SafeInt64Map struct {
@@ -34,3 +47,264 @@ func (s *SafeInt64Map) Remove(element int64) {
 
 	delete(s.valMap, element)
 }
+
+// wait waits for all in-flight transfers to finish. Once ctx is cancelled
+// it gives up after timeout, so a stuck query cannot hold back the final
+// report.
+func wait(ctx context.Context, eg *errgroup.Group, timeout time.Duration) error {
+	done := make(chan error, 1)
+
+	go func() {
+		done <- eg.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %v waiting for in-flight transfers", timeout)
+	}
+}
+
+// logCounts logs counts keyed by error class, in reporting order. Nothing is
+// logged if there are no counts.
+func logCounts(logger *slog.Logger, msg string, counts map[string]int64) {
+	if len(counts) == 0 {
+		return
+	}
+
+	var attrs []any
+
+	for _, class := range data.ErrorClasses {
+		if n, ok := counts[class.String()]; ok {
+			attrs = append(attrs, class.String(), n)
+		}
+	}
+
+	logger.Info(msg, attrs...)
+}
+
+func parseIsolation(level string) (sql.IsolationLevel, error) {
+	switch level {
+	case "default":
+		return sql.LevelDefault, nil
+	case "read-committed":
+		return sql.LevelReadCommitted, nil
+	case "repeatable-read":
+		return sql.LevelRepeatableRead, nil
+	case "serializable":
+		return sql.LevelSerializable, nil
+	}
+	return sql.LevelDefault, fmt.Errorf("unsupported isolation level %q", level)
+}
+
+// logLatencies logs the latency percentiles of each step, in workflow order.
+func logLatencies(logger *slog.Logger, name string, latencies map[string]*stats.Distribution) {
+	for _, step := range steps {
+		d, ok := latencies[step]
+		if !ok {
+			continue
+		}
+
+		logger.Info(fmt.Sprintf("%v %v latency", name, step),
+			"count", d.Count,
+			"mean", d.Mean(),
+			"p50", d.Quantile(0.5),
+			"p90", d.Quantile(0.9),
+			"p99", d.Quantile(0.99),
+			"max", d.Max(),
+		)
+	}
+}
+
+// driverName returns the client driver used for the configured engine, as
+// recorded in the results.
+func driverName(cfg config) string {
+	switch cfg.db.engine {
+	case "postgresql":
+		switch cfg.db.pgDriver {
+		case "pgx":
+			return "pgx"
+		default:
+			return "lib/pq"
+		}
+	case "mariadb", "mysql":
+		return "go-sql-driver/mysql"
+	}
+	return ""
+}
+
+func logReplicaLag(logger *slog.Logger, name string, lag *stats.LagSummary) {
+	logger.Info(fmt.Sprintf("%v replica lag (heartbeat)", name),
+		"samples", lag.Heartbeat.Count,
+		"p50", lag.Heartbeat.Quantile(0.5),
+		"p90", lag.Heartbeat.Quantile(0.9),
+		"p99", lag.Heartbeat.Quantile(0.99),
+		"max", lag.Heartbeat.Max(),
+	)
+
+	if lag.Server != nil {
+		logger.Info(fmt.Sprintf("%v replica lag (reported by replica)", name),
+			"samples", lag.Server.Count,
+			"p50", lag.Server.Quantile(0.5),
+			"p90", lag.Server.Quantile(0.9),
+			"p99", lag.Server.Quantile(0.99),
+			"max", lag.Server.Max(),
+		)
+	}
+}
+
+func logReadYourWrites(logger *slog.Logger, name string, ryw *stats.ReadYourWritesSummary) {
+	logger.Info(fmt.Sprintf("%v read-your-writes", name),
+		"checks", ryw.Checks,
+		"stale", ryw.Stale,
+		"timed_out", ryw.TimedOut,
+		"stale_rate", fmt.Sprintf("%.2f%%", ryw.StaleRate*100),
+		"p50_delay", ryw.Delay.Quantile(0.5),
+		"p99_delay", ryw.Delay.Quantile(0.99),
+		"max_delay", ryw.Delay.Max(),
+	)
+}
+
+// logReplicas logs how many reads went to each read replica and how fast
+// they were, and its own read-your-writes checks and lag.
+func logReplicas(logger *slog.Logger, name string, summaries []replicas.Summary) {
+	for _, r := range summaries {
+		logger.Info(fmt.Sprintf("%v %v reads", name, r.Name),
+			"queries", r.Queries,
+			"errors", r.Errors,
+			"healthy", r.Healthy,
+			"mean", r.Latency.Mean(),
+			"p50", r.Latency.Quantile(0.5),
+			"p99", r.Latency.Quantile(0.99),
+			"max", r.Latency.Max(),
+		)
+
+		if r.ReadYourWrites != nil {
+			logReadYourWrites(logger, fmt.Sprintf("%v %v", name, r.Name), r.ReadYourWrites)
+		}
+		if r.Lag != nil {
+			logReplicaLag(logger, fmt.Sprintf("%v %v", name, r.Name), r.Lag)
+		}
+	}
+}
+
+func logClient(logger *slog.Logger, name string, client *stats.ClientSummary) {
+	args := []any{
+		"max_goroutines", client.MaxGoroutines,
+		"sched_latency_p99", client.SchedLatency.Quantile(0.99),
+		"gc_pause_max", client.GCPauses.Max(),
+		"loop_lag_p99", client.LoopLag.Quantile(0.99),
+	}
+	if client.CPU != nil {
+		args = append([]any{"cpu", fmt.Sprintf("%.0f%%", *client.CPU*100)}, args...)
+	}
+
+	logger.Info(fmt.Sprintf("%v client", name), args...)
+
+	if client.ClientBound {
+		logger.Warn(fmt.Sprintf("%v was client-bound, its results reflect reserva more than the database: %v", name, strings.Join(client.Reasons, ", ")))
+	}
+}
+
+func logSharding(logger *slog.Logger, name string, sharding *results.Sharding) {
+	summary := sharding.Summary
+
+	logger.Info(fmt.Sprintf("%v sharded across %v databases", name, sharding.Shards),
+		"by", sharding.By,
+		"cross_shard", sharding.CrossShard,
+		"transfers_per_shard", summary.Transfers,
+		"cross_shard_transfers", summary.CrossShard,
+		"cross_shard_rate", fmt.Sprintf("%.1f%%", summary.CrossShardRate*100),
+		"compensations", summary.Compensations,
+	)
+
+	if summary.InDoubt > 0 {
+		logger.Warn(fmt.Sprintf("%v left %v cross-shard transfers in doubt, applied on one shard but maybe not the other", name, summary.InDoubt))
+	}
+}
+
+func logServerStats(logger *slog.Logger, name string, server *results.ServerStats) {
+	args := []any{"counters", len(server.Counters), "statements", len(server.Statements)}
+	if server.CacheHitRatio != nil {
+		args = append(args, "cache_hit_ratio", fmt.Sprintf("%.4f", *server.CacheHitRatio))
+	}
+
+	logger.Info(fmt.Sprintf("%v server stats", name), args...)
+
+	for _, st := range server.Statements[:min(len(server.Statements), 5)] {
+		logger.Info(fmt.Sprintf("%v busiest statement", name),
+			"calls", st.Calls,
+			"total_time_ms", fmt.Sprintf("%.1f", st.TotalTimeMs),
+			"query", strings.Join(strings.Fields(st.Query), " "),
+		)
+	}
+}
+
+func logFailover(logger *slog.Logger, name string, failover *stats.FailoverSummary) {
+	logger.Info(fmt.Sprintf("%v failover", name),
+		"downtime", failover.Downtime,
+		"outages", len(failover.Outages),
+	)
+
+	for _, o := range failover.Outages {
+		logger.Info(fmt.Sprintf("%v outage", name),
+			"start", o.Start.Format(time.RFC3339Nano),
+			"duration", o.Duration,
+			"recovered", o.Recovered,
+			"pool_recovery", o.PoolRecovery,
+		)
+	}
+
+	for class, example := range failover.ErrorExamples {
+		logger.Info(fmt.Sprintf("%v error seen", name), "class", class, "example", example)
+	}
+
+	if failover.Checked {
+		logger.Info(fmt.Sprintf("%v acknowledged transfers", name),
+			"acknowledged", failover.Acknowledged,
+			"missing", failover.Missing,
+		)
+	}
+}
+
+// logResult logs the final report of a run.
+func logResult(logger *slog.Logger, result *results.Result) {
+	name, summary := result.Name, result.Summary
+
+	if result.Interrupted {
+		logger.Info(fmt.Sprintf("%v interrupted after %v actions in %v, rate of %.0f per second", name, summary.Actions, summary.Elapsed, summary.Rate))
+	} else {
+		logger.Info(fmt.Sprintf("%v completed %v actions in %v, rate of %.0f per second", name, summary.Actions, summary.Elapsed, summary.Rate))
+	}
+
+	logger.Info(fmt.Sprintf("%v opened %v connections, rate of %.1f per second", name, summary.Connections, summary.ConnectionRate))
+	logLatencies(logger, name, summary.Latencies)
+	if summary.ReadYourWrites != nil {
+		logReadYourWrites(logger, name, summary.ReadYourWrites)
+	}
+	if result.ReplicaLag != nil {
+		logReplicaLag(logger, name, result.ReplicaLag)
+	}
+	logReplicas(logger, name, result.Replicas)
+	if result.Failover != nil {
+		logFailover(logger, name, result.Failover)
+	}
+	if result.Sharding != nil && result.Sharding.Summary != nil {
+		logSharding(logger, name, result.Sharding)
+	}
+	if result.Client != nil {
+		logClient(logger, name, result.Client)
+	}
+	if result.Server != nil {
+		logServerStats(logger, name, result.Server)
+	}
+	logCounts(logger, fmt.Sprintf("%v retries by error class", name), summary.Retries)
+	logCounts(logger, fmt.Sprintf("%v failures by error class", name), summary.Failures)
+}
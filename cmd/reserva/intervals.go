@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/stats"
+)
+
+// sampleIntervals samples the recorder at the end of every -interval of the
+// measurement window, until the window ends. If ctx is done first, as when
+// the run is interrupted or a replay runs out of operations, the partial
+// interval is sampled. Each interval is also written to the time series, if
+// there is one, and sent to the coordinator of a distributed run.
+func (app *application) sampleIntervals(ctx context.Context) {
+	window := app.recorder.Window
+	length := app.config.interval
+
+	sleepUntil(ctx, window.Start)
+
+	prevPool := app.writeDb.Stats()
+
+	sample := func(t time.Time) {
+		pool := app.writeDb.Stats()
+
+		interval := app.recorder.Sample(t, poolStats(pool, prevPool))
+		prevPool = pool
+
+		if app.timeseries != nil {
+			err := app.timeseries.write(app.config.name, window, interval)
+			if err != nil {
+				app.logger.Warn(fmt.Errorf("error writing time series -> %w", err).Error())
+			}
+		}
+
+		if app.config.agent != nil {
+			app.config.agent.interval(interval)
+		}
+	}
+
+	for next := window.Start.Add(length); ; next = next.Add(length) {
+		if next.After(window.End) {
+			next = window.End
+		}
+
+		sleepUntil(ctx, next)
+
+		if ctx.Err() != nil {
+			if now := time.Now(); now.After(window.Start) {
+				if now.After(next) {
+					now = next
+				}
+				sample(now)
+			}
+			return
+		}
+
+		sample(next)
+
+		if !next.Before(window.End) {
+			return
+		}
+	}
+}
+
+func poolStats(cur, prev sql.DBStats) *stats.PoolStats {
+	return &stats.PoolStats{
+		Open:         cur.OpenConnections,
+		InUse:        cur.InUse,
+		Idle:         cur.Idle,
+		WaitCount:    cur.WaitCount - prev.WaitCount,
+		WaitDuration: cur.WaitDuration - prev.WaitDuration,
+	}
+}
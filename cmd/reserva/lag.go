@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/data"
+	"github.com/calmitchell617/reserva/internal/stats"
+)
+
+// probeLag measures how far each read replica is behind the primary until
+// ctx is done. Every interval it writes a heartbeat to the primary and polls
+// each replica's own pool until the heartbeat shows up, and also asks each
+// replica how far behind it thinks it is. Every replica's samples are recorded
+// on it, and the worst of them in lag.
+func (app *application) probeLag(ctx context.Context, heartbeats data.HeartbeatModel, lag *stats.LagRecorder) {
+	interval := app.config.db.lagInterval
+
+	replicas := app.replicas.Replicas()
+
+	serverLag := make([]bool, len(replicas))
+	for i := range serverLag {
+		serverLag[i] = true
+	}
+
+	for ctx.Err() == nil {
+		written := time.Now()
+		next := written.Add(interval)
+
+		err := heartbeats.Write(ctx, written, app.config.db.engine)
+		if err != nil {
+			if ctx.Err() == nil {
+				app.logger.Warn(fmt.Errorf("error writing heartbeat -> %w", err).Error())
+			}
+			sleepUntil(ctx, next)
+			continue
+		}
+
+		committed := time.Now()
+		samples := make([]stats.LagSample, len(replicas))
+
+		var wg sync.WaitGroup
+
+		for i, replica := range replicas {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				replicaHeartbeats := data.HeartbeatModel{
+					ReadDb:       replica.Pool,
+					QueryTimeout: heartbeats.QueryTimeout,
+				}
+
+				samples[i] = app.probeReplicaLag(ctx, replicaHeartbeats, replica.Name, written, committed, next, &serverLag[i])
+			}()
+		}
+
+		wg.Wait()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		worst := stats.LagSample{At: committed}
+
+		for i, sample := range samples {
+			replicas[i].RecordLag(sample)
+
+			worst.Heartbeat = max(worst.Heartbeat, sample.Heartbeat)
+			if sample.Server != nil && (worst.Server == nil || *sample.Server > *worst.Server) {
+				worst.Server = sample.Server
+			}
+		}
+
+		lag.Record(worst)
+
+		sleepUntil(ctx, next)
+	}
+}
+
+// probeReplicaLag polls one replica until the heartbeat written at written
+// shows up. If it hasn't by next, when the next one is due, the lag is
+// recorded as at least that long. serverLag is cleared if the replica can't
+// report its own lag, so it isn't asked again.
+func (app *application) probeReplicaLag(ctx context.Context, heartbeats data.HeartbeatModel, name string, written, committed, next time.Time, serverLag *bool) stats.LagSample {
+	pollInterval := max(time.Millisecond, app.config.db.lagInterval/100)
+
+	sample := stats.LagSample{At: committed}
+
+	for {
+		seen, err := heartbeats.Read(ctx)
+		now := time.Now()
+
+		if err == nil && !seen.Before(written) {
+			sample.Heartbeat = now.Sub(committed)
+			break
+		}
+
+		if now.After(next) || ctx.Err() != nil {
+			sample.Heartbeat = now.Sub(committed)
+			break
+		}
+
+		sleepUntil(ctx, now.Add(pollInterval))
+	}
+
+	if *serverLag {
+		d, err := heartbeats.ServerLag(ctx, app.config.db.engine)
+		switch {
+		case err == nil:
+			sample.Server = &d
+		case errors.Is(err, data.ErrRecordNotFound):
+		case ctx.Err() == nil:
+			app.logger.Warn(fmt.Errorf("error reading %v status, only measuring its heartbeat lag -> %w", name, err).Error())
+			*serverLag = false
+		}
+	}
+
+	return sample
+}
+
+func sleepUntil(ctx context.Context, t time.Time) {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
@@ -6,368 +6,1157 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"math/rand"
 	"os"
+	"os/signal"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 
 	"github.com/calmitchell617/reserva/internal/data"
+	"github.com/calmitchell617/reserva/internal/history"
+	"github.com/calmitchell617/reserva/internal/recording"
+	"github.com/calmitchell617/reserva/internal/replicas"
+	"github.com/calmitchell617/reserva/internal/results"
+	"github.com/calmitchell617/reserva/internal/stats"
+	"github.com/calmitchell617/reserva/internal/tracing"
 
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/lib/pq"
 )
 
 type config struct {
 	name string
 	db   struct {
-		readDsn        string
-		writeDsn       string
-		hasReadReplica bool
-		maxIdleTime    time.Duration
-		engine         string
-		queryTimeout   time.Duration
+		readDsns        []string
+		readPolicy      string
+		healthInterval  time.Duration
+		writeDsns       []string
+		shardBy         string
+		crossShard      string
+		hasReadReplica  bool
+		maxIdleTime     time.Duration
+		maxLifetime     time.Duration
+		connMode        string
+		engine          string
+		pgDriver        string
+		queryTimeout    time.Duration
+		txMode          string
+		isolation       string
+		isolationLevel  sql.IsolationLevel
+		prepared        bool
+		lagInterval     time.Duration
+		rywSample       float64
+		rywTimeout      time.Duration
+		consistentReads bool
 	}
 	duration         time.Duration
+	warmup           time.Duration
+	cooldown         time.Duration
 	concurrencyLimit int
 	deletes          bool
 	kindaRandom      bool
+	shutdownTimeout  time.Duration
+	resultsPath      string
+	seed             int64
+	targetsPath      string
+	historyDir       string
+	dashboard        bool
+	timeseriesPath   string
+	tracePath        string
+	recordPath       string
+	pprofAddr        string
+	clientCPU        float64
+	clientLatency    time.Duration
+	traceSample      float64
+	traceSlow        time.Duration
+	serverStats      bool
+	explain          bool
+	explainAnalyze   bool
+	serverStatsEvery time.Duration
+	interval         time.Duration
+	targetsMode      string
+	failover         struct {
+		enabled   bool
+		hook      string
+		at        time.Duration
+		ackLog    string
+		threshold time.Duration
+	}
+	retry struct {
+		maxRetries int
+		backoff    time.Duration
+		maxBackoff time.Duration
+		jitter     float64
+	}
+	cluster struct {
+		listen     string
+		agents     int
+		startDelay time.Duration
+	}
+
+	// agent is set when the run is one part of a distributed run
+	agent *agentHooks
+
+	// replay is set when the run replays operations from a file instead of
+	// choosing them at random
+	replay *replaySource
 }
 
 type application struct {
-	models       data.Models
-	queryTimeout time.Duration
+	config      config
+	logger      *slog.Logger
+	writeDb     *sql.DB
+	readDb      data.DB
+	replicas    *replicas.Set
+	models      data.Models
+	workers     chan *worker
+	users       *data.SafeUserSlice
+	recorder    *stats.Recorder
+	retryPolicy retryPolicy
+	transferIds *SafeInt64Map
+	shards      *shardSet
+	isolation   sql.IsolationLevel
+	rywSlots    chan struct{}
+	rywChecks   sync.WaitGroup
+	failover    *stats.FailoverRecorder
+	acks        *ackLog
+	rng         *rand.Rand
+	inFlight    atomic.Int64
+	timeseries  *timeseriesWriter
+	tracer      *tracing.Tracer
 }
 
 func main() {
-	var cfg config
-
-	flag.StringVar(&cfg.name, "name", "", "Name of system")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "proxy":
+			runProxy(os.Args[2:])
+			return
+		case "compare":
+			runCompare(os.Args[2:])
+			return
+		case "report":
+			runReport(os.Args[2:])
+			return
+		case "coordinator":
+			runCoordinator(os.Args[2:])
+			return
+		case "agent":
+			runAgent(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		}
+	}
 
-	flag.StringVar(&cfg.db.writeDsn, "write-dsn", "", "Write DSN")
-	flag.StringVar(&cfg.db.readDsn, "read-dsn", "", "Read DSN")
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags := configFlags(fs)
+	fs.Parse(os.Args[1:])
 
-	flag.DurationVar(&cfg.db.maxIdleTime, "db-max-idle-time", 15*time.Minute, "Max DB connection idle time")
+	execute(*flags)
+}
 
-	flag.DurationVar(&cfg.db.queryTimeout, "queryTimeout", 1*time.Minute, "Max DB query time")
+// execute runs the workload, or a replay, against the configured target or
+// targets, then reports the results and exits.
+func execute(cfg config) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
-	flag.StringVar(&cfg.db.engine, "engine", "", "Database engine")
+	var dash *dashboard
 
-	flag.DurationVar(&cfg.duration, "duration", 123*time.Minute, "Test duration")
-	flag.IntVar(&cfg.concurrencyLimit, "concurrency-limit", 64, "Concurrency limit")
-	flag.BoolVar(&cfg.deletes, "deletes", true, "Perform deletes during benchmark")
-	flag.BoolVar(&cfg.kindaRandom, "kinda-random", false, "make user selection kinda random")
+	if cfg.dashboard {
+		if isTerminal(os.Stdout) {
+			dash = newDashboard(os.Stdout)
+			logger = slog.New(slog.NewTextHandler(dash, nil))
+		} else {
+			logger.Info("stdout is not a terminal, logging progress instead of showing the dashboard")
+		}
+	}
 
-	flag.Parse()
+	// every target runs the same sequence of transfers
+	if cfg.seed == 0 {
+		cfg.seed = time.Now().UnixNano()
+	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	// the root context is cancelled on SIGINT or SIGTERM, which stops new
+	// transfers from being scheduled and cancels in-flight queries
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if cfg.db.engine == "" {
-		logger.Error("engine is required")
+	if cfg.interval <= 0 {
+		logger.Error("-interval must be positive")
 		os.Exit(1)
 	}
 
-	if cfg.name == "" {
-		cfg.name = cfg.db.engine
+	var timeseries *timeseriesWriter
+
+	if cfg.timeseriesPath != "" {
+		var err error
+
+		timeseries, err = newTimeseriesWriter(cfg.timeseriesPath)
+		if err != nil {
+			logger.Error(fmt.Errorf("error opening time series: %w", err).Error())
+			os.Exit(1)
+		}
 	}
 
-	cfg.db.hasReadReplica = true
+	if cfg.traceSample < 0 || cfg.traceSample > 1 {
+		logger.Error("-trace-sample must be between 0 and 1")
+		os.Exit(1)
+	}
 
-	if cfg.db.readDsn == "" {
-		cfg.db.hasReadReplica = false
+	if cfg.clientCPU <= 0 || cfg.clientCPU > 1 {
+		logger.Error("-client-cpu-limit must be above 0 and at most 1")
+		os.Exit(1)
 	}
 
-	writeDb, readDb, err := openDB(cfg)
-	if err != nil {
-		logger.Error(fmt.Errorf("error opening database connection: %w", err).Error())
+	if cfg.recordPath != "" && cfg.targetsPath != "" {
+		logger.Error("-record can't be used with -targets")
 		os.Exit(1)
 	}
-	defer writeDb.Close()
-	if cfg.db.hasReadReplica {
-		defer readDb.Close()
+
+	if cfg.pprofAddr != "" {
+		go servePprof(cfg.pprofAddr, logger)
 	}
 
-	logger.Info("database connection pool established")
+	var tracer *tracing.Tracer
 
-	app := &application{
-		models:       data.NewModels(writeDb, readDb, cfg.db.queryTimeout),
-		queryTimeout: cfg.db.queryTimeout,
+	if cfg.tracePath != "" {
+		exporter, err := tracing.NewExporter(cfg.tracePath)
+		if err != nil {
+			logger.Error(fmt.Errorf("error opening trace exporter: %w", err).Error())
+			os.Exit(1)
+		}
+
+		tracer = tracing.New(exporter, cfg.traceSample, cfg.traceSlow, tracing.String("service.name", "reserva"))
 	}
 
-	users, err := app.models.Users.GetAll(cfg.db.engine)
-	if err != nil {
-		logger.Error(fmt.Errorf("error getting users: %w", err).Error())
-		os.Exit(1)
+	dashCtx, stopDash := context.WithCancel(ctx)
+	dashDone := make(chan struct{})
+
+	if dash != nil {
+		go func() {
+			defer close(dashDone)
+			dash.run(dashCtx)
+		}()
+	} else {
+		close(dashDone)
 	}
 
-	start := time.Now()
+	var rs []*results.Result
 
-	eg := errgroup.Group{}
+	if cfg.targetsPath != "" {
+		targets, err := loadTargets(cfg.targetsPath)
+		if err != nil {
+			logger.Error(fmt.Errorf("error loading targets: %w", err).Error())
+			os.Exit(1)
+		}
 
-	// set limit
-	eg.SetLimit(cfg.concurrencyLimit)
+		rs = runTargets(ctx, stop, cfg, targets, logger, dash, timeseries, tracer)
 
-	// initialize atomic counter
-	var transferCounter int32
-	var deleteCounter int32
+		stopDash()
+		<-dashDone
 
-	transferIds := &SafeInt64Map{
-		valMap: make(map[int64]bool, 0),
-	}
+		for _, result := range rs {
+			// targets that failed to start have nothing to report
+			if !result.StartedAt.IsZero() {
+				logResult(logger, result)
+			}
+		}
 
-	logger.Info(fmt.Sprintf("Starting test of %v", cfg.name))
+		err = results.WriteComparison(os.Stdout, rs)
+		if err != nil {
+			logger.Error(fmt.Errorf("error writing comparison: %w", err).Error())
+		}
+	} else {
+		err := validate(&cfg)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
 
-	lastTransferCheckTime := time.Now()
-	var lastTransferPlusDeletes int32 = 0
+		result, err := run(ctx, stop, cfg, logger, dash, timeseries, tracer)
 
-	for time.Since(start) < cfg.duration {
+		stopDash()
+		<-dashDone
 
-		if time.Since(lastTransferCheckTime) > 3*time.Second {
-			transferPlusDeletes := atomic.LoadInt32(&transferCounter) + atomic.LoadInt32(&deleteCounter)
-			logger.Info(fmt.Sprintf("%v completing %.0f actions per second", cfg.name, float64(transferPlusDeletes-lastTransferPlusDeletes)/time.Since(lastTransferCheckTime).Seconds()))
-			lastTransferCheckTime = time.Now()
-			lastTransferPlusDeletes = transferPlusDeletes
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
 		}
 
-		eg.Go(func() error {
+		logResult(logger, result)
 
-			// get a random amount
-			amount := rand.Int63n(1000)
+		rs = append(rs, result)
+	}
 
-			var acquiringUserChoice data.User
-			var issuingUserChoice data.User
+	finish(cfg, logger, rs, timeseries, tracer)
+}
 
-			// get two random users
-			if cfg.kindaRandom {
-				_, acquiringUserChoice = users.GetKindaRandom()
-				_, issuingUserChoice = users.GetKindaRandom()
-			} else {
-				_, acquiringUserChoice = users.GetRandom()
-				_, issuingUserChoice = users.GetRandom()
-			}
+// finish closes the time series and trace exporter, writes the results to the
+// results file and history, and exits with status 1 if a run failed or 130 if
+// one was interrupted.
+func finish(cfg config, logger *slog.Logger, rs []*results.Result, timeseries *timeseriesWriter, tracer *tracing.Tracer) {
+	if timeseries != nil {
+		err := timeseries.close()
+		if err != nil {
+			logger.Error(fmt.Errorf("error writing time series: %w", err).Error())
+			os.Exit(1)
+		}
+		logger.Info(fmt.Sprintf("time series written to %v", cfg.timeseriesPath))
+	}
 
-			acquiringAccountID := acquiringUserChoice.AccountID
+	if tracer != nil {
+		err := tracer.Close()
+		if err != nil {
+			logger.Error(fmt.Errorf("error exporting traces: %w", err).Error())
+			os.Exit(1)
+		}
+		if dropped := tracer.Dropped(); dropped > 0 {
+			logger.Warn(fmt.Sprintf("dropped %v traces the exporter couldn't keep up with", dropped))
+		}
+		logger.Info(fmt.Sprintf("traces exported to %v", cfg.tracePath))
+	}
 
-			// ensure the users are different
-			if acquiringUserChoice.ID == issuingUserChoice.ID {
-				return nil
-			}
+	if cfg.resultsPath != "" {
+		var err error
+
+		if len(rs) == 1 {
+			err = results.Write(cfg.resultsPath, rs[0])
+		} else {
+			err = results.WriteAll(cfg.resultsPath, rs)
+		}
+		if err != nil {
+			logger.Error(fmt.Errorf("error writing results: %w", err).Error())
+			os.Exit(1)
+		}
+		logger.Info(fmt.Sprintf("results written to %v", cfg.resultsPath))
+	}
 
-			// get acquiring user and check permission with token
-			users, err := app.models.Users.GetForToken(acquiringUserChoice.Token.Hash, cfg.db.engine)
+	if cfg.historyDir != "" {
+		for _, result := range rs {
+			entry, err := history.Save(cfg.historyDir, result)
 			if err != nil {
-				// err = fmt.Errorf("error getting user -> %w", err)
-				// logger.Error(err.Error())
-				time.Sleep(time.Second)
-				return err
+				logger.Error(fmt.Errorf("error saving results to history: %w", err).Error())
+				os.Exit(1)
 			}
+			logger.Info(fmt.Sprintf("%v saved to history as %v", result.Name, entry.ID))
+		}
+	}
+
+	failed, interrupted := false, false
+	for _, result := range rs {
+		failed = failed || result.Error != ""
+		interrupted = interrupted || result.Interrupted
+	}
+
+	switch {
+	case failed:
+		os.Exit(1)
+	case interrupted:
+		os.Exit(130)
+	}
+}
+
+// configFlags defines the flags of a run on fs, which fill in the returned
+// config when fs is parsed.
+func configFlags(fs *flag.FlagSet) *config {
+	var cfg config
+
+	fs.StringVar(&cfg.name, "name", "", "Name of system")
+
+	fs.Func("write-dsn", "Write DSN (repeat to shard accounts across several databases)", func(dsn string) error {
+		cfg.db.writeDsns = append(cfg.db.writeDsns, dsn)
+		return nil
+	})
+	fs.StringVar(&cfg.db.shardBy, "shard-by", "hash", "How accounts are split across shards: hash or range of account IDs, as the shards were loaded")
+	fs.StringVar(&cfg.db.crossShard, "cross-shard", "saga", "How transfers between shards are run: saga (debit, credit and refund on failure) or xa (prepared transactions)")
+	fs.Func("read-dsn", "Read DSN (repeat for several read replicas)", func(dsn string) error {
+		cfg.db.readDsns = append(cfg.db.readDsns, dsn)
+		return nil
+	})
+	fs.StringVar(&cfg.db.readPolicy, "read-policy", replicas.RoundRobin, "How reads are spread over read replicas: round-robin, least-in-flight or latency-weighted")
+	fs.DurationVar(&cfg.db.healthInterval, "replica-health-interval", time.Second, "How often to health check read replicas (0 disables)")
+	fs.Float64Var(&cfg.db.rywSample, "ryw-sample", 0, "Fraction of transfers to check for read-your-writes consistency on the read replica (0-1)")
+	fs.DurationVar(&cfg.db.rywTimeout, "ryw-timeout", 5*time.Second, "Max time to wait for a transfer to show up on the read replica")
+	fs.BoolVar(&cfg.db.consistentReads, "consistent-reads", false, "Send the balance check to the primary instead of the read replica")
+	fs.DurationVar(&cfg.db.lagInterval, "lag-interval", time.Second, "How often to measure read replica lag (0 disables)")
+
+	fs.DurationVar(&cfg.db.maxIdleTime, "db-max-idle-time", 15*time.Minute, "Max DB connection idle time")
+	fs.DurationVar(&cfg.db.maxLifetime, "db-max-lifetime", 0, "Max DB connection lifetime (0 means unlimited)")
+	fs.StringVar(&cfg.db.connMode, "conn-mode", "pool", "Connection mode: pool (shared pool), churn (new connection per transfer) or dedicated (one connection per worker)")
+
+	fs.DurationVar(&cfg.db.queryTimeout, "queryTimeout", 1*time.Minute, "Max DB query time")
+
+	fs.StringVar(&cfg.db.engine, "engine", "", "Database engine")
+	fs.StringVar(&cfg.db.pgDriver, "pg-driver", "pq", "PostgreSQL driver: pq (lib/pq) or pgx (pgx through database/sql)")
+
+	fs.StringVar(&cfg.db.txMode, "tx-mode", "procedure", "How transfers are run: procedure (transfer_funds), client (client-side transaction) or cte (single statement, postgresql only)")
+	fs.BoolVar(&cfg.db.prepared, "prepared", false, "Prepare each workload query once and reuse the prepared statement")
+	fs.StringVar(&cfg.db.isolation, "isolation", "default", "Isolation level of client-side transactions: default, read-committed, repeatable-read or serializable")
+
+	fs.DurationVar(&cfg.duration, "duration", 123*time.Minute, "Test duration")
+	fs.DurationVar(&cfg.warmup, "warmup", 0, "Time to run the workload before measuring")
+	fs.DurationVar(&cfg.cooldown, "cooldown", 0, "Time to keep running the workload after measuring")
+	fs.IntVar(&cfg.concurrencyLimit, "concurrency-limit", 64, "Concurrency limit")
+	fs.BoolVar(&cfg.deletes, "deletes", true, "Perform deletes during benchmark")
+	fs.BoolVar(&cfg.kindaRandom, "kinda-random", false, "make user selection kinda random")
+	fs.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", 30*time.Second, "Max time to wait for in-flight transfers after an interrupt")
+	fs.StringVar(&cfg.resultsPath, "results", "", "Write the final report as JSON to this file")
+	fs.Int64Var(&cfg.seed, "seed", 0, "Seed of the workload's random choices (0 picks one from the clock)")
+	fs.BoolVar(&cfg.dashboard, "dashboard", false, "Show a live dashboard instead of logging progress, if stdout is a terminal")
+	fs.StringVar(&cfg.timeseriesPath, "timeseries", "", "Write a CSV row for every interval of the measurement to this file")
+	fs.DurationVar(&cfg.interval, "interval", time.Second, "Length of the intervals the measurement is sampled in")
+	fs.StringVar(&cfg.tracePath, "trace", "", "Export a trace of sampled transfers as OTLP JSON to this file, or to a collector at an http:// address")
+	fs.Float64Var(&cfg.traceSample, "trace-sample", 0.01, "Fraction of transfers to trace, from 0 to 1")
+	fs.DurationVar(&cfg.traceSlow, "trace-slow", 0, "Also trace every transfer that takes at least this long (0 disables)")
+	fs.StringVar(&cfg.recordPath, "record", "", "Record every operation of the workload to this file, to replay with reserva replay")
+	fs.Float64Var(&cfg.clientCPU, "client-cpu-limit", 0.9, "Mark the results client-bound if reserva uses at least this share of its CPU, from 0 to 1")
+	fs.DurationVar(&cfg.clientLatency, "client-latency-limit", 10*time.Millisecond, "Mark the results client-bound if reserva's goroutines wait at least this long to be scheduled at p99")
+	fs.StringVar(&cfg.pprofAddr, "pprof", "", "Serve pprof profiles of reserva itself at this address, such as localhost:6060")
+	fs.BoolVar(&cfg.serverStats, "server-stats", true, "Collect the database server's statistics before, during and after the run")
+	fs.DurationVar(&cfg.serverStatsEvery, "server-stats-interval", 10*time.Second, "How often to sample the server's statistics during the run (0 disables)")
+	fs.BoolVar(&cfg.explain, "explain", true, "Capture the plans of the workload's queries before the run")
+	fs.BoolVar(&cfg.explainAnalyze, "explain-analyze", false, "Run the queries when capturing their plans, rolling back writes")
+	fs.StringVar(&cfg.historyDir, "history", "", "Keep the results of every run in this directory")
+	fs.StringVar(&cfg.targetsPath, "targets", "", "JSON file of several targets to run, instead of -engine and the DSNs")
+	fs.StringVar(&cfg.targetsMode, "targets-mode", "concurrent", "How several targets are run: concurrent or sequential")
+
+	fs.BoolVar(&cfg.failover.enabled, "failover", false, "Keep running through a primary failover and report downtime and lost transfers")
+	fs.StringVar(&cfg.failover.hook, "failover-hook", "", "Shell command that triggers the failover, run -failover-at into the measurement")
+	fs.DurationVar(&cfg.failover.at, "failover-at", 0, "When to run -failover-hook, from the start of the measurement (0 means half way through)")
+	fs.StringVar(&cfg.failover.ackLog, "ack-log", "", "Log the ID of every acknowledged transfer to this file (a temporary file by default)")
+	fs.DurationVar(&cfg.failover.threshold, "outage-threshold", time.Second, "Shortest period without successful transfers that counts as an outage")
+
+	fs.StringVar(&cfg.cluster.listen, "listen", "localhost:7070", "Address the coordinator listens on for agents (coordinator only)")
+	fs.IntVar(&cfg.cluster.agents, "agents", 1, "Number of agents to wait for (coordinator only)")
+	fs.DurationVar(&cfg.cluster.startDelay, "start-delay", 2*time.Second, "How long after the last agent is ready they all start (coordinator only)")
+
+	fs.IntVar(&cfg.retry.maxRetries, "retries", 3, "Max retries of an operation that fails with a retryable error")
+	fs.DurationVar(&cfg.retry.backoff, "retry-backoff", 10*time.Millisecond, "Delay before the first retry, doubled on every retry")
+	fs.DurationVar(&cfg.retry.maxBackoff, "retry-max-backoff", time.Second, "Max delay between retries")
+	fs.Float64Var(&cfg.retry.jitter, "retry-jitter", 0.5, "Fraction of the retry delay that is randomized (0-1)")
+
+	return &cfg
+}
+
+// validate checks the configuration of a run and fills in what is derived
+// from it.
+func validate(cfg *config) error {
+	if cfg.db.engine == "" {
+		return errors.New("engine is required")
+	}
 
-			// make sure the acquiring user has permission to request payments
-			var acquiringUser *data.User
+	switch {
+	case cfg.db.txMode != "procedure" && cfg.db.txMode != "client" && cfg.db.txMode != "cte":
+		return fmt.Errorf("unsupported tx mode %q", cfg.db.txMode)
+	case cfg.db.txMode == "cte" && cfg.db.engine != "postgresql":
+		return errors.New("-tx-mode=cte is only supported by postgresql")
+	}
+
+	isolation, err := parseIsolation(cfg.db.isolation)
+	if err != nil {
+		return err
+	}
+
+	if cfg.db.txMode != "client" && isolation != sql.LevelDefault {
+		return errors.New("isolation can only be set with -tx-mode=client")
+	}
+
+	cfg.db.isolationLevel = isolation
+
+	if cfg.db.connMode != "pool" && cfg.db.connMode != "churn" && cfg.db.connMode != "dedicated" {
+		return fmt.Errorf("unsupported connection mode %q", cfg.db.connMode)
+	}
+
+	cfg.db.hasReadReplica = len(cfg.db.readDsns) > 0
+
+	switch {
+	case len(cfg.db.writeDsns) == 0:
+		return errors.New("-write-dsn is required")
+	case cfg.db.shardBy != "hash" && cfg.db.shardBy != "range":
+		return fmt.Errorf("unsupported shard-by %q", cfg.db.shardBy)
+	case cfg.db.crossShard != "saga" && cfg.db.crossShard != "xa":
+		return fmt.Errorf("unsupported cross-shard mode %q", cfg.db.crossShard)
+	}
+
+	if len(cfg.db.writeDsns) > 1 {
+		switch {
+		case cfg.db.connMode != "pool":
+			return errors.New("several -write-dsn shards require -conn-mode=pool")
+		case cfg.db.hasReadReplica:
+			return errors.New("-read-dsn can't be used with several -write-dsn shards")
+		case cfg.failover.enabled:
+			return errors.New("-failover can't be used with several -write-dsn shards")
+		}
+	}
+
+	if cfg.db.rywSample > 0 && !cfg.db.hasReadReplica {
+		return errors.New("-ryw-sample requires -read-dsn")
+	}
+
+	if cfg.failover.hook != "" && !cfg.failover.enabled {
+		return errors.New("-failover-hook requires -failover")
+	}
+
+	if cfg.name == "" {
+		cfg.name = cfg.db.engine
+	}
+
+	return nil
+}
+
+// run runs the workload against one target and returns its results. An error
+// is only returned if the run could not be started; errors during the run are
+// recorded in the results. stop restores default signal handling once the
+// run has been interrupted. If dash is not nil, progress is shown on it
+// instead of being logged, and if timeseries is not nil, every interval is
+// written to it.
+func run(ctx context.Context, stop func(), cfg config, logger *slog.Logger, dash *dashboard, timeseries *timeseriesWriter, tracer *tracing.Tracer) (*results.Result, error) {
+	counter := &connCounter{}
+
+	writeDbs, readDbs, err := openDB(cfg, counter)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database connection: %w", err)
+	}
+	for _, db := range append(writeDbs, readDbs...) {
+		defer db.Close()
+	}
+
+	// with several shards, the first one stands in for the database where
+	// only one is used, such as for server stats and query plans
+	writeDb := writeDbs[0]
+
+	logger.Info("database connection pool established")
 
-			for _, user := range users {
-				if user.Token.PermissionID == 1 {
-					acquiringUser = user
-					break
+	var modelWriteDb, modelReadDb data.DB = writeDb, writeDb
+
+	// the workload's queries are prepared before the run starts, so one the
+	// server can't prepare fails the run instead of every transfer
+	reads, writes := data.WorkloadQueries(cfg.db.engine, cfg.db.txMode, len(writeDbs) > 1)
+
+	if cfg.db.prepared {
+		preparedWriteDb := data.NewPreparedDB(writeDb)
+		defer preparedWriteDb.Close()
+
+		err = preparedWriteDb.Prepare(ctx, append(reads, writes...)...)
+		if err != nil {
+			return nil, err
+		}
+
+		modelWriteDb, modelReadDb = preparedWriteDb, preparedWriteDb
+
+		logger.Info("using prepared statements")
+	}
+
+	// reads are spread over the read replicas by a replica set, which sits
+	// in front of each replica's pool
+	var replicaSet *replicas.Set
+	var readDb data.DB = writeDb
+
+	if cfg.db.hasReadReplica {
+		replicaSet, err = replicas.New(cfg.db.readPolicy, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, db := range readDbs {
+			var replicaDb data.DB = db
+
+			if cfg.db.prepared {
+				preparedReadDb := data.NewPreparedDB(db)
+				defer preparedReadDb.Close()
+
+				err = preparedReadDb.Prepare(ctx, reads...)
+				if err != nil {
+					return nil, fmt.Errorf("replica %d -> %w", i+1, err)
 				}
-			}
 
-			if acquiringUser == nil {
-				err = fmt.Errorf("acquiring user not found or does not have permission")
-				logger.Error(err.Error())
-				return err
+				replicaDb = preparedReadDb
 			}
 
-			acquiringUser.AccountID = acquiringAccountID
+			replicaSet.Add(fmt.Sprintf("replica-%d", i+1), db, replicaDb)
+		}
 
-			// get the issuing account info from the card.. this is the info that would come from a POS terminal or payment gateway
-			issuingAccount, card, err := app.models.Accounts.GetFromCard(&issuingUserChoice.Card, cfg.db.engine)
-			if err != nil {
-				err = fmt.Errorf("error getting account from card -> %w", err)
-				logger.Error(err.Error())
-				return err
-			}
+		modelReadDb, readDb = replicaSet, replicaSet
 
-			// check account balance
-			if issuingAccount.Balance < amount {
-				err = errors.New("issuing account has insufficient funds")
-				logger.Error(err.Error())
-				return err
-			}
+		logger.Info(fmt.Sprintf("spreading reads over %v read replicas", len(readDbs)), "policy", cfg.db.readPolicy)
+	}
 
-			// check account frozen status
-			if issuingAccount.Frozen {
-				err = errors.New("issuing account is frozen")
-				logger.Error(err.Error())
-				return err
-			}
+	app := &application{
+		config:   cfg,
+		logger:   logger,
+		writeDb:  writeDb,
+		readDb:   readDb,
+		replicas: replicaSet,
+		retryPolicy: retryPolicy{
+			maxRetries: cfg.retry.maxRetries,
+			backoff:    cfg.retry.backoff,
+			maxBackoff: cfg.retry.maxBackoff,
+			jitter:     cfg.retry.jitter,
+		},
+		transferIds: &SafeInt64Map{
+			valMap: make(map[int64]bool, 0),
+		},
+		isolation:  cfg.db.isolationLevel,
+		rywSlots:   make(chan struct{}, cfg.concurrencyLimit),
+		rng:        rand.New(rand.NewSource(cfg.seed)),
+		timeseries: timeseries,
+		tracer:     tracer,
+	}
 
-			// check card frozen status
-			if card.Frozen {
-				err = errors.New("issuing card is frozen")
-				logger.Error(err.Error())
-				return err
-			}
+	app.models = app.newModels(modelWriteDb, modelReadDb)
 
-			// check card expiration date
-			if card.ExpirationDate.Before(time.Now()) {
-				err = errors.New("issuing card is expired")
-				logger.Error(err.Error())
-				return err
-			}
+	if len(writeDbs) > 1 {
+		app.shards = newShardSet(cfg)
 
-			// check card security code
-			if card.SecurityCode != issuingUserChoice.Card.SecurityCode {
-				err = errors.New("issuing card security code does not match")
-				logger.Error(err.Error())
-				return err
-			}
+		for i, db := range writeDbs {
+			shardDb := modelWriteDb
 
-			// at this point, the issuing org will have to approve the transfer request.
-			// They would be sent data about the account to a known endpoint, and would respond with a token if they approve the transfer.
+			if i > 0 {
+				shardDb = db
 
-			// get issuing user and check permission with token
-			users, err = app.models.Users.GetForToken(issuingUserChoice.Token.Hash, cfg.db.engine)
-			if err != nil {
-				err = fmt.Errorf("error getting user -> %w", err)
-				logger.Error(err.Error())
-				return err
-			}
+				if cfg.db.prepared {
+					preparedShardDb := data.NewPreparedDB(db)
+					defer preparedShardDb.Close()
 
-			var issuingUser *data.User
+					err = preparedShardDb.Prepare(ctx, append(reads, writes...)...)
+					if err != nil {
+						return nil, fmt.Errorf("shard %d -> %w", i, err)
+					}
 
-			// make sure they have permission to approve transfer requests
-			for _, user := range users {
-				if user.Token.PermissionID == 1 {
-					issuingUser = user
-					break
+					shardDb = preparedShardDb
 				}
 			}
 
-			if issuingUser == nil {
-				err = errors.New("issuing user not found or does not have permission")
-				logger.Error(err.Error())
-				return err
+			app.shards.add(db, app.newModels(shardDb, shardDb))
+		}
+
+		app.users, err = app.shards.loadUsers(ctx, cfg.db.engine)
+		if err != nil {
+			return nil, fmt.Errorf("error getting users: %w", err)
+		}
+
+		if cfg.db.crossShard == "xa" {
+			recoverErr := app.shards.recoverXA(ctx, cfg.db.engine, cfg.db.queryTimeout, logger)
+			if recoverErr != nil {
+				logger.Warn(fmt.Errorf("error resolving prepared transactions left by an earlier run -> %w", recoverErr).Error())
 			}
+		}
 
-			// check if the issuing user is in the same organization as the issuing account
-			if issuingUser.OrganizationID != issuingAccount.OrganizationID {
-				err = errors.New("issuing user is not in the same organization as the issuing account")
-				logger.Error(err.Error())
-				return err
+		logger.Info(fmt.Sprintf("sharding accounts across %v databases", len(writeDbs)), "by", cfg.db.shardBy, "cross_shard", cfg.db.crossShard)
+	} else {
+		app.users, err = app.models.Users.GetAll(ctx, cfg.db.engine)
+		if err != nil {
+			return nil, fmt.Errorf("error getting users: %w", err)
+		}
+	}
+
+	if cfg.replay != nil {
+		err = cfg.replay.open(app.users.All())
+		if err != nil {
+			return nil, fmt.Errorf("error opening %v: %w", cfg.replay.path, err)
+		}
+		defer cfg.replay.close()
+
+		logger.Info(fmt.Sprintf("replaying %v", cfg.replay.path), "format", cfg.replay.format, "timing", cfg.replay.timing)
+	}
+
+	server := data.ServerModel{
+		Db:           writeDb,
+		QueryTimeout: cfg.db.queryTimeout,
+	}
+
+	engineVersion, err := server.Version(ctx, cfg.db.engine)
+	if err != nil {
+		logger.Warn(fmt.Errorf("error getting server version -> %w", err).Error())
+	}
+
+	measureLag := cfg.db.hasReadReplica && cfg.db.lagInterval > 0
+
+	// each replica is polled for the heartbeats through its own pool
+	heartbeats := data.HeartbeatModel{
+		WriteDb:      writeDb,
+		QueryTimeout: cfg.db.queryTimeout,
+	}
+
+	if measureLag {
+		err = heartbeats.Setup(ctx, cfg.db.engine)
+		if err != nil {
+			return nil, fmt.Errorf("error setting up replica lag heartbeat: %w", err)
+		}
+	}
+
+	var plans []data.Plan
+
+	if cfg.explain {
+		plans, err = app.explainPlans(ctx)
+		if err != nil {
+			logger.Warn(fmt.Errorf("error capturing query plans -> %w", err).Error())
+		} else {
+			logger.Info(fmt.Sprintf("captured the plans of %v queries", len(plans)), "analyzed", cfg.explainAnalyze)
+		}
+	}
+
+	var collector *serverStats
+
+	if cfg.serverStats {
+		collector, err = app.startServerStats(ctx)
+		if err != nil {
+			logger.Warn(fmt.Errorf("error reading server stats, not collecting them -> %w", err).Error())
+		}
+	}
+
+	serverCtx, stopServer := context.WithCancel(ctx)
+	defer stopServer()
+
+	if collector != nil && cfg.serverStatsEvery > 0 {
+		go collector.sample(serverCtx, cfg.serverStatsEvery)
+	}
+
+	// agents of a distributed run start together, once they are all ready
+	if cfg.agent != nil {
+		startAt, err := cfg.agent.ready(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error waiting for the coordinator: %w", err)
+		}
+
+		sleepUntil(ctx, startAt)
+	}
+
+	start := time.Now()
+	end := start.Add(cfg.warmup + cfg.duration + cfg.cooldown)
+
+	// only work completed between warmup and cooldown is measured
+	window := stats.NewWindow(start, cfg.warmup, cfg.duration)
+
+	app.recorder = stats.NewRecorder(window)
+	counter.start(app.recorder)
+
+	if dash != nil {
+		defer dash.add(app)()
+	}
+
+	// a replay can run out of operations before the window ends
+	intervalsCtx, stopIntervals := context.WithCancel(ctx)
+	defer stopIntervals()
+
+	intervalsDone := make(chan struct{})
+	go func() {
+		defer close(intervalsDone)
+		app.sampleIntervals(intervalsCtx)
+	}()
+
+	client := stats.NewClientRecorder(window, stats.ClientLimits{CPU: cfg.clientCPU, Latency: cfg.clientLatency})
+	clientCtx, stopClient := context.WithCancel(ctx)
+	defer stopClient()
+
+	go app.watchClient(clientCtx, client)
+
+	if app.shards != nil {
+		app.shards.recorder = stats.NewShardRecorder(window, len(app.shards.shards))
+	}
+
+	if cfg.failover.enabled {
+		app.failover = stats.NewFailoverRecorder(window, cfg.failover.threshold)
+
+		app.acks, err = openAckLog(cfg.failover.ackLog)
+		if err != nil {
+			return nil, fmt.Errorf("error opening ack log: %w", err)
+		}
+
+		if cfg.failover.ackLog == "" {
+			defer os.Remove(app.acks.f.Name())
+		}
+
+		if cfg.failover.hook != "" {
+			at := cfg.failover.at
+			if at == 0 {
+				at = cfg.duration / 2
 			}
 
-			// create a transfer
-			transfer := &data.Transfer{
-				CardID:         card.ID,
-				FromAccountID:  issuingAccount.ID,
-				ToAccountID:    acquiringUser.AccountID,
-				RequestingUser: *acquiringUser,
-				Amount:         amount,
-				CreatedAt:      time.Now(),
+			go app.runFailoverHook(ctx, window.Start.Add(at), app.failover)
+		}
+	}
+
+	var recorded *recording.Writer
+
+	if cfg.recordPath != "" {
+		recorded, err = recording.Create(cfg.recordPath)
+		if err != nil {
+			return nil, fmt.Errorf("error creating recording: %w", err)
+		}
+	}
+
+	healthCtx, stopHealth := context.WithCancel(ctx)
+	defer stopHealth()
+
+	if replicaSet != nil {
+		replicaSet.Start(window)
+
+		if cfg.db.healthInterval > 0 {
+			go replicaSet.CheckHealth(healthCtx, cfg.db.healthInterval)
+		}
+	}
+
+	lag := stats.NewLagRecorder(window)
+	lagCtx, stopLag := context.WithCancel(ctx)
+	lagDone := make(chan struct{})
+
+	if measureLag {
+		go func() {
+			defer close(lagDone)
+			app.probeLag(lagCtx, heartbeats, lag)
+		}()
+	} else {
+		close(lagDone)
+	}
+
+	if cfg.db.connMode == "dedicated" {
+		// workers open their connections the first time they are used
+		app.workers = make(chan *worker, cfg.concurrencyLimit)
+		for range cfg.concurrencyLimit {
+			app.workers <- nil
+		}
+	}
+
+	eg := errgroup.Group{}
+
+	// set limit
+	eg.SetLimit(cfg.concurrencyLimit)
+
+	logger.Info(fmt.Sprintf("Starting test of %v", cfg.name), "seed", cfg.seed)
+
+	lastTransferCheckTime := time.Now()
+	var lastTransferPlusDeletes int64 = 0
+
+	var replayErr error
+
+	// a replay waiting for its next operation stops waiting at the end
+	replayCtx, stopReplay := context.WithDeadline(ctx, end)
+	defer stopReplay()
+
+	for time.Now().Before(end) && ctx.Err() == nil {
+
+		if dash == nil && time.Since(lastTransferCheckTime) > 3*time.Second {
+			transferPlusDeletes := app.recorder.Actions()
+			logger.Info(fmt.Sprintf("%v completing %.0f actions per second", cfg.name, float64(transferPlusDeletes-lastTransferPlusDeletes)/time.Since(lastTransferCheckTime).Seconds()), "phase", app.recorder.Window.Phase(time.Now()).String())
+			lastTransferCheckTime = time.Now()
+			lastTransferPlusDeletes = transferPlusDeletes
+		}
+
+		var op operation
+
+		if cfg.replay != nil {
+			op, replayErr = cfg.replay.next(replayCtx, start)
+			if replayErr != nil {
+				break
 			}
 
-			_, err = app.models.Transfers.TransferFunds(transfer, cfg.db.engine)
+			op.checked = app.sampleReadYourWrites()
+		} else {
+			op = app.nextOperation()
+		}
+
+		if recorded != nil {
+			recorded.Write(recordOp(op, time.Since(start)))
+		}
+
+		eg.Go(func() error {
+			app.inFlight.Add(1)
+			defer app.inFlight.Add(-1)
+
+			ctx, trace := app.startTrace(ctx, op)
+
+			models, release, err := app.acquireModels(ctx)
 			if err != nil {
-				err = fmt.Errorf("error transferring funds -> %w", err)
+				err = fmt.Errorf("error opening connection -> %w", err)
 				logger.Error(err.Error())
-				return err
+			} else {
+				err = app.transfer(ctx, models, op)
+				release(err)
 			}
 
-			atomic.AddInt32(&transferCounter, 1)
+			outcome := "committed"
 
-			if cfg.deletes {
-				transferIds.Add(transfer.ID)
+			// errors caused by an interrupt are not failures
+			if err != nil && ctx.Err() == nil {
+				class := data.Classify(err).String()
+				app.recorder.Failure(class)
 
-				if transferCounter != 0 && transferCounter%20 == 0 {
-					toDeleteElement, err := transferIds.GetRandom()
-					if err != nil {
-						err = fmt.Errorf("error getting random transfer -> %w", err)
-						logger.Error(err.Error())
-						return err
-					}
-					err = app.models.Transfers.Delete(toDeleteElement, cfg.db.engine)
-					if err != nil {
-						err = fmt.Errorf("error deleting transfer -> %w", err)
-						logger.Error(err.Error())
-						return err
-					}
+				if app.failover != nil {
+					app.failover.Error(time.Now(), class, err)
+				}
 
-					transferIds.Remove(toDeleteElement)
+				outcome = class
+			} else if err != nil {
+				outcome = "interrupted"
+			}
 
-					atomic.AddInt32(&deleteCounter, 1)
-				}
+			trace.End(err, tracing.String("reserva.outcome", outcome))
+
+			// a failover is expected to cause errors, which are reported
+			// rather than failing the run
+			if app.failover != nil {
+				return nil
 			}
 
-			return nil
+			return err
 		})
 	}
 
-	err = eg.Wait()
+	if ctx.Err() != nil {
+		// restore default signal handling so a second interrupt exits immediately
+		stop()
+		logger.Info(fmt.Sprintf("%v interrupted, waiting up to %v for in-flight transfers", cfg.name, cfg.shutdownTimeout))
+	}
+
+	err = wait(ctx, &eg, cfg.shutdownTimeout)
+
+	interrupted := ctx.Err() != nil
+	if err != nil && interrupted && errors.Is(err, context.Canceled) {
+		// in-flight queries cancelled by the interrupt are not failures
+		err = nil
+	}
 	if err != nil {
 		logger.Error(err.Error())
-		os.Exit(1)
 	}
 
-	totalActions := transferCounter + deleteCounter
+	switch {
+	case replayErr == nil || replayCtx.Err() != nil:
+		// the replay was interrupted or ran out of time
+	case replayErr == io.EOF:
+		logger.Info(fmt.Sprintf("%v replayed all %v operations of %v", cfg.name, cfg.replay.ops, cfg.replay.path))
+	default:
+		replayErr = fmt.Errorf("error reading %v -> %w", cfg.replay.path, replayErr)
+		logger.Error(replayErr.Error())
+
+		if err == nil {
+			err = replayErr
+		}
+	}
+
+	if app.shards != nil {
+		resolveErr := app.shards.resolveXA(context.WithoutCancel(ctx), cfg.db.engine, cfg.db.queryTimeout, logger)
+		if resolveErr != nil {
+			logger.Error(fmt.Errorf("error resolving cross-shard transfers in doubt -> %w", resolveErr).Error())
+		}
+	}
+
+	stopLag()
+	<-lagDone
+	stopHealth()
+	stopServer()
+	stopClient()
+	stopIntervals()
+	<-intervalsDone
+
+	if recorded != nil {
+		recordErr := recorded.Close()
+		if recordErr != nil {
+			logger.Error(fmt.Errorf("error writing recording -> %w", recordErr).Error())
+		} else {
+			logger.Info(fmt.Sprintf("%v recorded %v operations to %v", cfg.name, recorded.Len(), cfg.recordPath))
+		}
+	}
+
+	app.rywChecks.Wait()
+
+	if app.workers != nil {
+		for range cfg.concurrencyLimit {
+			if w := <-app.workers; w != nil {
+				w.close()
+			}
+		}
+	}
 
-	logger.Info(fmt.Sprintf("%v completed %v actions in %v, rate of %.0f per second", cfg.name, totalActions, cfg.duration, float64(totalActions)/time.Since(start).Seconds()))
+	summary := app.recorder.Summary(time.Now())
+
+	result := &results.Result{
+		Name:            cfg.name,
+		Engine:          cfg.db.engine,
+		EngineVersion:   engineVersion,
+		Commit:          results.Commit(),
+		Driver:          driverName(cfg),
+		TxMode:          cfg.db.txMode,
+		Isolation:       cfg.db.isolation,
+		Prepared:        cfg.db.prepared,
+		ConnMode:        cfg.db.connMode,
+		ConsistentReads: cfg.db.consistentReads,
+		RYWSample:       cfg.db.rywSample,
+		StartedAt:       start,
+		FinishedAt:      time.Now(),
+		Duration:        cfg.duration,
+		Warmup:          cfg.warmup,
+		Cooldown:        cfg.cooldown,
+		Concurrency:     cfg.concurrencyLimit,
+		Seed:            cfg.seed,
+		Deletes:         cfg.deletes,
+		KindaRandom:     cfg.kindaRandom,
+		ReadReplicas:    len(cfg.db.readDsns),
+		Interrupted:     interrupted,
+		Summary:         summary,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if measureLag {
+		result.ReplicaLag = lag.Summary()
+	}
+	result.Client = client.Summary()
+	if replicaSet != nil {
+		result.ReadPolicy = cfg.db.readPolicy
+		result.Replicas = replicaSet.Summary()
+	}
+	if app.failover != nil {
+		result.Failover = app.failover.Summary(time.Now())
+		result.Failover.Acknowledged = app.acks.acks
+
+		// the check runs even after an interrupt, which is a common way to
+		// end a failover test
+		err := app.acks.close()
+		if err == nil {
+			checkCtx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+			var checked int64
+			var missing []int64
+			checked, missing, err = app.checkAcknowledged(checkCtx, app.acks.f.Name())
+			cancel()
+
+			if err == nil {
+				result.Failover.Checked = true
+				result.Failover.Missing = int64(len(missing))
+				result.Failover.MissingIds = missing[:min(len(missing), maxMissingIds)]
+				logger.Info(fmt.Sprintf("%v checked %v acknowledged transfers on the primary", cfg.name, checked))
+			}
+		}
+		if err != nil {
+			logger.Error(fmt.Errorf("error checking acknowledged transfers: %w", err).Error())
+		}
+	}
+
+	if collector != nil {
+		// the root context may have been cancelled by an interrupt
+		finishCtx, cancel := context.WithTimeout(context.Background(), cfg.db.queryTimeout)
+		result.Server, err = collector.finish(finishCtx)
+		cancel()
+
+		if err != nil {
+			logger.Warn(fmt.Errorf("error reading server stats -> %w", err).Error())
+		}
+	}
+
+	result.Plans = plans
+	if cfg.replay != nil {
+		result.Replay = cfg.replay.summary()
+
+		if result.Replay.MaxBehind > cfg.interval {
+			logger.Warn(fmt.Sprintf("%v fell behind the recorded timing by up to %v, try a higher -concurrency-limit", cfg.name, result.Replay.MaxBehind))
+		}
+	}
+	if app.shards != nil {
+		result.Sharding = &results.Sharding{
+			Shards:     len(app.shards.shards),
+			By:         cfg.db.shardBy,
+			CrossShard: cfg.db.crossShard,
+			Summary:    app.shards.recorder.Summary(),
+		}
+	}
+	result.ScenarioHash = result.Scenario()
+
+	return result, nil
 }
 
-func openDB(cfg config) (writeDb *sql.DB, readDb *sql.DB, err error) {
+// openDB opens a pool for every write DSN, one per shard, and every read
+// replica.
+func openDB(cfg config, counter *connCounter) (writeDbs []*sql.DB, readDbs []*sql.DB, err error) {
 
 	var driver string
 
 	switch cfg.db.engine {
 	case "postgresql":
-		driver = "postgres"
+		switch cfg.db.pgDriver {
+		case "pq":
+			driver = "postgres"
+		case "pgx":
+			driver = "pgx"
+		default:
+			return nil, nil, fmt.Errorf("unsupported postgresql driver %q", cfg.db.pgDriver)
+		}
 	case "mariadb", "mysql":
 		driver = "mysql"
 	default:
 		return nil, nil, fmt.Errorf("unsupported database engine")
 	}
 
-	writeDb, err = sql.Open(driver, cfg.db.writeDsn)
+	closeAll := func() {
+		for _, db := range append(writeDbs, readDbs...) {
+			db.Close()
+		}
+	}
+
+	for i, dsn := range cfg.db.writeDsns {
+		writeDb, err := openPool(driver, dsn, cfg, counter)
+		if err != nil {
+			closeAll()
+			if len(cfg.db.writeDsns) > 1 {
+				err = fmt.Errorf("shard %d -> %w", i, err)
+			}
+			return nil, nil, err
+		}
+
+		writeDbs = append(writeDbs, writeDb)
+	}
+
+	for i, dsn := range cfg.db.readDsns {
+		readDb, err := openPool(driver, dsn, cfg, counter)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("read replica %d -> %w", i+1, err)
+		}
+
+		readDbs = append(readDbs, readDb)
+	}
+
+	return writeDbs, readDbs, nil
+}
+
+func openPool(driver, dsn string, cfg config, counter *connCounter) (*sql.DB, error) {
+	connector, err := newCountingConnector(driver, dsn, counter)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	writeDb.SetMaxOpenConns(cfg.concurrencyLimit)
-	writeDb.SetMaxIdleConns(cfg.concurrencyLimit)
-	writeDb.SetConnMaxIdleTime(cfg.db.maxIdleTime)
+	db := sql.OpenDB(connector)
+
+	configurePool(db, cfg)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	err = writeDb.PingContext(ctx)
+	err = db.PingContext(ctx)
 	if err != nil {
-		writeDb.Close()
-		return nil, nil, err
+		db.Close()
+		return nil, err
 	}
 
-	readDb = writeDb
-
-	if cfg.db.hasReadReplica {
-		readDb, err = sql.Open(driver, cfg.db.readDsn)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		readDb.SetMaxOpenConns(cfg.concurrencyLimit)
-		readDb.SetMaxIdleConns(cfg.concurrencyLimit)
-		readDb.SetConnMaxIdleTime(cfg.db.maxIdleTime)
+	return db, nil
+}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+func configurePool(db *sql.DB, cfg config) {
+	db.SetMaxOpenConns(cfg.concurrencyLimit)
+	db.SetMaxIdleConns(cfg.concurrencyLimit)
+	db.SetConnMaxIdleTime(cfg.db.maxIdleTime)
+	db.SetConnMaxLifetime(cfg.db.maxLifetime)
 
-		err = readDb.PingContext(ctx)
-		if err != nil {
-			readDb.Close()
-			return nil, nil, err
-		}
+	// in churn mode, connections are closed as soon as they are released
+	if cfg.db.connMode == "churn" {
+		db.SetMaxIdleConns(0)
 	}
-
-	return writeDb, readDb, nil
 }
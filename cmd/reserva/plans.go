@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/data"
+)
+
+// explainPlans captures the plans of the workload's queries, explained with
+// the accounts, card and token of two users drawn from the data set. Its own
+// random source is used, so the seeded workload is left as it would have
+// been. In a sharded run, the plans are explained on the first shard, so both
+// users are drawn from the accounts on it.
+func (app *application) explainPlans(ctx context.Context) ([]data.Plan, error) {
+	rng := rand.New(rand.NewSource(app.config.seed))
+
+	issuing, err := app.planUser(rng)
+	if err != nil {
+		return nil, err
+	}
+
+	acquiring, err := app.planUser(rng)
+	if err != nil {
+		return nil, err
+	}
+
+	plans := data.PlanModel{
+		WriteDb:      app.writeDb,
+		ReadDb:       app.readDb,
+		QueryTimeout: app.config.db.queryTimeout,
+	}
+
+	args := data.PlanArgs{
+		TokenHash:     issuing.Token.Hash,
+		CardID:        issuing.Card.ID,
+		FromAccountID: issuing.AccountID,
+		ToAccountID:   acquiring.AccountID,
+		UserID:        issuing.ID,
+		TransferID:    1,
+		CreatedAt:     time.Now(),
+	}
+
+	return plans.Explain(ctx, app.config.db.engine, args, app.config.db.txMode == "cte", app.config.explainAnalyze)
+}
+
+// planUser draws a user to explain the plans with, whose account is on the
+// first shard if the accounts are sharded.
+func (app *application) planUser(rng *rand.Rand) (data.User, error) {
+	for range 1000 {
+		_, user := app.users.GetRandom(rng)
+
+		if app.shards == nil || app.shards.of(user.AccountID) == 0 {
+			return user, nil
+		}
+	}
+
+	return data.User{}, errors.New("no account found on the first shard to explain the plans with")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/proxy"
+)
+
+// runProxy runs `reserva proxy`, a TCP proxy that injects network faults
+// between reserva and the database.
+func runProxy(args []string) {
+	var cfg proxy.Config
+
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+
+	fs.StringVar(&cfg.Listen, "listen", "127.0.0.1:6432", "Address to listen on")
+	fs.StringVar(&cfg.Target, "target", "", "Address of the database to forward to, such as 127.0.0.1:5432")
+	fs.DurationVar(&cfg.Latency, "latency", 0, "Latency added in each direction")
+	fs.DurationVar(&cfg.Jitter, "jitter", 0, "Max random latency added on top of -latency")
+	fs.Int64Var(&cfg.Bandwidth, "bandwidth", 0, "Max bytes per second in each direction of each connection (0 means unlimited)")
+	fs.Float64Var(&cfg.DropRate, "drop-rate", 0, "Rate at which each connection is closed, per second")
+	fs.Float64Var(&cfg.ResetRate, "reset-rate", 0, "Rate at which each connection is reset, per second")
+	fs.DurationVar(&cfg.BlackholeAfter, "blackhole-after", 0, "When to start stalling all traffic, from the start of the proxy")
+	fs.DurationVar(&cfg.BlackholeFor, "blackhole-for", 0, "How long to stall all traffic for, delivering it once the stall ends (0 disables)")
+
+	fs.Parse(args)
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	if cfg.Target == "" {
+		logger.Error("target is required")
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	p := proxy.New(cfg, logger)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	var err error
+
+loop:
+	for {
+		select {
+		case err = <-done:
+			break loop
+		case <-ticker.C:
+			logProxyStats(logger, p.Stats())
+		}
+	}
+
+	logProxyStats(logger, p.Stats())
+
+	if err != nil {
+		logger.Error(fmt.Errorf("error running proxy: %w", err).Error())
+		os.Exit(1)
+	}
+}
+
+func logProxyStats(logger *slog.Logger, s proxy.Stats) {
+	logger.Info("proxy stats",
+		"connections", s.Connections,
+		"drops", s.Drops,
+		"resets", s.Resets,
+		"bytes", s.Bytes,
+		"blackholed_bytes", s.BlackholedBytes,
+	)
+}
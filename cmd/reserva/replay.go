@@ -0,0 +1,258 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/data"
+	"github.com/calmitchell617/reserva/internal/recording"
+	"github.com/calmitchell617/reserva/internal/results"
+)
+
+// runReplay runs `reserva replay`, which takes the flags of a run and issues
+// the operations of a recording made with -record, or the transactions of a
+// CSV file, instead of choosing transfers at random.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags := configFlags(fs)
+
+	format := fs.String("format", "", "Format of the file: trace (made with -record) or csv (real transactions); csv if the file ends in .csv, trace otherwise")
+	timing := fs.String("timing", "original", "Timing of the operations: original (as recorded) or fast (as fast as possible)")
+
+	fs.Parse(args)
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	if fs.NArg() != 1 {
+		logger.Error("usage: reserva replay [flags] <file>")
+		os.Exit(1)
+	}
+
+	cfg := *flags
+
+	if cfg.targetsPath != "" {
+		logger.Error("-targets can't be used with a replay, replay against one target at a time")
+		os.Exit(1)
+	}
+
+	// transfer IDs differ between targets, so the deletes of a recorded run
+	// can't be replayed, and random ones would make it a different workload
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "deletes" && cfg.deletes {
+			logger.Warn("deletes aren't replayed, ignoring -deletes")
+		}
+	})
+	cfg.deletes = false
+
+	source, err := newReplaySource(fs.Arg(0), *format, *timing)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	cfg.replay = source
+
+	execute(cfg)
+}
+
+// replaySource reads the operations of a replay, and holds them back until
+// their recorded time if the timing is preserved.
+type replaySource struct {
+	path   string
+	format string
+	timing string
+
+	read  func() (operation, time.Duration, error)
+	close func() error
+
+	ops    int64
+	behind time.Duration
+}
+
+func newReplaySource(path, format, timing string) (*replaySource, error) {
+	if format == "" {
+		format = "trace"
+		if filepath.Ext(path) == ".csv" {
+			format = "csv"
+		}
+	}
+
+	if format != "trace" && format != "csv" {
+		return nil, fmt.Errorf("unsupported replay format %q", format)
+	}
+
+	if timing != "original" && timing != "fast" {
+		return nil, fmt.Errorf("unsupported replay timing %q", timing)
+	}
+
+	return &replaySource{path: path, format: format, timing: timing}, nil
+}
+
+// open opens the file. The users of a recording are looked up by the IDs of
+// the user, account and card each used, so the target must have been loaded
+// with the same data as the recorded one. The
+// accounts of a CSV file are mapped onto the target's users in the order they
+// first appear, which keeps busy accounts busy, and wraps around if there are
+// more accounts than users.
+func (s *replaySource) open(users []data.User) error {
+	if len(users) == 0 {
+		return errors.New("the target has no users")
+	}
+
+	switch s.format {
+	case "trace":
+		r, err := recording.Open(s.path)
+		if err != nil {
+			return err
+		}
+
+		// a user has a row per account and card they can use, so the
+		// recorded ones are looked up, not just the user
+		issuing := make(map[userKey]data.User, len(users))
+		acquiring := make(map[userKey]data.User, len(users))
+		for _, user := range users {
+			issuing[userKey{user.ID, user.AccountID, user.Card.ID}] = user
+			if _, ok := acquiring[userKey{user.ID, user.AccountID, 0}]; !ok {
+				acquiring[userKey{user.ID, user.AccountID, 0}] = user
+			}
+		}
+
+		lookup := func(users map[userKey]data.User, key userKey) (data.User, error) {
+			user, ok := users[key]
+			if !ok {
+				return user, fmt.Errorf("operation %d uses user %d with account %d and card %d, which the target doesn't have", s.ops+1, key.user, key.account, key.card)
+			}
+			return user, nil
+		}
+
+		s.close = r.Close
+		s.read = func() (op operation, at time.Duration, err error) {
+			recorded, err := r.Next()
+			if err != nil {
+				return op, 0, err
+			}
+
+			op.amount = recorded.Amount
+
+			op.acquiring, err = lookup(acquiring, userKey{recorded.AcquiringUserID, recorded.AcquiringAccountID, 0})
+			if err != nil {
+				return op, 0, err
+			}
+
+			op.issuing, err = lookup(issuing, userKey{recorded.IssuingUserID, recorded.IssuingAccountID, recorded.IssuingCardID})
+			if err != nil {
+				return op, 0, err
+			}
+
+			return op, recorded.At, nil
+		}
+	case "csv":
+		r, err := recording.OpenCSV(s.path)
+		if err != nil {
+			return err
+		}
+
+		// every target maps the same accounts to the same users
+		users = slices.Clone(users)
+		slices.SortFunc(users, func(a, b data.User) int {
+			return cmp.Compare(a.ID, b.ID)
+		})
+
+		accounts := make(map[string]data.User)
+
+		user := func(account string) data.User {
+			u, ok := accounts[account]
+			if !ok {
+				u = users[len(accounts)%len(users)]
+				accounts[account] = u
+			}
+			return u
+		}
+
+		s.close = r.Close
+		s.read = func() (op operation, at time.Duration, err error) {
+			t, err := r.Next()
+			if err != nil {
+				return op, 0, err
+			}
+
+			op.amount = t.Amount
+			op.issuing = user(t.FromAccount)
+			op.acquiring = user(t.ToAccount)
+
+			return op, t.At, nil
+		}
+	}
+
+	return nil
+}
+
+// userKey identifies a user's row in the data set: the user, one of their
+// accounts and, for an issuing user, a card of it.
+type userKey struct {
+	user    int64
+	account int64
+	card    int64
+}
+
+// next returns the next operation, or io.EOF once there are none left. With
+// the original timing, it waits until the operation's time, from start,
+// unless ctx is done first, and keeps track of how far behind operations
+// start when it can't keep up.
+func (s *replaySource) next(ctx context.Context, start time.Time) (operation, error) {
+	op, at, err := s.read()
+	if err != nil {
+		return op, err
+	}
+
+	if s.timing == "original" {
+		t := start.Add(at)
+
+		if behind := time.Since(t); behind > 0 {
+			s.behind = max(s.behind, behind)
+		} else {
+			sleepUntil(ctx, t)
+
+			if err := ctx.Err(); err != nil {
+				return op, err
+			}
+		}
+	}
+
+	s.ops++
+
+	return op, nil
+}
+
+func (s *replaySource) summary() *results.Replay {
+	return &results.Replay{
+		Source:     s.path,
+		Format:     s.format,
+		Timing:     s.timing,
+		Operations: s.ops,
+		MaxBehind:  s.behind,
+	}
+}
+
+// recordOp returns the recording of an operation that was meant to start at,
+// from the start of the run.
+func recordOp(op operation, at time.Duration) recording.Op {
+	return recording.Op{
+		At:                 at,
+		Type:               recording.TypeTransfer,
+		Amount:             op.amount,
+		AcquiringUserID:    op.acquiring.ID,
+		AcquiringAccountID: op.acquiring.AccountID,
+		IssuingUserID:      op.issuing.ID,
+		IssuingAccountID:   op.issuing.AccountID,
+		IssuingCardID:      op.issuing.Card.ID,
+	}
+}
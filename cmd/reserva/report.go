@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/calmitchell617/reserva/internal/report"
+	"github.com/calmitchell617/reserva/internal/results"
+)
+
+// runReport runs `reserva report`, which turns one or more results files into
+// a report. The results of every file are overlaid.
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+
+	format := fs.String("format", "html", "Report format: html")
+	out := fs.String("o", "", "Write the report to this file instead of stdout")
+
+	fs.Parse(args)
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	if fs.NArg() == 0 {
+		logger.Error("usage: reserva report [flags] <results.json>...")
+		os.Exit(1)
+	}
+
+	if *format != "html" {
+		logger.Error(fmt.Sprintf("unsupported report format %q", *format))
+		os.Exit(1)
+	}
+
+	var rs []*results.Result
+
+	for _, path := range fs.Args() {
+		fileResults, err := results.Read(path)
+		if err != nil {
+			logger.Error(fmt.Errorf("error reading %v: %w", path, err).Error())
+			os.Exit(1)
+		}
+		rs = append(rs, fileResults...)
+	}
+
+	var buf bytes.Buffer
+
+	err := report.HTML(&buf, rs)
+	if err != nil {
+		logger.Error(fmt.Errorf("error writing report: %w", err).Error())
+		os.Exit(1)
+	}
+
+	if *out == "" {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+
+	err = os.WriteFile(*out, buf.Bytes(), 0644)
+	if err != nil {
+		logger.Error(fmt.Errorf("error writing report: %w", err).Error())
+		os.Exit(1)
+	}
+
+	logger.Info(fmt.Sprintf("report written to %v", *out))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/data"
+)
+
+// retryPolicy decides how often and how long to wait before retrying an
+// operation that failed with a retryable error, such as a serialization
+// failure, deadlock or lost connection.
+type retryPolicy struct {
+	maxRetries int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	jitter     float64
+}
+
+// delay returns how long to wait before the given retry, starting at 1. The
+// delay doubles with every retry up to maxBackoff, and up to jitter of it is
+// randomly taken off so that clients that failed together don't retry in
+// lockstep.
+func (p retryPolicy) delay(retry int) time.Duration {
+	d := p.backoff
+	for i := 1; i < retry && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+
+	d = min(d, p.maxBackoff)
+
+	if p.jitter > 0 {
+		d -= time.Duration(p.jitter * rand.Float64() * float64(d))
+	}
+
+	return d
+}
+
+// retry runs fn, retrying it according to the retry policy for as long as it
+// fails with a retryable error. Retries are counted by error class.
+func (app *application) retry(ctx context.Context, fn func() error) error {
+	for retry := 1; ; retry++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		// errors caused by an interrupt are neither retried nor counted
+		if ctx.Err() != nil {
+			return err
+		}
+
+		class := data.Classify(err)
+
+		if !class.Retryable() || retry > app.retryPolicy.maxRetries {
+			return err
+		}
+
+		app.recorder.Retry(class.String())
+
+		select {
+		case <-time.After(app.retryPolicy.delay(retry)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/data"
+)
+
+const rywPollInterval = 5 * time.Millisecond
+
+// startReadYourWritesCheck checks in the background whether a transfer that
+// was just committed on the primary can be read back from the read replica.
+// Checks are skipped if as many are already running as there are workers, so
+// that a lagging replica can't pile them up.
+func (app *application) startReadYourWritesCheck(ctx context.Context, transferId int64, committed time.Time) {
+	select {
+	case app.rywSlots <- struct{}{}:
+	default:
+		return
+	}
+
+	app.rywChecks.Add(1)
+
+	go func() {
+		defer func() {
+			<-app.rywSlots
+			app.rywChecks.Done()
+		}()
+
+		app.checkReadYourWrites(ctx, transferId, committed)
+	}()
+}
+
+// checkReadYourWrites polls a read replica, picked by the read policy, for
+// the transfer until it shows up or -ryw-timeout passes. The replica is polled
+// through its own pool, so every poll of a check reads from the same replica,
+// and the check is counted both overall and on that replica. The transfer row
+// is polled rather than the account balances, as a balance can't tell this
+// transfer apart from concurrent ones touching the same accounts.
+func (app *application) checkReadYourWrites(ctx context.Context, transferId int64, committed time.Time) {
+	replica := app.replicas.Pick()
+
+	transfers := data.TransferModel{
+		ReadDb:       replica.Pool,
+		QueryTimeout: app.config.db.queryTimeout,
+	}
+
+	deadline := committed.Add(app.config.db.rywTimeout)
+	stale := false
+
+	for {
+		visible, err := transfers.Visible(ctx, transferId, app.config.db.engine)
+		if err != nil {
+			if ctx.Err() == nil {
+				app.logger.Warn(fmt.Errorf("error checking read-your-writes -> %w", err).Error())
+			}
+			return
+		}
+
+		if visible {
+			delay := time.Since(committed)
+			app.recorder.ReadYourWrites(stale, false, delay)
+			replica.ReadYourWrites(stale, false, delay)
+			return
+		}
+
+		stale = true
+
+		if time.Now().After(deadline) {
+			app.recorder.ReadYourWrites(true, true, 0)
+			replica.ReadYourWrites(true, true, 0)
+			return
+		}
+
+		sleepUntil(ctx, time.Now().Add(rywPollInterval))
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
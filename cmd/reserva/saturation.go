@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/stats"
+)
+
+// loopTick is how often the loop lag probe wakes up.
+const loopTick = 10 * time.Millisecond
+
+// clientWarnEvery limits how often a saturated client is warned about.
+const clientWarnEvery = 10 * time.Second
+
+// watchClient samples the load generator's own health every -interval until
+// ctx is done: its CPU use, how long goroutines wait to be scheduled, its GC
+// pauses and goroutine count, and how late a goroutine that sleeps for
+// loopTick at a time wakes up. It warns whenever the client looks like the
+// bottleneck.
+func (app *application) watchClient(ctx context.Context, client *stats.ClientRecorder) {
+	var loopLag atomic.Int64
+
+	go func() {
+		for {
+			expected := time.Now().Add(loopTick)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(loopTick):
+			}
+
+			now := time.Now()
+			lag := max(0, now.Sub(expected))
+
+			client.LoopLag(now, lag)
+
+			for {
+				m := loopLag.Load()
+				if int64(lag) <= m || loopLag.CompareAndSwap(m, int64(lag)) {
+					break
+				}
+			}
+		}
+	}()
+
+	samples := []metrics.Sample{
+		{Name: "/sched/latencies:seconds"},
+		{Name: "/sched/pauses/total/gc:seconds"},
+		{Name: "/sched/goroutines:goroutines"},
+	}
+
+	metrics.Read(samples)
+
+	prevSched := runtimeCounts(samples[0])
+	prevPauses := runtimeCounts(samples[1])
+	prevCPU, hasCPU := processCPU()
+	prevAt := time.Now()
+
+	var lastWarning time.Time
+
+	ticker := time.NewTicker(app.config.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		metrics.Read(samples)
+
+		sample := stats.ClientSample{
+			At:      now,
+			LoopLag: time.Duration(loopLag.Swap(0)),
+		}
+
+		if samples[2].Value.Kind() == metrics.KindUint64 {
+			sample.Goroutines = int64(samples[2].Value.Uint64())
+		}
+
+		// the runtime's histograms are cumulative, so only what changed
+		// since the last sample is recorded
+		var sched stats.Histogram
+
+		prevSched = recordRuntimeHistogram(samples[0], prevSched, func(d time.Duration, n int64) {
+			sched.RecordN(d, n)
+			client.SchedLatency(now, d, n)
+		})
+		prevPauses = recordRuntimeHistogram(samples[1], prevPauses, func(d time.Duration, n int64) {
+			client.GCPause(now, d, n)
+		})
+
+		sample.SchedLatencyP99 = sched.Distribution().Quantile(0.99)
+
+		if cpu, ok := processCPU(); ok && hasCPU {
+			share := float64(cpu-prevCPU) / float64(now.Sub(prevAt)) / float64(runtime.GOMAXPROCS(0))
+			sample.CPU = &share
+			prevCPU = cpu
+		}
+
+		prevAt = now
+
+		client.Record(sample)
+
+		var reason string
+
+		switch limits := client.Limits; {
+		case sample.CPU != nil && *sample.CPU >= limits.CPU:
+			reason = fmt.Sprintf("using %.0f%% of its CPU", *sample.CPU*100)
+		case sample.SchedLatencyP99 >= limits.Latency:
+			reason = fmt.Sprintf("goroutines waiting %v to be scheduled at p99", sample.SchedLatencyP99)
+		case sample.LoopLag >= limits.Latency:
+			reason = fmt.Sprintf("timers firing up to %v late", sample.LoopLag)
+		}
+
+		if reason != "" && now.Sub(lastWarning) >= clientWarnEvery {
+			app.logger.Warn(fmt.Sprintf("%v client may be the bottleneck, %v", app.config.name, reason))
+			lastWarning = now
+		}
+	}
+}
+
+func runtimeCounts(sample metrics.Sample) []uint64 {
+	if sample.Value.Kind() != metrics.KindFloat64Histogram {
+		return nil
+	}
+	return append([]uint64(nil), sample.Value.Float64Histogram().Counts...)
+}
+
+// recordRuntimeHistogram passes the change in each bucket of a runtime
+// histogram since prev to record, valued at the bucket's lower bound, and
+// returns the new counts.
+func recordRuntimeHistogram(sample metrics.Sample, prev []uint64, record func(time.Duration, int64)) []uint64 {
+	if sample.Value.Kind() != metrics.KindFloat64Histogram {
+		return prev
+	}
+
+	h := sample.Value.Float64Histogram()
+
+	for i, count := range h.Counts {
+		var before uint64
+		if i < len(prev) {
+			before = prev[i]
+		}
+
+		if count <= before {
+			continue
+		}
+
+		lower := h.Buckets[i]
+		if math.IsInf(lower, -1) {
+			lower = 0
+		}
+
+		record(time.Duration(lower*float64(time.Second)), int64(count-before))
+	}
+
+	return append(prev[:0], h.Counts...)
+}
+
+// servePprof serves the pprof profiles of reserva itself, for when the client
+// is the bottleneck.
+func servePprof(addr string, logger *slog.Logger) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	logger.Info(fmt.Sprintf("serving pprof at http://%v/debug/pprof/", addr))
+
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		logger.Error(fmt.Errorf("error serving pprof -> %w", err).Error())
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/data"
+	"github.com/calmitchell617/reserva/internal/results"
+)
+
+// serverStats snapshots the database server's statistics before and after a
+// run, and every -server-stats-interval during it.
+type serverStats struct {
+	app        *application
+	model      data.ServerModel
+	statements bool
+
+	before data.ServerSnapshot
+
+	mu      sync.Mutex
+	last    data.ServerSnapshot
+	samples []results.ServerSample
+}
+
+// startServerStats takes the first snapshot. On postgresql, pg_stat_statements
+// is left out if the extension is not installed.
+func (app *application) startServerStats(ctx context.Context) (*serverStats, error) {
+	s := &serverStats{
+		app: app,
+		model: data.ServerModel{
+			Db:           app.writeDb,
+			QueryTimeout: app.config.db.queryTimeout,
+		},
+		statements: app.config.db.engine == "postgresql",
+	}
+
+	snapshot, err := s.model.Snapshot(ctx, app.config.db.engine, s.statements)
+	if err != nil && s.statements {
+		app.logger.Warn(fmt.Errorf("error reading pg_stat_statements, collecting server stats without it -> %w", err).Error())
+
+		s.statements = false
+		snapshot, err = s.model.Snapshot(ctx, app.config.db.engine, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.before, s.last = snapshot, snapshot
+
+	return s, nil
+}
+
+// sample records the counters that moved every interval until ctx is done.
+func (s *serverStats) sample(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		snapshot, err := s.model.Snapshot(ctx, s.app.config.db.engine, s.statements)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.app.logger.Warn(fmt.Errorf("error reading server stats -> %w", err).Error())
+			}
+			continue
+		}
+
+		s.mu.Lock()
+		s.samples = append(s.samples, results.Changed(s.last, snapshot))
+		s.last = snapshot
+		s.mu.Unlock()
+	}
+}
+
+// finish takes the last snapshot and summarises the run.
+func (s *serverStats) finish(ctx context.Context) (*results.ServerStats, error) {
+	after, err := s.model.Snapshot(ctx, s.app.config.db.engine, s.statements)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return results.NewServerStats(s.before, after, s.samples), nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/data"
+	"github.com/calmitchell617/reserva/internal/stats"
+)
+
+// shard is one of the databases the accounts of a sharded run are split
+// across. Organizations, users and tokens are on every shard.
+type shard struct {
+	db          *sql.DB
+	models      data.Models
+	transferIds *SafeInt64Map
+}
+
+// shardSet routes every account to the shard it is on. Accounts are either
+// hashed onto shards or split into ranges of account IDs, which must match
+// how the data loader split them.
+type shardSet struct {
+	by     string
+	shards []*shard
+
+	// bounds are the highest account ID on each shard, when split by range
+	bounds []int64
+
+	recorder *stats.ShardRecorder
+
+	// xids identify the prepared transactions of cross-shard transfers,
+	// which must not clash with those of other runs or agents. They start
+	// with namePrefix, which runs of the same name share.
+	namePrefix string
+	xidPrefix  string
+	xids       atomic.Int64
+
+	// inDoubt is whether to commit each branch a transfer left prepared
+	inDoubtMu sync.Mutex
+	inDoubt   map[string]bool
+}
+
+func newShardSet(cfg config) *shardSet {
+	// xids can't be longer than 64 bytes on MySQL, so the name is hashed
+	h := fnv.New32a()
+	h.Write([]byte(cfg.name))
+
+	namePrefix := fmt.Sprintf("reserva-%v-", strconv.FormatUint(uint64(h.Sum32()), 36))
+
+	return &shardSet{
+		by:         cfg.db.shardBy,
+		namePrefix: namePrefix,
+		xidPrefix:  namePrefix + strconv.FormatInt(time.Now().UnixNano(), 36),
+		inDoubt:    make(map[string]bool),
+	}
+}
+
+func (s *shardSet) add(db *sql.DB, models data.Models) {
+	s.shards = append(s.shards, &shard{
+		db:     db,
+		models: models,
+		transferIds: &SafeInt64Map{
+			valMap: make(map[int64]bool, 0),
+		},
+	})
+}
+
+// hashShard is the shard an account is hashed onto, as computed by the data
+// loader.
+func hashShard(accountID int64, shards int) int {
+	return int(uint64(accountID) * 2654435761 % (1 << 32) % uint64(shards))
+}
+
+// of returns the index of the shard an account is on.
+func (s *shardSet) of(accountID int64) int {
+	if s.by == "range" {
+		i, _ := slices.BinarySearch(s.bounds, accountID)
+		return min(i, len(s.shards)-1)
+	}
+
+	return hashShard(accountID, len(s.shards))
+}
+
+// loadUsers loads the users of every shard, and checks that each shard holds
+// the accounts routed to it. The users are in the order a single database
+// returns them, so a seed picks the same transfers whether or not the
+// accounts are sharded.
+func (s *shardSet) loadUsers(ctx context.Context, engine string) (*data.SafeUserSlice, error) {
+	perShard := make([][]data.User, len(s.shards))
+	s.bounds = make([]int64, len(s.shards))
+
+	for i, sh := range s.shards {
+		users, err := sh.models.Users.GetAll(ctx, engine)
+		if err != nil {
+			return nil, fmt.Errorf("shard %d -> %w", i, err)
+		}
+
+		perShard[i] = users.All()
+
+		if len(perShard[i]) == 0 {
+			return nil, fmt.Errorf("shard %d has no accounts", i)
+		}
+
+		for _, user := range perShard[i] {
+			s.bounds[i] = max(s.bounds[i], user.AccountID)
+		}
+	}
+
+	var all []data.User
+
+	for i, users := range perShard {
+		for _, user := range users {
+			if want := s.of(user.AccountID); want != i {
+				return nil, fmt.Errorf("account %d is on shard %d, but belongs on shard %d: load the shards with the migrations/*_shard.sql scripts, in the order of -write-dsn, split by %v", user.AccountID, i, want, s.by)
+			}
+		}
+
+		all = append(all, users...)
+	}
+
+	slices.SortFunc(all, func(a, b data.User) int {
+		return cmp.Or(cmp.Compare(a.ID, b.ID), cmp.Compare(a.OrganizationID, b.OrganizationID), cmp.Compare(a.AccountID, b.AccountID))
+	})
+
+	users := &data.SafeUserSlice{}
+	for _, user := range all {
+		users.Add(user)
+	}
+
+	return users, nil
+}
+
+func (s *shardSet) nextXid() string {
+	return fmt.Sprintf("%v-%v", s.xidPrefix, s.xids.Add(1))
+}
+
+// preparedXids lists the branches prepared on the shards whose xids start
+// with prefix, and the shard each is on. Shards on the same MySQL server all
+// list the server's branches, which are kept on the first that does.
+func (s *shardSet) preparedXids(ctx context.Context, engine, prefix string, queryTimeout time.Duration) (map[string]int, error) {
+	prepared := make(map[string]int)
+
+	for i, sh := range s.shards {
+		ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+		xids, err := data.PreparedXids(ctx, sh.db, engine, prefix)
+		cancel()
+
+		if err != nil {
+			return nil, fmt.Errorf("shard %d -> %w", i, err)
+		}
+
+		for _, xid := range xids {
+			if _, ok := prepared[xid]; !ok {
+				prepared[xid] = i
+			}
+		}
+	}
+
+	return prepared, nil
+}
+
+func (s *shardSet) resolveXid(ctx context.Context, engine, xid string, shard int, commit bool, queryTimeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	err := data.ResolveXA(ctx, s.shards[shard].db, engine, xid, commit)
+	if err != nil {
+		return fmt.Errorf("error resolving %v on shard %d -> %w", xid, shard, err)
+	}
+
+	return nil
+}
+
+// recoverXA resolves the branches earlier runs of the same name left
+// prepared, having stopped in the middle of a cross-shard transfer. If both
+// of a transfer's branches are still prepared, neither has committed, so both
+// are rolled back. A lone branch's transfer may have committed the other, or
+// rolled it back, so it is left to be resolved by hand.
+func (s *shardSet) recoverXA(ctx context.Context, engine string, queryTimeout time.Duration, logger *slog.Logger) error {
+	prepared, err := s.preparedXids(ctx, engine, s.namePrefix, queryTimeout)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	rolledBack := 0
+
+	for xid, shard := range prepared {
+		transfer, branch, _ := cutLast(xid, "-")
+
+		other := transfer + "-to"
+		if branch == "to" {
+			other = transfer + "-from"
+		}
+
+		if _, ok := prepared[other]; !ok {
+			logger.Warn(fmt.Sprintf("%v is prepared on shard %d, but not the other branch of its transfer, so it's unknown whether to commit it or roll it back", xid, shard))
+			continue
+		}
+
+		err := s.resolveXid(ctx, engine, xid, shard, false, queryTimeout)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		rolledBack++
+	}
+
+	if rolledBack > 0 {
+		logger.Info(fmt.Sprintf("rolled back %v prepared branches an earlier run left behind", rolledBack))
+	}
+
+	return errors.Join(errs...)
+}
+
+// resolveXA resolves the branches this run's transfers left in doubt, the
+// way each transfer decided to.
+func (s *shardSet) resolveXA(ctx context.Context, engine string, queryTimeout time.Duration, logger *slog.Logger) error {
+	s.inDoubtMu.Lock()
+	defer s.inDoubtMu.Unlock()
+
+	if len(s.inDoubt) == 0 {
+		return nil
+	}
+
+	prepared, err := s.preparedXids(ctx, engine, s.xidPrefix+"-", queryTimeout)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	resolved := 0
+
+	for xid, shard := range prepared {
+		commit, ok := s.inDoubt[xid]
+		if !ok {
+			logger.Warn(fmt.Sprintf("%v is prepared on shard %d, but its transfer didn't leave it in doubt", xid, shard))
+			continue
+		}
+
+		err := s.resolveXid(ctx, engine, xid, shard, commit, queryTimeout)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		resolved++
+	}
+
+	logger.Info(fmt.Sprintf("resolved %v of the %v branches cross-shard transfers left in doubt", resolved, len(s.inDoubt)))
+
+	return errors.Join(errs...)
+}
+
+// cutLast slices s around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+
+	return s, "", false
+}
+
+// shardedTransferFunds transfers funds from an account on one shard to an
+// account on another, or on the same one, in which case it is an ordinary
+// transfer.
+func (app *application) shardedTransferFunds(ctx context.Context, from, to int, transfer *data.Transfer) error {
+	s := app.shards
+
+	if from == to {
+		return app.transferFunds(ctx, s.shards[from].models, transfer)
+	}
+
+	if app.config.db.crossShard == "xa" {
+		xa := data.XAModel{
+			FromDb:       s.shards[from].db,
+			ToDb:         s.shards[to].db,
+			QueryTimeout: app.config.db.queryTimeout,
+			FromFirst:    from < to,
+		}
+
+		_, err := xa.TransferFunds(ctx, transfer, app.config.db.engine, s.nextXid())
+
+		var inDoubt *data.InDoubtError
+		if errors.As(err, &inDoubt) {
+			s.recorder.InDoubt(time.Now())
+
+			s.inDoubtMu.Lock()
+			for _, xid := range inDoubt.Xids {
+				s.inDoubt[xid] = inDoubt.Commit
+			}
+			s.inDoubtMu.Unlock()
+		}
+
+		return err
+	}
+
+	return app.saga(ctx, s.shards[from].models, s.shards[to].models, transfer)
+}
+
+// saga debits the issuing account on its shard, then credits the acquiring
+// account on its own. If the credit is rejected, the debit is refunded, and
+// the credit's error is returned, so the transfer can be retried from the
+// start. If the credit may have committed anyway, or the refund fails, the
+// transfer is in doubt.
+func (app *application) saga(ctx context.Context, from, to data.Models, transfer *data.Transfer) error {
+	engine := app.config.db.engine
+
+	_, err := from.Transfers.Debit(ctx, transfer, engine)
+	if err != nil {
+		return err
+	}
+
+	err = to.Transfers.Credit(ctx, transfer, engine)
+	if err == nil {
+		return nil
+	}
+
+	// refunding a credit that committed would create the money it moved
+	if !data.Rejected(err) {
+		app.shards.recorder.InDoubt(time.Now())
+		return fmt.Errorf("%w: error crediting transfer %d, which may have committed -> %w", data.ErrInDoubt, transfer.ID, err)
+	}
+
+	// the debit has committed, so it is refunded even if the transfer was
+	// interrupted
+	refundCtx := context.WithoutCancel(ctx)
+
+	refundErr := app.retry(refundCtx, func() error {
+		return data.InDoubt(from.Transfers.Refund(refundCtx, transfer, engine))
+	})
+	if refundErr != nil {
+		app.shards.recorder.InDoubt(time.Now())
+		return fmt.Errorf("%w: error refunding transfer %d -> %w, after error crediting it -> %w", data.ErrInDoubt, transfer.ID, refundErr, err)
+	}
+
+	app.shards.recorder.Compensation(time.Now())
+
+	return err
+}
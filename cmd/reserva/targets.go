@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/calmitchell617/reserva/internal/results"
+	"github.com/calmitchell617/reserva/internal/tracing"
+)
+
+// target is one database to benchmark, as listed in the -targets file. Every
+// other setting is taken from the command line and shared by all targets.
+type target struct {
+	Name     string   `json:"name"`
+	Engine   string   `json:"engine"`
+	WriteDsn string   `json:"write_dsn"`
+	ReadDsns []string `json:"read_dsns"`
+	PgDriver string   `json:"pg_driver"`
+
+	// Shards are the write DSNs of a sharded target, instead of WriteDsn
+	Shards []string `json:"shards"`
+}
+
+func loadTargets(path string) ([]target, error) {
+	js, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []target
+
+	err = json.Unmarshal(js, &targets)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets in %v", path)
+	}
+
+	names := make(map[string]bool)
+
+	for i, t := range targets {
+		if t.Name == "" {
+			t.Name = t.Engine
+			targets[i].Name = t.Engine
+		}
+
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate target name %q", t.Name)
+		}
+		names[t.Name] = true
+	}
+
+	return targets, nil
+}
+
+// runTargets runs the workload against every target, at the same time or one
+// after another according to -targets-mode. A target that fails to start is
+// reported in its results rather than stopping the others.
+func runTargets(ctx context.Context, stop func(), cfg config, targets []target, logger *slog.Logger, dash *dashboard, timeseries *timeseriesWriter, tracer *tracing.Tracer) []*results.Result {
+	rs := make([]*results.Result, len(targets))
+
+	runTarget := func(i int) {
+		t := targets[i]
+
+		targetCfg := cfg
+		targetCfg.name = t.Name
+		targetCfg.db.engine = t.Engine
+		targetCfg.db.writeDsns = []string{t.WriteDsn}
+		if len(t.Shards) > 0 {
+			targetCfg.db.writeDsns = t.Shards
+		}
+		targetCfg.db.readDsns = t.ReadDsns
+		if t.PgDriver != "" {
+			targetCfg.db.pgDriver = t.PgDriver
+		}
+
+		targetLogger := logger.With("target", t.Name)
+
+		err := validate(&targetCfg)
+		if err == nil {
+			rs[i], err = run(ctx, stop, targetCfg, targetLogger, dash, timeseries, tracer)
+		}
+		if err != nil {
+			targetLogger.Error(err.Error())
+			rs[i] = &results.Result{
+				Name:   t.Name,
+				Engine: t.Engine,
+				Seed:   cfg.seed,
+				Error:  err.Error(),
+			}
+		}
+	}
+
+	switch cfg.targetsMode {
+	case "sequential":
+		for i := range targets {
+			if ctx.Err() != nil {
+				rs[i] = &results.Result{Name: targets[i].Name, Engine: targets[i].Engine, Seed: cfg.seed, Interrupted: true}
+				continue
+			}
+			runTarget(i)
+		}
+	default:
+		var wg sync.WaitGroup
+
+		for i := range targets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runTarget(i)
+			}()
+		}
+
+		wg.Wait()
+	}
+
+	return rs
+}
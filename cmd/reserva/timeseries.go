@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/data"
+	"github.com/calmitchell617/reserva/internal/stats"
+)
+
+// timeseriesWriter writes a CSV row for every interval of every target as it
+// is sampled, so the time series survives a run that doesn't finish.
+type timeseriesWriter struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *csv.Writer
+}
+
+func newTimeseriesWriter(path string) (*timeseriesWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &timeseriesWriter{f: f, w: csv.NewWriter(f)}
+
+	header := []string{"target", "timestamp", "elapsed_s", "interval_s", "transfers", "deletes"}
+
+	for _, class := range data.ErrorClasses {
+		header = append(header, "failures_"+class.String())
+	}
+
+	for _, step := range steps {
+		header = append(header, step+"_count", step+"_p50_us", step+"_p90_us", step+"_p99_us", step+"_max_us")
+	}
+
+	header = append(header, "pool_open", "pool_in_use", "pool_idle", "pool_wait_count", "pool_wait_us")
+
+	err = t.w.Write(header)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *timeseriesWriter) write(name string, window stats.Window, interval stats.Interval) error {
+	us := func(d time.Duration) string {
+		return strconv.FormatInt(d.Microseconds(), 10)
+	}
+	count := func(n int64) string {
+		return strconv.FormatInt(n, 10)
+	}
+
+	row := []string{
+		name,
+		interval.At.UTC().Format(time.RFC3339Nano),
+		strconv.FormatFloat(interval.At.Sub(window.Start).Seconds(), 'f', 3, 64),
+		strconv.FormatFloat(interval.Length.Seconds(), 'f', 3, 64),
+		count(interval.Transfers),
+		count(interval.Deletes),
+	}
+
+	for _, class := range data.ErrorClasses {
+		row = append(row, count(interval.Failures[class.String()]))
+	}
+
+	for _, step := range steps {
+		l := interval.Latencies[step]
+		row = append(row, count(l.Count), us(l.P50), us(l.P90), us(l.P99), us(l.Max))
+	}
+
+	if p := interval.Pool; p != nil {
+		row = append(row, strconv.Itoa(p.Open), strconv.Itoa(p.InUse), strconv.Itoa(p.Idle), count(p.WaitCount), us(p.WaitDuration))
+	} else {
+		row = append(row, "", "", "", "", "")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err := t.w.Write(row)
+	if err != nil {
+		return err
+	}
+
+	t.w.Flush()
+
+	return t.w.Error()
+}
+
+func (t *timeseriesWriter) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.w.Flush()
+	if err := t.w.Error(); err != nil {
+		t.f.Close()
+		return err
+	}
+
+	return t.f.Close()
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+
+	"github.com/calmitchell617/reserva/internal/tracing"
+)
+
+// startTrace starts the trace of a transfer, if tracing is on. Its steps are
+// added to it by step, which finds it in the returned context.
+func (app *application) startTrace(ctx context.Context, op operation) (context.Context, *tracing.Trace) {
+	return app.tracer.Start(ctx, "transfer",
+		tracing.String("reserva.target", app.config.name),
+		tracing.String("db.system", app.config.db.engine),
+		tracing.String("reserva.tx_mode", app.config.db.txMode),
+		tracing.Int("reserva.amount", op.amount),
+		tracing.Int("reserva.acquiring_user_id", op.acquiring.ID),
+		tracing.Int("reserva.issuing_user_id", op.issuing.ID),
+	)
+}
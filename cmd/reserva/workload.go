@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/data"
+	"github.com/calmitchell617/reserva/internal/tracing"
+)
+
+// steps are the timed steps of the workload, in the order they run. connect
+// is only timed when a new connection is opened, and total covers a whole
+// transfer, from the first query to transfer_funds. When accounts are
+// sharded, single_shard and cross_shard split total by whether the two
+// accounts are on the same shard.
+var steps = []string{"connect", "auth", "card_lookup", "issuer_auth", "transfer_funds", "delete", "total", "single_shard", "cross_shard"}
+
+// operation is one transfer of the workload. Operations are chosen up front
+// from the seeded random source, one at a time, so that every run with the
+// same seed issues the same sequence of transfers.
+type operation struct {
+	amount    int64
+	acquiring data.User
+	issuing   data.User
+	checked   bool
+}
+
+func (app *application) nextOperation() operation {
+	var op operation
+
+	// get a random amount
+	op.amount = app.rng.Int63n(1000)
+
+	// get two random users
+	if app.config.kindaRandom {
+		_, op.acquiring = app.users.GetKindaRandom(app.rng)
+		_, op.issuing = app.users.GetKindaRandom(app.rng)
+	} else {
+		_, op.acquiring = app.users.GetRandom(app.rng)
+		_, op.issuing = app.users.GetRandom(app.rng)
+	}
+
+	op.checked = app.sampleReadYourWrites()
+
+	return op
+}
+
+// sampleReadYourWrites picks whether a transfer is checked for read-your-writes
+// consistency.
+func (app *application) sampleReadYourWrites() bool {
+	return app.config.db.rywSample > 0 && app.rng.Float64() < app.config.db.rywSample
+}
+
+// transfer runs one iteration of the workload: it authenticates the acquiring
+// user, looks up the issuing card and account, authenticates the issuing user,
+// transfers the funds and, every so often, deletes an earlier transfer.
+func (app *application) transfer(ctx context.Context, models data.Models, op operation) error {
+	start := time.Now()
+
+	amount := op.amount
+	acquiringUserChoice := op.acquiring
+	issuingUserChoice := op.issuing
+
+	acquiringAccountID := acquiringUserChoice.AccountID
+
+	// ensure the users are different
+	if acquiringUserChoice.ID == issuingUserChoice.ID {
+		tracing.FromContext(ctx).SetAttributes(tracing.Bool("reserva.skipped", true))
+		return nil
+	}
+
+	// when accounts are sharded, each user is looked up on the shard of the
+	// account they use, and the transfer is recorded on the issuing one
+	acquiringModels, issuingModels := models, models
+	transferIds := app.transferIds
+	var acquiringShard, issuingShard int
+
+	if app.shards != nil {
+		acquiringShard = app.shards.of(acquiringAccountID)
+		issuingShard = app.shards.of(issuingUserChoice.AccountID)
+
+		acquiringModels = app.shards.shards[acquiringShard].models
+		issuingModels = app.shards.shards[issuingShard].models
+		transferIds = app.shards.shards[issuingShard].transferIds
+
+		tracing.FromContext(ctx).SetAttributes(tracing.Int("reserva.acquiring_shard", int64(acquiringShard)), tracing.Int("reserva.issuing_shard", int64(issuingShard)))
+	}
+
+	// get acquiring user and check permission with token
+	var users []*data.User
+
+	err := app.step(ctx, "auth", func() (err error) {
+		users, err = acquiringModels.Users.GetForToken(ctx, acquiringUserChoice.Token.Hash, app.config.db.engine)
+		return err
+	})
+	if err != nil {
+		err = fmt.Errorf("error getting user -> %w", err)
+		app.logger.Error(err.Error())
+		return err
+	}
+
+	// make sure the acquiring user has permission to request payments
+	var acquiringUser *data.User
+
+	for _, user := range users {
+		if user.Token.PermissionID == 1 {
+			acquiringUser = user
+			break
+		}
+	}
+
+	if acquiringUser == nil {
+		err = fmt.Errorf("acquiring user not found or does not have permission")
+		app.logger.Error(err.Error())
+		return err
+	}
+
+	acquiringUser.AccountID = acquiringAccountID
+
+	// get the issuing account info from the card.. this is the info that would come from a POS terminal or payment gateway
+	var issuingAccount *data.Account
+	var card *data.Card
+
+	err = app.step(ctx, "card_lookup", func() (err error) {
+		issuingAccount, card, err = issuingModels.Accounts.GetFromCard(ctx, &issuingUserChoice.Card, app.config.db.engine)
+		return err
+	})
+	if err != nil {
+		err = fmt.Errorf("error getting account from card -> %w", err)
+		app.logger.Error(err.Error())
+		return err
+	}
+
+	// check account balance
+	if issuingAccount.Balance < amount {
+		err = data.ErrInsufficientFunds
+		app.logger.Error(err.Error())
+		return err
+	}
+
+	// check account frozen status
+	if issuingAccount.Frozen {
+		err = errors.New("issuing account is frozen")
+		app.logger.Error(err.Error())
+		return err
+	}
+
+	// check card frozen status
+	if card.Frozen {
+		err = errors.New("issuing card is frozen")
+		app.logger.Error(err.Error())
+		return err
+	}
+
+	// check card expiration date
+	if card.ExpirationDate.Before(time.Now()) {
+		err = errors.New("issuing card is expired")
+		app.logger.Error(err.Error())
+		return err
+	}
+
+	// check card security code
+	if card.SecurityCode != issuingUserChoice.Card.SecurityCode {
+		err = errors.New("issuing card security code does not match")
+		app.logger.Error(err.Error())
+		return err
+	}
+
+	// at this point, the issuing org will have to approve the transfer request.
+	// They would be sent data about the account to a known endpoint, and would respond with a token if they approve the transfer.
+
+	// get issuing user and check permission with token
+	err = app.step(ctx, "issuer_auth", func() (err error) {
+		users, err = issuingModels.Users.GetForToken(ctx, issuingUserChoice.Token.Hash, app.config.db.engine)
+		return err
+	})
+	if err != nil {
+		err = fmt.Errorf("error getting user -> %w", err)
+		app.logger.Error(err.Error())
+		return err
+	}
+
+	var issuingUser *data.User
+
+	// make sure they have permission to approve transfer requests
+	for _, user := range users {
+		if user.Token.PermissionID == 1 {
+			issuingUser = user
+			break
+		}
+	}
+
+	if issuingUser == nil {
+		err = errors.New("issuing user not found or does not have permission")
+		app.logger.Error(err.Error())
+		return err
+	}
+
+	// check if the issuing user is in the same organization as the issuing account
+	if issuingUser.OrganizationID != issuingAccount.OrganizationID {
+		err = errors.New("issuing user is not in the same organization as the issuing account")
+		app.logger.Error(err.Error())
+		return err
+	}
+
+	// create a transfer
+	transfer := &data.Transfer{
+		CardID:         card.ID,
+		FromAccountID:  issuingAccount.ID,
+		ToAccountID:    acquiringUser.AccountID,
+		RequestingUser: *acquiringUser,
+		Amount:         amount,
+		CreatedAt:      time.Now(),
+	}
+
+	err = app.writeStep(ctx, "transfer_funds", func() error {
+		if app.shards != nil {
+			return app.shardedTransferFunds(ctx, issuingShard, acquiringShard, transfer)
+		}
+		return app.transferFunds(ctx, models, transfer)
+	})
+	if err != nil {
+		err = fmt.Errorf("error transferring funds -> %w", err)
+		app.logger.Error(err.Error())
+		return err
+	}
+
+	committed := time.Now()
+
+	tracing.FromContext(ctx).SetAttributes(tracing.Int("reserva.transfer_id", transfer.ID))
+
+	app.recorder.Latency("total", committed.Sub(start))
+
+	if app.shards != nil {
+		crossShard := issuingShard != acquiringShard
+
+		if crossShard {
+			app.recorder.Latency("cross_shard", committed.Sub(start))
+		} else {
+			app.recorder.Latency("single_shard", committed.Sub(start))
+		}
+
+		app.shards.recorder.Transfer(committed, issuingShard, crossShard)
+	}
+
+	if app.failover != nil {
+		app.failover.Success(committed)
+		app.acks.ack(transfer.ID)
+	}
+
+	transferCount := app.recorder.Transfer()
+
+	// transfers being checked are not deleted, so they can't disappear from
+	// the replica before they show up there
+	checked := op.checked
+	if checked {
+		app.startReadYourWritesCheck(ctx, transfer.ID, committed)
+	}
+
+	if app.config.deletes {
+		if !checked {
+			transferIds.Add(transfer.ID)
+		}
+
+		if transferCount%20 == 0 {
+			toDeleteElement, err := transferIds.GetRandom()
+			if err != nil {
+				err = fmt.Errorf("error getting random transfer -> %w", err)
+				app.logger.Error(err.Error())
+				return err
+			}
+
+			if app.acks != nil {
+				app.acks.deleting(toDeleteElement)
+			}
+
+			err = app.writeStep(ctx, "delete", func() error {
+				return issuingModels.Transfers.Delete(ctx, toDeleteElement, app.config.db.engine)
+			})
+			if err != nil {
+				err = fmt.Errorf("error deleting transfer -> %w", err)
+				app.logger.Error(err.Error())
+				return err
+			}
+
+			transferIds.Remove(toDeleteElement)
+
+			app.recorder.Delete()
+		}
+	}
+
+	return nil
+}
+
+// transferFunds moves the money and records the transfer through the
+// transfer_funds stored procedure, in a client-side transaction or, on
+// postgresql, as a single data-modifying CTE.
+func (app *application) transferFunds(ctx context.Context, models data.Models, transfer *data.Transfer) error {
+	var err error
+
+	switch app.config.db.txMode {
+	case "client":
+		_, err = models.Transfers.TransferFundsClient(ctx, transfer, app.config.db.engine, app.isolation)
+	case "cte":
+		_, err = models.Transfers.TransferFundsCTE(ctx, transfer, app.config.db.engine)
+	default:
+		_, err = models.Transfers.TransferFunds(ctx, transfer, app.config.db.engine)
+	}
+
+	return err
+}
+
+// step runs one step of the workload with retries, and records its latency
+// if it succeeds. If the transfer is traced, the step is a span of its trace.
+func (app *application) step(ctx context.Context, name string, fn func() error) error {
+	span := tracing.FromContext(ctx).Span(name, tracing.String("db.system", app.config.db.engine))
+
+	start := time.Now()
+
+	err := app.retry(ctx, fn)
+	span.End(err)
+	if err != nil {
+		return err
+	}
+
+	app.recorder.Latency(name, time.Since(start))
+
+	return nil
+}
+
+// writeStep runs a step that writes, which isn't retried if it loses its
+// connection, as it may have committed anyway. It fails in doubt instead.
+func (app *application) writeStep(ctx context.Context, name string, fn func() error) error {
+	return app.step(ctx, name, func() error {
+		return data.InDoubt(fn())
+	})
+}
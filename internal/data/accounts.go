@@ -15,32 +15,27 @@ type Account struct {
 }
 
 type AccountModel struct {
-	WriteDB      *sql.DB
-	ReadDb       *sql.DB
+	WriteDB      DB
+	ReadDb       DB
 	QueryTimeout time.Duration
 }
 
-func (m AccountModel) GetFromCard(card *Card, engine string) (*Account, *Card, error) {
+func (m AccountModel) GetFromCard(ctx context.Context, card *Card, engine string) (*Account, *Card, error) {
 	switch engine {
 	case "postgresql":
-		return m.GetFromCardPostgreSQL(card)
+		return m.GetFromCardPostgreSQL(ctx, card)
 	case "mariadb", "mysql":
-		return m.GetFromCardMySQL(card)
+		return m.GetFromCardMySQL(ctx, card)
 	}
 	return nil, nil, errors.New("unsupported database engine")
 }
 
-func (m AccountModel) GetFromCardMySQL(card *Card) (*Account, *Card, error) {
-	query := `
-	SELECT accounts.id, accounts.organization_id, accounts.balance, accounts.frozen, cards.account_id, cards.expiration_date, cards.security_code, cards.frozen
-	FROM accounts
-	JOIN cards ON accounts.id = cards.account_id
-	WHERE cards.id = ?
-	`
+func (m AccountModel) GetFromCardMySQL(ctx context.Context, card *Card) (*Account, *Card, error) {
+	query := getFromCardMySQL
 
 	var account Account
 
-	ctx, cancel := context.WithTimeout(context.Background(), m.QueryTimeout)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	err := m.ReadDb.QueryRowContext(ctx, query, card.ID).Scan(
@@ -66,17 +61,12 @@ func (m AccountModel) GetFromCardMySQL(card *Card) (*Account, *Card, error) {
 	return &account, card, nil
 }
 
-func (m AccountModel) GetFromCardPostgreSQL(card *Card) (*Account, *Card, error) {
-	query := `
-	SELECT accounts.id, accounts.organization_id, accounts.balance, accounts.frozen, cards.account_id, cards.expiration_date, cards.security_code, cards.frozen
-	FROM accounts
-	JOIN cards ON accounts.id = cards.account_id
-	WHERE cards.id = $1
-	`
+func (m AccountModel) GetFromCardPostgreSQL(ctx context.Context, card *Card) (*Account, *Card, error) {
+	query := getFromCardPostgreSQL
 
 	var account Account
 
-	ctx, cancel := context.WithTimeout(context.Background(), m.QueryTimeout)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	err := m.ReadDb.QueryRowContext(ctx, query, card.ID).Scan(
@@ -1,7 +1,6 @@
 package data
 
 import (
-	"database/sql"
 	"time"
 )
 
@@ -14,7 +13,7 @@ type Card struct {
 }
 
 type CardModel struct {
-	WriteDb      *sql.DB
-	ReadDb       *sql.DB
+	WriteDb      DB
+	ReadDb       DB
 	QueryTimeout time.Duration
 }
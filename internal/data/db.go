@@ -0,0 +1,168 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Querier runs queries. It is implemented by *sql.DB, *sql.Conn and *sql.Tx.
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// DB is what the models use to talk to the database. It is implemented by
+// *sql.DB, *sql.Conn and PreparedDB.
+type DB interface {
+	Querier
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// Preparer is a DB that can prepare statements, such as *sql.DB or *sql.Conn.
+type Preparer interface {
+	DB
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// PreparedDB runs queries as prepared statements, instead of sending the
+// query text with every call. The workload's queries are prepared up front by
+// Prepare, so a statement the server rejects fails the run before it starts;
+// any other query is prepared the first time it is run. Statements prepared on
+// a *sql.DB are prepared once per pooled connection by database/sql.
+type PreparedDB struct {
+	db Preparer
+
+	mu    sync.RWMutex
+	stmts map[string]*sql.Stmt
+}
+
+func NewPreparedDB(db Preparer) *PreparedDB {
+	return &PreparedDB{
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+	}
+}
+
+// Prepare prepares queries, so they are ready before the workload runs them.
+func (p *PreparedDB) Prepare(ctx context.Context, queries ...string) error {
+	for _, query := range queries {
+		_, err := p.stmt(ctx, query)
+		if err != nil {
+			return fmt.Errorf("error preparing %v -> %w", strings.Join(strings.Fields(query), " "), err)
+		}
+	}
+
+	return nil
+}
+
+func (p *PreparedDB) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	p.mu.RLock()
+	stmt, ok := p.stmts[query]
+	p.mu.RUnlock()
+
+	if ok {
+		return stmt, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if stmt, ok := p.stmts[query]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := p.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	p.stmts[query] = stmt
+
+	return stmt, nil
+}
+
+func (p *PreparedDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	stmt, err := p.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+func (p *PreparedDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	stmt, err := p.stmt(ctx, query)
+	if err != nil {
+		// a *sql.Row can't be built with an error, so let the unprepared
+		// query report it
+		return p.db.QueryRowContext(ctx, query, args...)
+	}
+	return stmt.QueryRowContext(ctx, args...)
+}
+
+func (p *PreparedDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	stmt, err := p.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+func (p *PreparedDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return p.db.BeginTx(ctx, opts)
+}
+
+// Close closes the prepared statements, but not the underlying DB.
+func (p *PreparedDB) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for query, stmt := range p.stmts {
+		stmt.Close()
+		delete(p.stmts, query)
+	}
+
+	return nil
+}
+
+// inTx returns a Querier that runs queries inside tx. If tx was started on a
+// PreparedDB, its prepared statements are used.
+func inTx(db DB, tx *sql.Tx) Querier {
+	p, ok := db.(*PreparedDB)
+	if !ok {
+		return tx
+	}
+	return &preparedTx{db: p, tx: tx}
+}
+
+type preparedTx struct {
+	db *PreparedDB
+	tx *sql.Tx
+}
+
+func (t *preparedTx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	stmt, err := t.db.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return t.tx.StmtContext(ctx, stmt).QueryContext(ctx, args...)
+}
+
+func (t *preparedTx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	stmt, err := t.db.stmt(ctx, query)
+	if err != nil {
+		return t.tx.QueryRowContext(ctx, query, args...)
+	}
+	return t.tx.StmtContext(ctx, stmt).QueryRowContext(ctx, args...)
+}
+
+func (t *preparedTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	stmt, err := t.db.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return t.tx.StmtContext(ctx, stmt).ExecContext(ctx, args...)
+}
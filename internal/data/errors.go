@@ -0,0 +1,213 @@
+package data
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+// ErrorClass groups database errors by how a client should react to them.
+type ErrorClass int
+
+const (
+	ClassOther ErrorClass = iota
+	ClassSerialization
+	ClassDeadlock
+	ClassLockTimeout
+	ClassQueryCanceled
+	ClassConnection
+	ClassTimeout
+	ClassCanceled
+	ClassInsufficientFunds
+	ClassInDoubt
+)
+
+// ErrorClasses lists every class, in the order they are reported.
+var ErrorClasses = []ErrorClass{
+	ClassSerialization,
+	ClassDeadlock,
+	ClassLockTimeout,
+	ClassQueryCanceled,
+	ClassConnection,
+	ClassTimeout,
+	ClassCanceled,
+	ClassInsufficientFunds,
+	ClassInDoubt,
+	ClassOther,
+}
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ClassSerialization:
+		return "serialization"
+	case ClassDeadlock:
+		return "deadlock"
+	case ClassLockTimeout:
+		return "lock_timeout"
+	case ClassQueryCanceled:
+		return "query_canceled"
+	case ClassConnection:
+		return "connection"
+	case ClassTimeout:
+		return "timeout"
+	case ClassCanceled:
+		return "canceled"
+	case ClassInsufficientFunds:
+		return "insufficient_funds"
+	case ClassInDoubt:
+		return "in_doubt"
+	}
+	return "other"
+}
+
+// Retryable reports whether an operation that failed with this class of
+// error can be expected to succeed if it is tried again.
+func (c ErrorClass) Retryable() bool {
+	switch c {
+	case ClassSerialization, ClassDeadlock, ClassLockTimeout, ClassQueryCanceled, ClassConnection:
+		return true
+	}
+	return false
+}
+
+// InDoubt wraps the error of a write that lost its connection in ErrInDoubt,
+// as the write may have committed before the connection was lost, and
+// returns any other error as is. driver.ErrBadConn is the exception, as
+// drivers only return it if the write was never sent.
+func InDoubt(err error) error {
+	if Classify(err) != ClassConnection || errors.Is(err, driver.ErrBadConn) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", ErrInDoubt, err)
+}
+
+// Rejected reports whether a write that failed with err certainly didn't
+// commit, because the server refused it or the driver never sent it. A write
+// that lost its connection, timed out or was cancelled may have committed.
+func Rejected(err error) bool {
+	if errors.Is(err, ErrNoAccountToCredit) || errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	var pgErr *pgconn.PgError
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &pqErr) || errors.As(err, &pgErr) || errors.As(err, &mysqlErr) {
+		// the server may have sent these as it shut the connection down
+		return Classify(err) != ClassConnection
+	}
+
+	return false
+}
+
+// Classify maps an error returned by any of the database drivers to its class.
+func Classify(err error) ErrorClass {
+	if err == nil {
+		return ClassOther
+	}
+
+	if errors.Is(err, ErrInsufficientFunds) {
+		return ClassInsufficientFunds
+	}
+
+	// whatever went wrong, retrying could apply the transfer twice
+	if errors.Is(err, ErrInDoubt) {
+		return ClassInDoubt
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return classifySQLState(string(pqErr.Code))
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return classifySQLState(pgErr.Code)
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case 1213:
+			return ClassDeadlock
+		case 1205:
+			return ClassLockTimeout
+		case 1317, 1969, 3024:
+			return ClassQueryCanceled
+		case 2006, 2013:
+			return ClassConnection
+		case 3819, 4025:
+			// the balance >= 0 check constraint on accounts
+			return ClassInsufficientFunds
+		}
+		return ClassOther
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ClassTimeout
+	case errors.Is(err, context.Canceled):
+		return ClassCanceled
+	case errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, mysql.ErrInvalidConn),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return ClassConnection
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ClassConnection
+	}
+
+	return ClassOther
+}
+
+// sqlState returns the SQLSTATE of a postgresql error from either driver, or
+// "" for any other error.
+func sqlState(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+
+	return ""
+}
+
+func classifySQLState(code string) ErrorClass {
+	switch code {
+	case "40001":
+		return ClassSerialization
+	case "40P01":
+		return ClassDeadlock
+	case "55P03":
+		return ClassLockTimeout
+	case "57014":
+		return ClassQueryCanceled
+	case "23514":
+		// the balance >= 0 check constraint on accounts
+		return ClassInsufficientFunds
+	case "57P01", "57P02", "57P03":
+		return ClassConnection
+	}
+
+	// class 08 is connection exceptions
+	if len(code) == 5 && code[:2] == "08" {
+		return ClassConnection
+	}
+
+	return ClassOther
+}
@@ -0,0 +1,187 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HeartbeatModel writes heartbeats to the primary and reads them back from
+// the read replica, to measure how far behind the replica is.
+type HeartbeatModel struct {
+	WriteDb      DB
+	ReadDb       DB
+	QueryTimeout time.Duration
+}
+
+// Setup creates the heartbeat table and its single row, if they don't exist
+// yet. The table is logged even on postgresql, as unlogged tables are not
+// replicated.
+func (m HeartbeatModel) Setup(ctx context.Context, engine string) error {
+	var queries []string
+
+	switch engine {
+	case "postgresql":
+		queries = []string{
+			`CREATE TABLE IF NOT EXISTS reserva_heartbeat(id int PRIMARY KEY, written_at bigint NOT NULL)`,
+			`INSERT INTO reserva_heartbeat(id, written_at) VALUES (1, 0) ON CONFLICT (id) DO NOTHING`,
+		}
+	case "mariadb", "mysql":
+		queries = []string{
+			`CREATE TABLE IF NOT EXISTS reserva_heartbeat(id INT PRIMARY KEY, written_at BIGINT NOT NULL)`,
+			`INSERT IGNORE INTO reserva_heartbeat(id, written_at) VALUES (1, 0)`,
+		}
+	default:
+		return fmt.Errorf("unsupported database engine")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	for _, query := range queries {
+		_, err := m.WriteDb.ExecContext(ctx, query)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write records t, in unix nanoseconds, as the latest heartbeat.
+func (m HeartbeatModel) Write(ctx context.Context, t time.Time, engine string) error {
+	var query string
+
+	switch engine {
+	case "postgresql":
+		query = `UPDATE reserva_heartbeat SET written_at = $1 WHERE id = 1`
+	case "mariadb", "mysql":
+		query = `UPDATE reserva_heartbeat SET written_at = ? WHERE id = 1`
+	default:
+		return fmt.Errorf("unsupported database engine")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.WriteDb.ExecContext(ctx, query, t.UnixNano())
+	return err
+}
+
+// Read returns the latest heartbeat visible on the read replica.
+func (m HeartbeatModel) Read(ctx context.Context) (time.Time, error) {
+	query := `SELECT written_at FROM reserva_heartbeat WHERE id = 1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var writtenAt int64
+
+	err := m.ReadDb.QueryRowContext(ctx, query).Scan(&writtenAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return time.Time{}, ErrRecordNotFound
+		default:
+			return time.Time{}, err
+		}
+	}
+
+	return time.Unix(0, writtenAt), nil
+}
+
+// ServerLag returns the replication lag as reported by the read replica
+// itself: the time since the last replayed transaction on postgresql, or
+// Seconds_Behind_Source on mysql and mariadb. ErrRecordNotFound is returned
+// if the server does not consider itself a replica.
+func (m HeartbeatModel) ServerLag(ctx context.Context, engine string) (time.Duration, error) {
+	switch engine {
+	case "postgresql":
+		return m.ServerLagPostgreSQL(ctx)
+	case "mariadb", "mysql":
+		return m.ServerLagMySQL(ctx)
+	}
+	return 0, fmt.Errorf("unsupported database engine")
+}
+
+func (m HeartbeatModel) ServerLagPostgreSQL(ctx context.Context) (time.Duration, error) {
+	query := `SELECT EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var seconds sql.NullFloat64
+
+	err := m.ReadDb.QueryRowContext(ctx, query).Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+
+	// pg_last_xact_replay_timestamp is null on a primary
+	if !seconds.Valid {
+		return 0, ErrRecordNotFound
+	}
+
+	return time.Duration(seconds.Float64 * float64(time.Second)), nil
+}
+
+func (m HeartbeatModel) ServerLagMySQL(ctx context.Context) (time.Duration, error) {
+	query := `SHOW REPLICA STATUS`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.ReadDb.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, ErrRecordNotFound
+	}
+
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	err = rows.Scan(dest...)
+	if err != nil {
+		return 0, err
+	}
+
+	// mysql calls it Seconds_Behind_Source, mariadb Seconds_Behind_Master
+	for i, column := range columns {
+		if !strings.HasPrefix(column, "Seconds_Behind_") {
+			continue
+		}
+
+		// null while replication is stopped
+		if values[i] == nil {
+			return 0, ErrRecordNotFound
+		}
+
+		seconds, err := strconv.ParseInt(string(values[i]), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	return 0, ErrRecordNotFound
+}
@@ -1,7 +1,6 @@
 package data
 
 import (
-	"database/sql"
 	"errors"
 	"time"
 )
@@ -9,6 +8,14 @@ import (
 var (
 	ErrRecordNotFound = errors.New("record not found")
 	ErrEditConflict   = errors.New("edit conflict")
+
+	ErrInsufficientFunds = errors.New("issuing account has insufficient funds")
+	ErrNoAccountToCredit = errors.New("no account to credit")
+	ErrSameAccount       = errors.New("cannot transfer to the same account")
+
+	// ErrInDoubt is returned by a cross-shard transfer that may have been
+	// applied on one shard and not the other, which must not be retried.
+	ErrInDoubt = errors.New("cross-shard transfer in doubt")
 )
 
 type Models struct {
@@ -18,7 +25,7 @@ type Models struct {
 	Users     UserModel
 }
 
-func NewModels(writeDb *sql.DB, readDb *sql.DB, queryTimeout time.Duration) Models {
+func NewModels(writeDb DB, readDb DB, queryTimeout time.Duration) Models {
 	return Models{
 		Accounts: AccountModel{
 			WriteDB:      writeDb,
@@ -0,0 +1,359 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Plan is the execution plan the server chose for one of the workload's
+// queries. Shape is the plan without its estimates, timings or values,
+// so two plans with the same shape use the same operators, tables and
+// indexes.
+type Plan struct {
+	Name     string `json:"name"`
+	Query    string `json:"query"`
+	Analyzed bool   `json:"analyzed"`
+	Plan     string `json:"plan"`
+	Shape    string `json:"shape"`
+}
+
+// PlanArgs are the values the workload's queries are explained with. They
+// should come from the data set, so the planner sees realistic values.
+type PlanArgs struct {
+	TokenHash     []byte
+	CardID        int64
+	FromAccountID int64
+	ToAccountID   int64
+	UserID        int64
+	TransferID    int64
+	CreatedAt     time.Time
+}
+
+type PlanModel struct {
+	WriteDb      DB
+	ReadDb       DB
+	QueryTimeout time.Duration
+}
+
+type planQuery struct {
+	name  string
+	query string
+	args  []any
+	write bool
+}
+
+// Explain returns the plans of the queries the workload runs: the token
+// lookup, the card lookup, the delete, and either the statements inside the
+// transfer_funds procedure or, with cte, the single-statement transfer.
+// analyze runs the queries too, writes inside a transaction that is rolled
+// back. MySQL can only analyze reads, so its writes are explained without it.
+func (m PlanModel) Explain(ctx context.Context, engine string, args PlanArgs, cte, analyze bool) ([]Plan, error) {
+	switch engine {
+	case "postgresql":
+		return m.ExplainPostgreSQL(ctx, args, cte, analyze)
+	case "mariadb", "mysql":
+		return m.ExplainMySQL(ctx, engine, args, analyze)
+	}
+	return nil, fmt.Errorf("unsupported database engine")
+}
+
+func (m PlanModel) ExplainPostgreSQL(ctx context.Context, args PlanArgs, cte, analyze bool) ([]Plan, error) {
+	queries := []planQuery{
+		{
+			name: "get_for_token",
+			query: `
+        SELECT users.id, users.organization_id, users.frozen, tokens.hash, tokens.permission_id, tokens.expires_at
+        FROM users
+        INNER JOIN tokens
+        ON users.id = tokens.user_id
+        WHERE tokens.hash = $1`,
+			args: []any{string(args.TokenHash)},
+		},
+		{
+			name: "get_from_card",
+			query: `
+	SELECT accounts.id, accounts.organization_id, accounts.balance, accounts.frozen, cards.account_id, cards.expiration_date, cards.security_code, cards.frozen
+	FROM accounts
+	JOIN cards ON accounts.id = cards.account_id
+	WHERE cards.id = $1
+	`,
+			args: []any{args.CardID},
+		},
+	}
+
+	if cte {
+		queries = append(queries, planQuery{
+			name:  "transfer_funds_cte",
+			query: transferFundsCTEQuery,
+			args:  []any{args.CardID, args.FromAccountID, args.ToAccountID, args.UserID, int64(1), args.CreatedAt},
+			write: true,
+		})
+	} else {
+		queries = append(queries,
+			planQuery{
+				name: "transfer_funds_update",
+				query: `
+		UPDATE accounts
+		SET balance = CASE
+				WHEN id = $1 THEN balance - $3
+				WHEN id = $2 THEN balance + $3
+			END
+		WHERE id IN ($1, $2)
+	`,
+				args:  []any{args.FromAccountID, args.ToAccountID, int64(1)},
+				write: true,
+			},
+			planQuery{
+				name: "transfer_funds_insert",
+				query: `
+		INSERT INTO transfers (card_id, from_account_id, to_account_id, requesting_user_id, amount, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`,
+				args:  []any{args.CardID, args.FromAccountID, args.ToAccountID, args.UserID, int64(1), args.CreatedAt},
+				write: true,
+			},
+		)
+	}
+
+	queries = append(queries, planQuery{
+		name: "delete_transfer",
+		query: `
+		DELETE FROM transfers
+		WHERE id = $1
+	`,
+		args:  []any{args.TransferID},
+		write: true,
+	})
+
+	explain := `EXPLAIN (FORMAT JSON) `
+	if analyze {
+		explain = `EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) `
+	}
+
+	return m.explain(ctx, queries, func(ctx context.Context, q Querier, pq planQuery) (Plan, error) {
+		var plan string
+
+		err := q.QueryRowContext(ctx, explain+pq.query, pq.args...).Scan(&plan)
+		if err != nil {
+			return Plan{}, err
+		}
+
+		return Plan{Analyzed: analyze, Plan: plan, Shape: jsonShape(plan)}, nil
+	})
+}
+
+// ExplainMySQL explains the workload's queries on mysql, as a tree, or on
+// mariadb, as JSON. transfer_funds is always a stored procedure on these
+// engines.
+func (m PlanModel) ExplainMySQL(ctx context.Context, engine string, args PlanArgs, analyze bool) ([]Plan, error) {
+	queries := []planQuery{
+		{
+			name: "get_for_token",
+			query: `
+        SELECT users.id, users.organization_id, users.frozen, tokens.hash, tokens.permission_id, tokens.expires_at
+        FROM users
+        INNER JOIN tokens
+        ON users.id = tokens.user_id
+        WHERE tokens.hash = ?`,
+			args: []any{args.TokenHash},
+		},
+		{
+			name: "get_from_card",
+			query: `
+	SELECT accounts.id, accounts.organization_id, accounts.balance, accounts.frozen, cards.account_id, cards.expiration_date, cards.security_code, cards.frozen
+	FROM accounts
+	JOIN cards ON accounts.id = cards.account_id
+	WHERE cards.id = ?
+	`,
+			args: []any{args.CardID},
+		},
+		{
+			name: "transfer_funds_update",
+			query: `
+		UPDATE accounts
+		SET balance = CASE
+				WHEN id = ? THEN balance - ?
+				WHEN id = ? THEN balance + ?
+			END
+		WHERE id IN (?, ?)
+	`,
+			args:  []any{args.FromAccountID, int64(1), args.ToAccountID, int64(1), args.FromAccountID, args.ToAccountID},
+			write: true,
+		},
+		{
+			name: "transfer_funds_insert",
+			query: `
+		INSERT INTO transfers (card_id, from_account_id, to_account_id, requesting_user_id, amount, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`,
+			args:  []any{args.CardID, args.FromAccountID, args.ToAccountID, args.UserID, int64(1), args.CreatedAt},
+			write: true,
+		},
+		{
+			name: "delete_transfer",
+			query: `
+		DELETE FROM transfers
+		WHERE id = ?
+	`,
+			args:  []any{args.TransferID},
+			write: true,
+		},
+	}
+
+	return m.explain(ctx, queries, func(ctx context.Context, q Querier, pq planQuery) (Plan, error) {
+		if engine == "mariadb" {
+			explain := `EXPLAIN FORMAT=JSON `
+			if analyze {
+				explain = `ANALYZE FORMAT=JSON `
+			}
+
+			var plan string
+
+			err := q.QueryRowContext(ctx, explain+pq.query, pq.args...).Scan(&plan)
+			if err != nil {
+				return Plan{}, err
+			}
+
+			return Plan{Analyzed: analyze, Plan: plan, Shape: jsonShape(plan)}, nil
+		}
+
+		analyzed := analyze && !pq.write
+
+		explain := `EXPLAIN FORMAT=TREE `
+		if analyzed {
+			explain = `EXPLAIN ANALYZE `
+		}
+
+		var plan string
+
+		err := q.QueryRowContext(ctx, explain+pq.query, pq.args...).Scan(&plan)
+		if err != nil {
+			return Plan{}, err
+		}
+
+		return Plan{Analyzed: analyzed, Plan: plan, Shape: treeShape(plan)}, nil
+	})
+}
+
+// explain runs fn for each query. Reads go to the read database. Writes go to
+// the primary, inside a transaction that is rolled back, in case explaining
+// them runs them.
+func (m PlanModel) explain(ctx context.Context, queries []planQuery, fn func(context.Context, Querier, planQuery) (Plan, error)) ([]Plan, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	tx, err := m.WriteDb.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	plans := make([]Plan, 0, len(queries))
+
+	for _, pq := range queries {
+		var q Querier = m.ReadDb
+		if pq.write {
+			q = tx
+		}
+
+		plan, err := fn(ctx, q, pq)
+		if err != nil {
+			return nil, fmt.Errorf("error explaining %v -> %w", pq.name, err)
+		}
+
+		plan.Name = pq.name
+		plan.Query = strings.Join(strings.Fields(pq.query), " ")
+
+		plans = append(plans, plan)
+	}
+
+	return plans, nil
+}
+
+// shapeKeys are the plan properties that make up its shape: postgresql's
+// node types, relations, indexes and join types, and mariadb's tables, access
+// types and keys.
+var shapeKeys = []string{
+	"Node Type", "Join Type", "Relation Name", "Index Name", "Parent Relationship",
+	"table_name", "access_type", "key",
+}
+
+// jsonShape reduces a JSON plan to one line per node, indented by its depth,
+// listing the properties in shapeKeys.
+func jsonShape(plan string) string {
+	var v any
+
+	err := json.Unmarshal([]byte(plan), &v)
+	if err != nil {
+		return plan
+	}
+
+	var lines []string
+
+	var walk func(v any, depth int)
+	walk = func(v any, depth int) {
+		switch v := v.(type) {
+		case []any:
+			for _, child := range v {
+				walk(child, depth)
+			}
+		case map[string]any:
+			var props []string
+			for _, key := range shapeKeys {
+				if s, ok := v[key].(string); ok {
+					props = append(props, fmt.Sprintf("%v=%v", key, s))
+				}
+			}
+
+			next := depth
+			if len(props) > 0 {
+				lines = append(lines, strings.Repeat("  ", depth)+strings.Join(props, " "))
+				next++
+			}
+
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			slices.Sort(keys)
+
+			for _, key := range keys {
+				walk(v[key], next)
+			}
+		}
+	}
+
+	walk(v, 0)
+
+	return strings.Join(lines, "\n")
+}
+
+// treeDetails matches the parenthesised parts of a mysql tree plan: cost and
+// row estimates, timings, and the values looked up or filtered on.
+var treeDetails = regexp.MustCompile(`\s*\([^()]*\)`)
+
+// treeShape strips the details from a mysql tree plan, leaving its operators,
+// tables and indexes.
+func treeShape(plan string) string {
+	var lines []string
+
+	for _, line := range strings.Split(plan, "\n") {
+		// innermost first, for values such as <cache>(0x01)
+		for stripped := ""; stripped != line; {
+			stripped, line = line, treeDetails.ReplaceAllString(line, "")
+		}
+
+		line = strings.TrimRight(line, " ")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
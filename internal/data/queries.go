@@ -0,0 +1,132 @@
+package data
+
+// The queries the workload runs on every transfer, which PreparedDB prepares
+// up front. Queries that only run once, such as loading the users, are kept
+// with their models.
+const (
+	getForTokenPostgreSQL = `
+        SELECT users.id, users.organization_id, users.frozen, tokens.hash, tokens.permission_id, tokens.expires_at
+        FROM users
+        INNER JOIN tokens
+        ON users.id = tokens.user_id
+        WHERE tokens.hash = $1`
+
+	getForTokenMySQL = `
+        SELECT users.id, users.organization_id, users.frozen, tokens.hash, tokens.permission_id, tokens.expires_at
+        FROM users
+        INNER JOIN tokens
+        ON users.id = tokens.user_id
+        WHERE tokens.hash = ?`
+
+	getFromCardPostgreSQL = `
+	SELECT accounts.id, accounts.organization_id, accounts.balance, accounts.frozen, cards.account_id, cards.expiration_date, cards.security_code, cards.frozen
+	FROM accounts
+	JOIN cards ON accounts.id = cards.account_id
+	WHERE cards.id = $1
+	`
+
+	getFromCardMySQL = `
+	SELECT accounts.id, accounts.organization_id, accounts.balance, accounts.frozen, cards.account_id, cards.expiration_date, cards.security_code, cards.frozen
+	FROM accounts
+	JOIN cards ON accounts.id = cards.account_id
+	WHERE cards.id = ?
+	`
+
+	transferFundsPostgreSQL = `
+        SELECT transfer_funds($1, $2, $3, $4, $5, $6)
+    `
+
+	transferFundsMySQL = `CALL transfer_funds(?, ?, ?, ?, ?, ?);`
+
+	transferUpdatePostgreSQL = `
+		UPDATE accounts
+		SET balance = CASE
+				WHEN id = $1 THEN balance - $3
+				WHEN id = $2 THEN balance + $3
+			END
+		WHERE id IN ($1, $2)
+	`
+
+	transferUpdateMySQL = `
+		UPDATE accounts
+		SET balance = CASE
+				WHEN id = ? THEN balance - ?
+				WHEN id = ? THEN balance + ?
+			END
+		WHERE id IN (?, ?)
+	`
+
+	transferInsertPostgreSQL = `
+		INSERT INTO transfers (card_id, from_account_id, to_account_id, requesting_user_id, amount, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`
+
+	transferInsertMySQL = `
+		INSERT INTO transfers (card_id, from_account_id, to_account_id, requesting_user_id, amount, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+
+	visiblePostgreSQL = `
+		SELECT EXISTS (SELECT 1 FROM transfers WHERE id = $1)
+	`
+
+	visibleMySQL = `
+		SELECT EXISTS (SELECT 1 FROM transfers WHERE id = ?)
+	`
+
+	deletePostgreSQL = `
+		DELETE FROM transfers
+		WHERE id = $1
+	`
+
+	deleteMySQL = `
+		DELETE FROM transfers
+		WHERE id = ?
+	`
+
+	debitPostgreSQL  = `UPDATE accounts SET balance = balance - $1 WHERE id = $2`
+	debitMySQL       = `UPDATE accounts SET balance = balance - ? WHERE id = ?`
+	creditPostgreSQL = `UPDATE accounts SET balance = balance + $1 WHERE id = $2`
+	creditMySQL      = `UPDATE accounts SET balance = balance + ? WHERE id = ?`
+)
+
+// WorkloadQueries returns the queries the workload runs on the given engine
+// with the given tx mode: reads, which may go to a read replica, and writes,
+// which only go to the primary or a shard.
+func WorkloadQueries(engine, txMode string, sharded bool) (reads, writes []string) {
+	switch engine {
+	case "postgresql":
+		reads = []string{getForTokenPostgreSQL, getFromCardPostgreSQL, visiblePostgreSQL}
+		writes = []string{deletePostgreSQL}
+
+		switch txMode {
+		case "client":
+			writes = append(writes, transferUpdatePostgreSQL, transferInsertPostgreSQL)
+		case "cte":
+			writes = append(writes, transferFundsCTEQuery)
+		default:
+			writes = append(writes, transferFundsPostgreSQL)
+		}
+
+		if sharded {
+			writes = append(writes, debitPostgreSQL, creditPostgreSQL, transferInsertPostgreSQL)
+		}
+	case "mariadb", "mysql":
+		reads = []string{getForTokenMySQL, getFromCardMySQL, visibleMySQL}
+		writes = []string{deleteMySQL}
+
+		switch txMode {
+		case "client":
+			writes = append(writes, transferUpdateMySQL, transferInsertMySQL)
+		default:
+			writes = append(writes, transferFundsMySQL)
+		}
+
+		if sharded {
+			writes = append(writes, debitMySQL, creditMySQL, transferInsertMySQL)
+		}
+	}
+
+	return reads, writes
+}
@@ -0,0 +1,253 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerModel asks the database server about itself.
+type ServerModel struct {
+	Db           DB
+	QueryTimeout time.Duration
+}
+
+// Version returns the version the server reports, such as 17.0 or
+// 11.5.2-MariaDB-ubu2404.
+func (m ServerModel) Version(ctx context.Context, engine string) (string, error) {
+	var query string
+
+	switch engine {
+	case "postgresql":
+		query = `SHOW server_version`
+	case "mariadb", "mysql":
+		query = `SELECT VERSION()`
+	default:
+		return "", fmt.Errorf("unsupported database engine")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var version string
+
+	err := m.Db.QueryRowContext(ctx, query).Scan(&version)
+	if err != nil {
+		return "", err
+	}
+
+	return version, nil
+}
+
+// ServerSnapshot is the value of the server's statistics counters at one
+// point in time. Counters are named after the view or command they come from,
+// such as pg_stat_database.xact_commit, pg_stat_user_tables.transfers.seq_scan
+// or global_status.Innodb_row_lock_waits. Statements are keyed by query ID,
+// and only collected on postgresql with pg_stat_statements installed.
+type ServerSnapshot struct {
+	At         time.Time
+	Counters   map[string]int64
+	Statements map[string]StatementStats
+}
+
+// StatementStats are the pg_stat_statements counters of one query.
+type StatementStats struct {
+	Query          string  `json:"query"`
+	Calls          int64   `json:"calls"`
+	TotalTimeMs    float64 `json:"total_time_ms"`
+	Rows           int64   `json:"rows"`
+	SharedBlksHit  int64   `json:"shared_blks_hit"`
+	SharedBlksRead int64   `json:"shared_blks_read"`
+}
+
+// Sub returns the change in every counter since prev.
+func (s ServerSnapshot) Sub(prev ServerSnapshot) ServerSnapshot {
+	delta := ServerSnapshot{
+		At:       s.At,
+		Counters: make(map[string]int64, len(s.Counters)),
+	}
+
+	for name, v := range s.Counters {
+		delta.Counters[name] = v - prev.Counters[name]
+	}
+
+	if s.Statements != nil {
+		delta.Statements = make(map[string]StatementStats, len(s.Statements))
+
+		for id, st := range s.Statements {
+			p := prev.Statements[id]
+
+			delta.Statements[id] = StatementStats{
+				Query:          st.Query,
+				Calls:          st.Calls - p.Calls,
+				TotalTimeMs:    st.TotalTimeMs - p.TotalTimeMs,
+				Rows:           st.Rows - p.Rows,
+				SharedBlksHit:  st.SharedBlksHit - p.SharedBlksHit,
+				SharedBlksRead: st.SharedBlksRead - p.SharedBlksRead,
+			}
+		}
+	}
+
+	return delta
+}
+
+// Snapshot reads the server's statistics counters. withStatements adds
+// pg_stat_statements on postgresql; it is an error if the extension is not
+// installed.
+func (m ServerModel) Snapshot(ctx context.Context, engine string, withStatements bool) (ServerSnapshot, error) {
+	switch engine {
+	case "postgresql":
+		return m.SnapshotPostgreSQL(ctx, withStatements)
+	case "mariadb", "mysql":
+		return m.SnapshotMySQL(ctx)
+	}
+	return ServerSnapshot{}, fmt.Errorf("unsupported database engine")
+}
+
+func (m ServerModel) SnapshotPostgreSQL(ctx context.Context, withStatements bool) (ServerSnapshot, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	s := ServerSnapshot{
+		At:       time.Now(),
+		Counters: make(map[string]int64),
+	}
+
+	databaseColumns := []string{"xact_commit", "xact_rollback", "blks_read", "blks_hit", "tup_returned", "tup_fetched", "tup_inserted", "tup_updated", "tup_deleted", "conflicts", "temp_files", "temp_bytes", "deadlocks"}
+
+	query := fmt.Sprintf(`
+		SELECT %v
+		FROM pg_stat_database
+		WHERE datname = current_database()
+	`, strings.Join(databaseColumns, ", "))
+
+	values := make([]int64, len(databaseColumns))
+	dest := make([]any, len(databaseColumns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	err := m.Db.QueryRowContext(ctx, query).Scan(dest...)
+	if err != nil {
+		return ServerSnapshot{}, err
+	}
+
+	for i, column := range databaseColumns {
+		s.Counters["pg_stat_database."+column] = values[i]
+	}
+
+	tableColumns := []string{"seq_scan", "seq_tup_read", "idx_scan", "idx_tup_fetch", "n_tup_ins", "n_tup_upd", "n_tup_del", "n_tup_hot_upd", "n_live_tup", "n_dead_tup", "vacuum_count", "autovacuum_count", "analyze_count", "autoanalyze_count"}
+
+	selects := make([]string, len(tableColumns))
+	for i, column := range tableColumns {
+		selects[i] = fmt.Sprintf("COALESCE(%v, 0)", column)
+	}
+
+	query = fmt.Sprintf(`
+		SELECT relname, %v
+		FROM pg_stat_user_tables
+	`, strings.Join(selects, ", "))
+
+	rows, err := m.Db.QueryContext(ctx, query)
+	if err != nil {
+		return ServerSnapshot{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var table string
+
+		err = rows.Scan(append([]any{&table}, dest[:len(tableColumns)]...)...)
+		if err != nil {
+			return ServerSnapshot{}, err
+		}
+
+		for i, column := range tableColumns {
+			s.Counters["pg_stat_user_tables."+table+"."+column] = values[i]
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return ServerSnapshot{}, err
+	}
+
+	if !withStatements {
+		return s, nil
+	}
+
+	query = `
+		SELECT queryid::text, query, calls, total_exec_time, rows, shared_blks_hit, shared_blks_read
+		FROM pg_stat_statements
+		WHERE dbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+		AND queryid IS NOT NULL
+	`
+
+	rows, err = m.Db.QueryContext(ctx, query)
+	if err != nil {
+		return ServerSnapshot{}, err
+	}
+	defer rows.Close()
+
+	s.Statements = make(map[string]StatementStats)
+
+	for rows.Next() {
+		var id string
+		var st StatementStats
+
+		err = rows.Scan(&id, &st.Query, &st.Calls, &st.TotalTimeMs, &st.Rows, &st.SharedBlksHit, &st.SharedBlksRead)
+		if err != nil {
+			return ServerSnapshot{}, err
+		}
+
+		s.Statements[id] = st
+	}
+
+	if err = rows.Err(); err != nil {
+		return ServerSnapshot{}, err
+	}
+
+	return s, nil
+}
+
+// SnapshotMySQL reads every numeric variable of SHOW GLOBAL STATUS.
+func (m ServerModel) SnapshotMySQL(ctx context.Context) (ServerSnapshot, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	s := ServerSnapshot{
+		At:       time.Now(),
+		Counters: make(map[string]int64),
+	}
+
+	rows, err := m.Db.QueryContext(ctx, `SHOW GLOBAL STATUS`)
+	if err != nil {
+		return ServerSnapshot{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var value sql.NullString
+
+		err = rows.Scan(&name, &value)
+		if err != nil {
+			return ServerSnapshot{}, err
+		}
+
+		n, err := strconv.ParseInt(value.String, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s.Counters["global_status."+name] = n
+	}
+
+	if err = rows.Err(); err != nil {
+		return ServerSnapshot{}, err
+	}
+
+	return s, nil
+}
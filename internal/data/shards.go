@@ -0,0 +1,527 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// When accounts are sharded, a transfer between accounts on two shards can't
+// run in one local transaction. It is either run as a saga of local
+// transactions, Debit on the issuing account's shard and then Credit on the
+// acquiring account's shard, with Refund to compensate for the debit if the
+// credit fails, or as one distributed transaction with XAModel. Either way,
+// the transfer is recorded on the issuing account's shard.
+
+// Debit debits the issuing account and records the transfer, on the issuing
+// account's shard. It is the first step of a cross-shard saga.
+func (m *TransferModel) Debit(ctx context.Context, transfer *Transfer, engine string) (*Transfer, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	tx, err := m.WriteDb.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = debit(ctx, inTx(m.WriteDb, tx), transfer, engine)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return transfer, nil
+}
+
+// Credit credits the acquiring account, on its shard. It is the second step
+// of a cross-shard saga. If the account isn't on the shard, it returns
+// ErrNoAccountToCredit, so the debit is refunded.
+func (m *TransferModel) Credit(ctx context.Context, transfer *Transfer, engine string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	return credit(ctx, m.WriteDb, transfer, engine)
+}
+
+// Refund compensates for a debit whose credit failed, by crediting the
+// issuing account back and deleting the transfer, on the issuing account's
+// shard.
+func (m *TransferModel) Refund(ctx context.Context, transfer *Transfer, engine string) error {
+	var refundQuery, deleteQuery string
+
+	switch engine {
+	case "postgresql":
+		refundQuery = creditPostgreSQL
+		deleteQuery = deletePostgreSQL
+	case "mariadb", "mysql":
+		refundQuery = creditMySQL
+		deleteQuery = deleteMySQL
+	default:
+		return fmt.Errorf("unsupported database engine")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	tx, err := m.WriteDb.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := inTx(m.WriteDb, tx)
+
+	_, err = q.ExecContext(ctx, refundQuery, transfer.Amount, transfer.FromAccountID)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.ExecContext(ctx, deleteQuery, transfer.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func debit(ctx context.Context, q Querier, transfer *Transfer, engine string) error {
+	args := []any{
+		transfer.CardID,
+		transfer.FromAccountID,
+		transfer.ToAccountID,
+		transfer.RequestingUser.ID,
+		transfer.Amount,
+		transfer.CreatedAt,
+	}
+
+	switch engine {
+	case "postgresql":
+		_, err := q.ExecContext(ctx, debitPostgreSQL, transfer.Amount, transfer.FromAccountID)
+		if err != nil {
+			return err
+		}
+
+		return q.QueryRowContext(ctx, transferInsertPostgreSQL, args...).Scan(&transfer.ID)
+	case "mariadb", "mysql":
+		_, err := q.ExecContext(ctx, debitMySQL, transfer.Amount, transfer.FromAccountID)
+		if err != nil {
+			return err
+		}
+
+		result, err := q.ExecContext(ctx, transferInsertMySQL, args...)
+		if err != nil {
+			return err
+		}
+
+		transfer.ID, err = result.LastInsertId()
+		return err
+	}
+
+	return fmt.Errorf("unsupported database engine")
+}
+
+func credit(ctx context.Context, q Querier, transfer *Transfer, engine string) error {
+	var query string
+
+	switch engine {
+	case "postgresql":
+		query = creditPostgreSQL
+	case "mariadb", "mysql":
+		query = creditMySQL
+	default:
+		return fmt.Errorf("unsupported database engine")
+	}
+
+	result, err := q.ExecContext(ctx, query, transfer.Amount, transfer.ToAccountID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	// mysql only counts the rows it changed, which a credit of 0 doesn't
+	if rows == 0 && transfer.Amount == 0 && engine != "postgresql" {
+		return nil
+	}
+
+	if rows != 1 {
+		return fmt.Errorf("%w: account %d", ErrNoAccountToCredit, transfer.ToAccountID)
+	}
+
+	return nil
+}
+
+// XAModel runs a transfer between accounts on two shards as one distributed
+// transaction, with two-phase commit: PREPARE TRANSACTION on PostgreSQL,
+// which needs max_prepared_transactions to be above 0, and XA transactions
+// on MySQL and MariaDB.
+type XAModel struct {
+	FromDb       *sql.DB
+	ToDb         *sql.DB
+	QueryTimeout time.Duration
+
+	// FromFirst prepares the issuing account's shard first. Transfers that
+	// always prepare the lower shard first can't deadlock across shards.
+	FromFirst bool
+}
+
+// xaDialect is how an engine runs a branch of a distributed transaction. In
+// each statement, {xid} stands for the branch's transaction ID.
+type xaDialect struct {
+	begin            []string
+	prepare          []string
+	commit           string
+	rollback         []string
+	rollbackPrepared string
+}
+
+func xaDialectFor(engine string) (xaDialect, error) {
+	switch engine {
+	case "postgresql":
+		return xaDialect{
+			begin:            []string{`BEGIN`},
+			prepare:          []string{`PREPARE TRANSACTION '{xid}'`},
+			commit:           `COMMIT PREPARED '{xid}'`,
+			rollback:         []string{`ROLLBACK`},
+			rollbackPrepared: `ROLLBACK PREPARED '{xid}'`,
+		}, nil
+	case "mariadb", "mysql":
+		return xaDialect{
+			begin:            []string{`XA START '{xid}'`},
+			prepare:          []string{`XA END '{xid}'`, `XA PREPARE '{xid}'`},
+			commit:           `XA COMMIT '{xid}'`,
+			rollback:         []string{`XA END '{xid}'`, `XA ROLLBACK '{xid}'`},
+			rollbackPrepared: `XA ROLLBACK '{xid}'`,
+		}, nil
+	}
+	return xaDialect{}, fmt.Errorf("unsupported database engine")
+}
+
+const (
+	branchActive = iota + 1
+	branchPrepared
+	branchCommitted
+)
+
+// xaBranch is one shard's part of a distributed transaction, which runs on a
+// connection of its own.
+type xaBranch struct {
+	db    *sql.DB
+	xid   string
+	work  func(ctx context.Context, q Querier) error
+	conn  *sql.Conn
+	state int
+}
+
+func (b *xaBranch) exec(ctx context.Context, stmt string) error {
+	_, err := b.conn.ExecContext(ctx, strings.ReplaceAll(stmt, "{xid}", b.xid))
+	return err
+}
+
+func (b *xaBranch) prepare(ctx context.Context, d xaDialect) error {
+	var err error
+
+	b.conn, err = b.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range d.begin {
+		err = b.exec(ctx, stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	b.state = branchActive
+
+	err = b.work(ctx, b.conn)
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range d.prepare {
+		err = b.exec(ctx, stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	b.state = branchPrepared
+
+	return nil
+}
+
+// abort rolls the branch back. A connection that can't be rolled back is
+// discarded, and the error is only returned if the branch was prepared, as a
+// prepared branch outlives its connection.
+func (b *xaBranch) abort(ctx context.Context, d xaDialect) error {
+	var err error
+
+	switch b.state {
+	case branchActive:
+		for _, stmt := range d.rollback {
+			err = b.exec(ctx, stmt)
+		}
+	case branchPrepared:
+		err = b.exec(ctx, d.rollbackPrepared)
+	}
+
+	if err != nil {
+		b.conn.Raw(func(any) error {
+			return driver.ErrBadConn
+		})
+	}
+
+	if b.state != branchPrepared {
+		return nil
+	}
+
+	return err
+}
+
+// xaCommitAttempts is how many times a prepared branch is committed before
+// it is left in doubt.
+const xaCommitAttempts = 3
+
+// commit commits the prepared branch. If that fails, its connection is
+// discarded, as MySQL only lets another connection commit the branch once its
+// own is gone, and the commit is retried on another.
+func (b *xaBranch) commit(ctx context.Context, d xaDialect) error {
+	err := b.exec(ctx, d.commit)
+
+	for attempt := 1; err != nil && attempt < xaCommitAttempts; attempt++ {
+		b.discard()
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * 50 * time.Millisecond):
+		}
+
+		_, err = b.db.ExecContext(ctx, strings.ReplaceAll(d.commit, "{xid}", b.xid))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	b.state = branchCommitted
+
+	return nil
+}
+
+func (b *xaBranch) discard() {
+	if b.conn == nil {
+		return
+	}
+
+	b.conn.Raw(func(any) error {
+		return driver.ErrBadConn
+	})
+	b.conn.Close()
+	b.conn = nil
+}
+
+func (b *xaBranch) close() {
+	if b.conn != nil {
+		b.conn.Close()
+	}
+}
+
+// InDoubtError is returned by XAModel.TransferFunds when it couldn't finish
+// what it decided: committing every branch once all were prepared, or
+// rolling back those prepared otherwise. Xids are the branches that may
+// still be prepared, which ResolveXA must commit, if Commit is set, or roll
+// back.
+type InDoubtError struct {
+	Xids   []string
+	Commit bool
+	Err    error
+}
+
+func (e *InDoubtError) Error() string {
+	return fmt.Sprintf("%v: %v -> %v", ErrInDoubt, strings.Join(e.Xids, ", "), e.Err)
+}
+
+func (e *InDoubtError) Unwrap() []error {
+	return []error{ErrInDoubt, e.Err}
+}
+
+// TransferFunds prepares the debit and the transfer on the issuing account's
+// shard and the credit on the acquiring account's shard, and commits both
+// once both are prepared. xid identifies the transaction, and must be unique.
+// Every branch is committed, even if another's commit fails, and if any
+// does, the transfer is in doubt, and an InDoubtError is returned.
+func (m XAModel) TransferFunds(ctx context.Context, transfer *Transfer, engine, xid string) (*Transfer, error) {
+	d, err := xaDialectFor(engine)
+	if err != nil {
+		return nil, err
+	}
+
+	// shards on the same server need branch IDs of their own
+	from := &xaBranch{
+		db:  m.FromDb,
+		xid: xid + "-from",
+		work: func(ctx context.Context, q Querier) error {
+			return debit(ctx, q, transfer, engine)
+		},
+	}
+	to := &xaBranch{
+		db:  m.ToDb,
+		xid: xid + "-to",
+		work: func(ctx context.Context, q Querier) error {
+			return credit(ctx, q, transfer, engine)
+		},
+	}
+
+	branches := []*xaBranch{to, from}
+	if m.FromFirst {
+		branches = []*xaBranch{from, to}
+	}
+
+	defer func() {
+		for _, b := range branches {
+			b.close()
+		}
+	}()
+
+	prepareCtx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	for _, b := range branches {
+		err = b.prepare(prepareCtx, d)
+		if err == nil {
+			continue
+		}
+
+		// the rollback must run even if the transfer timed out or was
+		// cancelled
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), m.QueryTimeout)
+		defer cancel()
+
+		var xids []string
+		var abortErrs []error
+		for _, b := range branches {
+			if abortErr := b.abort(abortCtx, d); abortErr != nil {
+				xids = append(xids, b.xid)
+				abortErrs = append(abortErrs, fmt.Errorf("%v -> %w", b.xid, abortErr))
+			}
+		}
+
+		if len(abortErrs) > 0 {
+			return nil, &InDoubtError{
+				Xids: xids,
+				Err:  fmt.Errorf("error rolling back prepared branches -> %w, after error preparing -> %w", errors.Join(abortErrs...), err),
+			}
+		}
+
+		return nil, err
+	}
+
+	// every branch is prepared, so the transfer has to commit, whether or
+	// not it has been cancelled in the meantime
+	var xids []string
+	var commitErrs []error
+	for _, b := range branches {
+		commitCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), m.QueryTimeout)
+		err = b.commit(commitCtx, d)
+		cancel()
+
+		if err != nil {
+			xids = append(xids, b.xid)
+			commitErrs = append(commitErrs, fmt.Errorf("%v -> %w", b.xid, err))
+		}
+	}
+
+	if len(commitErrs) > 0 {
+		return nil, &InDoubtError{
+			Xids:   xids,
+			Commit: true,
+			Err:    fmt.Errorf("error committing -> %w", errors.Join(commitErrs...)),
+		}
+	}
+
+	return transfer, nil
+}
+
+// PreparedXids lists the transactions prepared on db whose xids start with
+// prefix. On MySQL and MariaDB, that is every one on the server, whichever
+// database it was prepared in.
+func PreparedXids(ctx context.Context, db *sql.DB, engine, prefix string) ([]string, error) {
+	var xids []string
+
+	switch engine {
+	case "postgresql":
+		rows, err := db.QueryContext(ctx, `SELECT gid FROM pg_prepared_xacts WHERE database = current_database() AND starts_with(gid, $1)`, prefix)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var xid string
+
+			err = rows.Scan(&xid)
+			if err != nil {
+				return nil, err
+			}
+
+			xids = append(xids, xid)
+		}
+
+		return xids, rows.Err()
+	case "mariadb", "mysql":
+		rows, err := db.QueryContext(ctx, `XA RECOVER`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var formatID, gtridLength, bqualLength int64
+			var data []byte
+
+			err = rows.Scan(&formatID, &gtridLength, &bqualLength, &data)
+			if err != nil {
+				return nil, err
+			}
+
+			if xid := string(data[:min(gtridLength, int64(len(data)))]); strings.HasPrefix(xid, prefix) {
+				xids = append(xids, xid)
+			}
+		}
+
+		return xids, rows.Err()
+	}
+
+	return nil, fmt.Errorf("unsupported database engine")
+}
+
+// ResolveXA commits or rolls back a transaction prepared on db.
+func ResolveXA(ctx context.Context, db *sql.DB, engine, xid string, commit bool) error {
+	d, err := xaDialectFor(engine)
+	if err != nil {
+		return err
+	}
+
+	stmt := d.rollbackPrepared
+	if commit {
+		stmt = d.commit
+	}
+
+	_, err = db.ExecContext(ctx, strings.ReplaceAll(stmt, "{xid}", xid))
+	return err
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -18,23 +19,23 @@ type Transfer struct {
 }
 
 type TransferModel struct {
-	WriteDb      *sql.DB
-	ReadDb       *sql.DB
+	WriteDb      DB
+	ReadDb       DB
 	QueryTimeout time.Duration
 }
 
-func (m *TransferModel) TransferFunds(transfer *Transfer, engine string) (*Transfer, error) {
+func (m *TransferModel) TransferFunds(ctx context.Context, transfer *Transfer, engine string) (*Transfer, error) {
 	switch engine {
 	case "postgresql":
-		return m.TransferFundsPostgreSQL(transfer)
+		return m.TransferFundsPostgreSQL(ctx, transfer)
 	case "mariadb", "mysql":
-		return m.TransferFundsMySQL(transfer)
+		return m.TransferFundsMySQL(ctx, transfer)
 	}
 	return nil, fmt.Errorf("unsupported database engine")
 }
 
-func (m *TransferModel) TransferFundsMySQL(transfer *Transfer) (*Transfer, error) {
-	query := `CALL transfer_funds(?, ?, ?, ?, ?, ?);`
+func (m *TransferModel) TransferFundsMySQL(ctx context.Context, transfer *Transfer) (*Transfer, error) {
+	query := transferFundsMySQL
 
 	args := []interface{}{
 		transfer.CardID,
@@ -45,7 +46,7 @@ func (m *TransferModel) TransferFundsMySQL(transfer *Transfer) (*Transfer, error
 		transfer.CreatedAt,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), m.QueryTimeout)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	// Execute the stored procedure
@@ -64,10 +65,8 @@ func (m *TransferModel) TransferFundsMySQL(transfer *Transfer) (*Transfer, error
 	return transfer, nil
 }
 
-func (m *TransferModel) TransferFundsPostgreSQL(transfer *Transfer) (*Transfer, error) {
-	query := `
-        SELECT transfer_funds($1, $2, $3, $4, $5, $6)
-    `
+func (m *TransferModel) TransferFundsPostgreSQL(ctx context.Context, transfer *Transfer) (*Transfer, error) {
+	query := transferFundsPostgreSQL
 
 	args := []interface{}{
 		transfer.CardID,
@@ -78,11 +77,10 @@ func (m *TransferModel) TransferFundsPostgreSQL(transfer *Transfer) (*Transfer,
 		transfer.CreatedAt,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), m.QueryTimeout)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
-	var transferID int64
-	err := m.WriteDb.QueryRowContext(ctx, query, args...).Scan(&transferID)
+	err := m.WriteDb.QueryRowContext(ctx, query, args...).Scan(&transfer.ID)
 	if err != nil {
 		fmt.Printf("Error transferring funds -> %v\n", err)
 		return nil, err
@@ -91,23 +89,310 @@ func (m *TransferModel) TransferFundsPostgreSQL(transfer *Transfer) (*Transfer,
 	return transfer, nil
 }
 
-func (m *TransferModel) Delete(transferId int64, engine string) error {
+// TransferFundsClient does the same work as the transfer_funds procedure, but
+// drives the transaction from the client, one statement per round trip, at
+// the given isolation level.
+func (m *TransferModel) TransferFundsClient(ctx context.Context, transfer *Transfer, engine string, isolation sql.IsolationLevel) (*Transfer, error) {
 	switch engine {
 	case "postgresql":
-		return m.DeletePostgreSQL(transferId)
+		return m.TransferFundsClientPostgreSQL(ctx, transfer, isolation)
 	case "mariadb", "mysql":
-		return m.DeleteMySQL(transferId)
+		return m.TransferFundsClientMySQL(ctx, transfer, isolation)
 	}
-	return fmt.Errorf("unsupported database engine")
+	return nil, fmt.Errorf("unsupported database engine")
 }
 
-func (m *TransferModel) DeletePostgreSQL(transferId int64) error {
-	query := `
-		DELETE FROM transfers
-		WHERE id = $1
+func (m *TransferModel) TransferFundsClientMySQL(ctx context.Context, transfer *Transfer, isolation sql.IsolationLevel) (*Transfer, error) {
+	updateQuery := transferUpdateMySQL
+
+	insertQuery := transferInsertMySQL
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	tx, err := m.WriteDb.BeginTx(ctx, &sql.TxOptions{Isolation: isolation})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	q := inTx(m.WriteDb, tx)
+
+	_, err = q.ExecContext(ctx, updateQuery,
+		transfer.FromAccountID,
+		transfer.Amount,
+		transfer.ToAccountID,
+		transfer.Amount,
+		transfer.FromAccountID,
+		transfer.ToAccountID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := q.ExecContext(ctx, insertQuery,
+		transfer.CardID,
+		transfer.FromAccountID,
+		transfer.ToAccountID,
+		transfer.RequestingUser.ID,
+		transfer.Amount,
+		transfer.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer.ID, err = result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return transfer, nil
+}
+
+func (m *TransferModel) TransferFundsClientPostgreSQL(ctx context.Context, transfer *Transfer, isolation sql.IsolationLevel) (*Transfer, error) {
+	updateQuery := transferUpdatePostgreSQL
+
+	insertQuery := transferInsertPostgreSQL
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	tx, err := m.WriteDb.BeginTx(ctx, &sql.TxOptions{Isolation: isolation})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	q := inTx(m.WriteDb, tx)
+
+	_, err = q.ExecContext(ctx, updateQuery, transfer.FromAccountID, transfer.ToAccountID, transfer.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	err = q.QueryRowContext(ctx, insertQuery,
+		transfer.CardID,
+		transfer.FromAccountID,
+		transfer.ToAccountID,
+		transfer.RequestingUser.ID,
+		transfer.Amount,
+		transfer.CreatedAt,
+	).Scan(&transfer.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return transfer, nil
+}
+
+// TransferFundsCTE runs the whole transfer as a single data-modifying
+// statement. Instead of relying on the balance check constraint to raise an
+// error, the debit only matches if the issuing account has enough funds, and
+// ErrInsufficientFunds is returned if it doesn't. ErrNoAccountToCredit is
+// returned, and nothing is applied, if the account to credit doesn't exist,
+// and ErrSameAccount if it is the account to debit.
+func (m *TransferModel) TransferFundsCTE(ctx context.Context, transfer *Transfer, engine string) (*Transfer, error) {
+	switch engine {
+	case "postgresql":
+		return m.TransferFundsCTEPostgreSQL(ctx, transfer)
+	}
+	return nil, fmt.Errorf("cte transfers are only supported by postgresql")
+}
+
+// transferFundsCTEQuery debits, credits and records the transfer in a
+// single statement. The credit and the insert only happen if the debit does.
+// A debit without a credit must not commit either, so in that case the final
+// select casts text to an integer, which fails the whole statement.
+const transferFundsCTEQuery = `
+		WITH debit AS (
+			UPDATE accounts
+			SET balance = balance - $5
+			WHERE id = $2 AND balance >= $5
+			RETURNING id
+		), credit AS (
+			UPDATE accounts
+			SET balance = balance + $5
+			WHERE id = $3 AND EXISTS (SELECT 1 FROM debit)
+			RETURNING id
+		), inserted AS (
+			INSERT INTO transfers (card_id, from_account_id, to_account_id, requesting_user_id, amount, created_at)
+			SELECT $1::bigint, $2::int, $3::int, $4::int, $5::bigint, $6::timestamp
+			FROM debit, credit
+			RETURNING id
+		)
+		SELECT
+			(SELECT id FROM inserted),
+			CASE
+				WHEN EXISTS (SELECT 1 FROM debit) AND NOT EXISTS (SELECT 1 FROM credit)
+				THEN (SELECT 'reserva: no account to credit' FROM debit)::int
+				ELSE 0
+			END
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), m.QueryTimeout)
+func (m *TransferModel) TransferFundsCTEPostgreSQL(ctx context.Context, transfer *Transfer) (*Transfer, error) {
+	// both updates would match the same row, and only the first one applies
+	if transfer.FromAccountID == transfer.ToAccountID {
+		return nil, ErrSameAccount
+	}
+
+	args := []interface{}{
+		transfer.CardID,
+		transfer.FromAccountID,
+		transfer.ToAccountID,
+		transfer.RequestingUser.ID,
+		transfer.Amount,
+		transfer.CreatedAt,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var id sql.NullInt64
+	var check int
+
+	err := m.WriteDb.QueryRowContext(ctx, transferFundsCTEQuery, args...).Scan(&id, &check)
+	if err != nil {
+		// invalid_text_representation is raised by the credit check
+		if sqlState(err) == "22P02" {
+			return nil, fmt.Errorf("%w: account %d", ErrNoAccountToCredit, transfer.ToAccountID)
+		}
+		return nil, err
+	}
+
+	// the debit matched nothing
+	if !id.Valid {
+		return nil, ErrInsufficientFunds
+	}
+
+	transfer.ID = id.Int64
+
+	return transfer, nil
+}
+
+// Visible reports whether the transfer with the given ID can be read from the
+// read replica yet.
+func (m *TransferModel) Visible(ctx context.Context, transferId int64, engine string) (bool, error) {
+	switch engine {
+	case "postgresql":
+		return m.VisiblePostgreSQL(ctx, transferId)
+	case "mariadb", "mysql":
+		return m.VisibleMySQL(ctx, transferId)
+	}
+	return false, fmt.Errorf("unsupported database engine")
+}
+
+func (m *TransferModel) VisiblePostgreSQL(ctx context.Context, transferId int64) (bool, error) {
+	query := visiblePostgreSQL
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var visible bool
+
+	err := m.ReadDb.QueryRowContext(ctx, query, transferId).Scan(&visible)
+	if err != nil {
+		return false, err
+	}
+
+	return visible, nil
+}
+
+func (m *TransferModel) VisibleMySQL(ctx context.Context, transferId int64) (bool, error) {
+	query := visibleMySQL
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var visible bool
+
+	err := m.ReadDb.QueryRowContext(ctx, query, transferId).Scan(&visible)
+	if err != nil {
+		return false, err
+	}
+
+	return visible, nil
+}
+
+// Existing returns which of the given transfer IDs exist on the primary.
+func (m *TransferModel) Existing(ctx context.Context, transferIds []int64, engine string) (map[int64]bool, error) {
+	if len(transferIds) == 0 {
+		return map[int64]bool{}, nil
+	}
+
+	placeholders := make([]string, len(transferIds))
+	args := make([]any, len(transferIds))
+
+	for i, id := range transferIds {
+		switch engine {
+		case "postgresql":
+			placeholders[i] = fmt.Sprintf("$%d", i+1)
+		case "mariadb", "mysql":
+			placeholders[i] = "?"
+		default:
+			return nil, fmt.Errorf("unsupported database engine")
+		}
+		args[i] = id
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id FROM transfers
+		WHERE id IN (%v)
+	`, strings.Join(placeholders, ", "))
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.WriteDb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := make(map[int64]bool, len(transferIds))
+
+	for rows.Next() {
+		var id int64
+
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		existing[id] = true
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return existing, nil
+}
+
+func (m *TransferModel) Delete(ctx context.Context, transferId int64, engine string) error {
+	switch engine {
+	case "postgresql":
+		return m.DeletePostgreSQL(ctx, transferId)
+	case "mariadb", "mysql":
+		return m.DeleteMySQL(ctx, transferId)
+	}
+	return fmt.Errorf("unsupported database engine")
+}
+
+func (m *TransferModel) DeletePostgreSQL(ctx context.Context, transferId int64) error {
+	query := deletePostgreSQL
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	_, err := m.WriteDb.ExecContext(ctx, query, transferId)
@@ -119,13 +404,10 @@ func (m *TransferModel) DeletePostgreSQL(transferId int64) error {
 	return nil
 }
 
-func (m *TransferModel) DeleteMySQL(transferId int64) error {
-	query := `
-		DELETE FROM transfers
-		WHERE id = ?
-	`
+func (m *TransferModel) DeleteMySQL(ctx context.Context, transferId int64) error {
+	query := deleteMySQL
 
-	ctx, cancel := context.WithTimeout(context.Background(), m.QueryTimeout)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	_, err := m.WriteDb.ExecContext(ctx, query, transferId)
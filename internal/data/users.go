@@ -2,9 +2,9 @@ package data
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
 	"math/rand"
+	"slices"
 	"sync"
 	"time"
 )
@@ -19,8 +19,8 @@ type User struct {
 }
 
 type UserModel struct {
-	WriteDb      *sql.DB
-	ReadDb       *sql.DB
+	WriteDb      DB
+	ReadDb       DB
 	QueryTimeout time.Duration
 }
 
@@ -35,21 +35,21 @@ func (s *SafeUserSlice) Add(element User) {
 	s.slice = append(s.slice, element)
 }
 
-func (s *SafeUserSlice) GetRandom() (index int64, element User) {
+func (s *SafeUserSlice) GetRandom(rng *rand.Rand) (index int64, element User) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if len(s.slice) == 0 {
 		return
 	}
 
-	index = rand.Int63n(int64(len(s.slice)))
+	index = rng.Int63n(int64(len(s.slice)))
 
 	element = s.slice[index]
 
 	return index, element
 }
 
-func (s *SafeUserSlice) GetKindaRandom() (index int, element User) {
+func (s *SafeUserSlice) GetKindaRandom(rng *rand.Rand) (index int, element User) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if len(s.slice) == 0 {
@@ -59,17 +59,17 @@ func (s *SafeUserSlice) GetKindaRandom() (index int, element User) {
 	numElements := len(s.slice)
 
 	// 80% chance of selecting first 20% of elements
-	if rand.Intn(100) < 80 {
+	if rng.Intn(100) < 80 {
 
 		// 80% chance of selecting first 4% of elements
-		if rand.Intn(100) < 80 {
-			index = rand.Intn(numElements / 25)
+		if rng.Intn(100) < 80 {
+			index = rng.Intn(numElements / 25)
 		} else {
-			index = rand.Intn(numElements / 5)
+			index = rng.Intn(numElements / 5)
 		}
 
 	} else {
-		index = rand.Intn(numElements)
+		index = rng.Intn(numElements)
 	}
 
 	element = s.slice[index]
@@ -83,17 +83,24 @@ func (s *SafeUserSlice) Remove(index int64) {
 	s.slice = append(s.slice[:index], s.slice[index+1:]...)
 }
 
-func (m UserModel) GetAll(engine string) (*SafeUserSlice, error) {
+// All returns a copy of the users.
+func (s *SafeUserSlice) All() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.slice)
+}
+
+func (m UserModel) GetAll(ctx context.Context, engine string) (*SafeUserSlice, error) {
 	switch engine {
 	case "postgresql":
-		return m.GetAllUsersPostgreSQL()
+		return m.GetAllUsersPostgreSQL(ctx)
 	case "mariadb", "mysql":
-		return m.GetAllUsersMySQL()
+		return m.GetAllUsersMySQL(ctx)
 	}
 	return nil, fmt.Errorf("unsupported database engine")
 }
 
-func (m UserModel) GetAllUsersPostgreSQL() (*SafeUserSlice, error) {
+func (m UserModel) GetAllUsersPostgreSQL(ctx context.Context) (*SafeUserSlice, error) {
 	query := `
 SELECT
 	USERS.ID,
@@ -116,7 +123,7 @@ ORDER BY
 	ORGANIZATION_ID,
 	ACCOUNT_ID`
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	rows, err := m.ReadDb.QueryContext(ctx, query)
@@ -161,7 +168,7 @@ ORDER BY
 	return &users, nil
 }
 
-func (m UserModel) GetAllUsersMySQL() (*SafeUserSlice, error) {
+func (m UserModel) GetAllUsersMySQL(ctx context.Context) (*SafeUserSlice, error) {
 	query := `
 SELECT
 	users.ID,
@@ -184,7 +191,7 @@ ORDER BY
 	ORGANIZATION_ID,
 	ACCOUNT_ID`
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	rows, err := m.ReadDb.QueryContext(ctx, query)
@@ -228,27 +235,22 @@ ORDER BY
 	return &users, nil
 }
 
-func (m UserModel) GetForToken(tokenHash []byte, engine string) ([]*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenHash []byte, engine string) ([]*User, error) {
 	switch engine {
 	case "postgresql":
-		return m.GetForTokenPostgreSQL(tokenHash)
+		return m.GetForTokenPostgreSQL(ctx, tokenHash)
 	case "mariadb", "mysql":
-		return m.GetForTokenMySQL(tokenHash)
+		return m.GetForTokenMySQL(ctx, tokenHash)
 	}
 	return nil, fmt.Errorf("unsupported database engine")
 }
 
-func (m UserModel) GetForTokenMySQL(tokenHash []byte) ([]*User, error) {
-	query := `
-        SELECT users.id, users.organization_id, users.frozen, tokens.hash, tokens.permission_id, tokens.expires_at
-        FROM users
-        INNER JOIN tokens
-        ON users.id = tokens.user_id
-        WHERE tokens.hash = ?`
+func (m UserModel) GetForTokenMySQL(ctx context.Context, tokenHash []byte) ([]*User, error) {
+	query := getForTokenMySQL
 
 	var users []*User
 
-	ctx, cancel := context.WithTimeout(context.Background(), m.QueryTimeout)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	rows, err := m.ReadDb.QueryContext(ctx, query, tokenHash)
@@ -286,20 +288,17 @@ func (m UserModel) GetForTokenMySQL(tokenHash []byte) ([]*User, error) {
 	return users, nil
 }
 
-func (m UserModel) GetForTokenPostgreSQL(tokenHash []byte) ([]*User, error) {
-	query := `
-        SELECT users.id, users.organization_id, users.frozen, tokens.hash, tokens.permission_id, tokens.expires_at
-        FROM users
-        INNER JOIN tokens
-        ON users.id = tokens.user_id
-        WHERE tokens.hash = $1`
+func (m UserModel) GetForTokenPostgreSQL(ctx context.Context, tokenHash []byte) ([]*User, error) {
+	query := getForTokenPostgreSQL
 
 	var users []*User
 
-	ctx, cancel := context.WithTimeout(context.Background(), m.QueryTimeout)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
-	rows, err := m.ReadDb.QueryContext(ctx, query, tokenHash)
+	// the hash is the text form of a uuid, which pgx would treat as raw uuid
+	// bytes if it was passed as a []byte
+	rows, err := m.ReadDb.QueryContext(ctx, query, string(tokenHash))
 	if err != nil {
 		return nil, err
 	}
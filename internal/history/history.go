@@ -0,0 +1,162 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/results"
+)
+
+// indexFile lists every run in a history directory, one JSON entry per line.
+// The results of each run are kept next to it, in runs/<id>.json.
+const indexFile = "index.jsonl"
+
+// Entry describes one run in the history.
+type Entry struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Engine        string    `json:"engine"`
+	EngineVersion string    `json:"engine_version"`
+	Commit        string    `json:"commit"`
+	ScenarioHash  string    `json:"scenario_hash"`
+	StartedAt     time.Time `json:"started_at"`
+	Interrupted   bool      `json:"interrupted"`
+	Failed        bool      `json:"failed"`
+}
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// Save stores the results of a run in the history directory, creating it if
+// needed, and returns its index entry.
+func Save(dir string, result *results.Result) (Entry, error) {
+	err := os.MkdirAll(filepath.Join(dir, "runs"), 0755)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	base := fmt.Sprintf("%v-%v", result.StartedAt.UTC().Format("20060102T150405Z"), unsafeChars.ReplaceAllString(result.Name, "_"))
+	id := base
+
+	for i := 2; ; i++ {
+		_, err := os.Stat(runPath(dir, id))
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		id = fmt.Sprintf("%v-%d", base, i)
+	}
+
+	err = results.Write(runPath(dir, id), result)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	entry := Entry{
+		ID:            id,
+		Name:          result.Name,
+		Engine:        result.Engine,
+		EngineVersion: result.EngineVersion,
+		Commit:        result.Commit,
+		ScenarioHash:  result.ScenarioHash,
+		StartedAt:     result.StartedAt,
+		Interrupted:   result.Interrupted,
+		Failed:        result.Error != "",
+	}
+
+	js, err := json.Marshal(entry)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, indexFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(js, '\n'))
+	if err != nil {
+		return Entry{}, err
+	}
+
+	return entry, nil
+}
+
+// List returns every run in the history directory, oldest first.
+func List(dir string) ([]Entry, error) {
+	f, err := os.Open(filepath.Join(dir, indexFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry Entry
+
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// Load reads the results of the run with the given ID.
+func Load(dir, id string) (*results.Result, error) {
+	rs, err := results.Read(runPath(dir, id))
+	if err != nil {
+		return nil, err
+	}
+
+	return rs[0], nil
+}
+
+// Latest returns the last two successful, uninterrupted runs of the named
+// target that share the scenario of its last such run, older first.
+func Latest(dir, name string) (Entry, Entry, error) {
+	entries, err := List(dir)
+	if err != nil {
+		return Entry{}, Entry{}, err
+	}
+
+	var found []Entry
+
+	for i := len(entries) - 1; i >= 0 && len(found) < 2; i-- {
+		e := entries[i]
+
+		if e.Name != name || e.Failed || e.Interrupted {
+			continue
+		}
+		if len(found) == 1 && e.ScenarioHash != found[0].ScenarioHash {
+			continue
+		}
+
+		found = append(found, e)
+	}
+
+	if len(found) < 2 {
+		return Entry{}, Entry{}, fmt.Errorf("fewer than two comparable runs of %q in %v", name, dir)
+	}
+
+	return found[1], found[0], nil
+}
+
+func runPath(dir, id string) string {
+	return filepath.Join(dir, "runs", id+".json")
+}
@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// faultInterval is how often each connection rolls the dice for being
+// dropped or reset.
+const faultInterval = 100 * time.Millisecond
+
+// Config describes the faults the proxy injects. Rates are per connection per
+// second, so a DropRate of 0.01 drops each connection after 100 seconds on
+// average.
+type Config struct {
+	Listen string
+	Target string
+
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Bandwidth caps each direction of each connection, in bytes per second.
+	// 0 means unlimited.
+	Bandwidth int64
+
+	DropRate  float64
+	ResetRate float64
+
+	// traffic stalls, without closing connections, for BlackholeFor
+	// starting BlackholeAfter after the proxy starts, as if the network had
+	// gone silent. New connections aren't made until it ends, and what was
+	// sent in the meantime is delivered then, so no stream is corrupted.
+	BlackholeAfter time.Duration
+	BlackholeFor   time.Duration
+}
+
+// Proxy forwards TCP connections to a target, injecting latency, bandwidth
+// limits, dropped and reset connections and blackholes along the way.
+type Proxy struct {
+	cfg    Config
+	logger *slog.Logger
+	start  time.Time
+
+	connections atomic.Int64
+	drops       atomic.Int64
+	resets      atomic.Int64
+	bytes       atomic.Int64
+	held        atomic.Int64
+}
+
+func New(cfg Config, logger *slog.Logger) *Proxy {
+	return &Proxy{cfg: cfg, logger: logger}
+}
+
+// Run listens on Listen and accepts connections until ctx is done.
+func (p *Proxy) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", p.cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	return p.Serve(ctx, listener)
+}
+
+// Serve accepts connections on listener until ctx is done, and closes it.
+func (p *Proxy) Serve(ctx context.Context, listener net.Listener) error {
+	p.start = time.Now()
+
+	p.logger.Info(fmt.Sprintf("proxying %v to %v", listener.Addr(), p.cfg.Target))
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		p.connections.Add(1)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.handle(ctx, conn)
+		}()
+	}
+}
+
+func (p *Proxy) handle(ctx context.Context, client net.Conn) {
+	// the connection to the target is only made once the blackhole ends
+	sleepUntil(ctx, p.blackholeEnd(time.Now()))
+
+	dialer := net.Dialer{}
+
+	target, err := dialer.DialContext(ctx, "tcp", p.cfg.Target)
+	if err != nil {
+		p.logger.Warn(fmt.Errorf("error connecting to target -> %w", err).Error())
+		client.Close()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	closeBoth := func(reset bool) {
+		once.Do(func() {
+			if reset {
+				// closing with a zero linger sends a RST instead of a FIN
+				for _, c := range []net.Conn{client, target} {
+					if tcp, ok := c.(*net.TCPConn); ok {
+						tcp.SetLinger(0)
+					}
+				}
+			}
+			client.Close()
+			target.Close()
+			cancel()
+		})
+	}
+
+	go p.injectFaults(ctx, closeBoth)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		p.pipe(ctx, target, client)
+		closeBoth(false)
+	}()
+
+	go func() {
+		defer wg.Done()
+		p.pipe(ctx, client, target)
+		closeBoth(false)
+	}()
+
+	wg.Wait()
+}
+
+func (p *Proxy) injectFaults(ctx context.Context, closeBoth func(reset bool)) {
+	if p.cfg.DropRate <= 0 && p.cfg.ResetRate <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(faultInterval)
+	defer ticker.Stop()
+
+	dropChance := p.cfg.DropRate * faultInterval.Seconds()
+	resetChance := p.cfg.ResetRate * faultInterval.Seconds()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n := rand.Float64()
+
+		switch {
+		case n < resetChance:
+			p.resets.Add(1)
+			closeBoth(true)
+			return
+		case n < resetChance+dropChance:
+			p.drops.Add(1)
+			closeBoth(false)
+			return
+		}
+	}
+}
+
+// blackholeEnd is when the blackhole t falls in ends, or t if it doesn't
+// fall in it.
+func (p *Proxy) blackholeEnd(t time.Time) time.Time {
+	if p.cfg.BlackholeFor <= 0 {
+		return t
+	}
+
+	start := p.start.Add(p.cfg.BlackholeAfter)
+	end := start.Add(p.cfg.BlackholeFor)
+
+	if t.Before(start) || !t.Before(end) {
+		return t
+	}
+
+	return end
+}
+
+type chunk struct {
+	data []byte
+	due  time.Time
+}
+
+// pipe copies from src to dst. Chunks are read as they arrive and written
+// once their latency has passed, and any blackhole has ended. Only a couple
+// are read ahead of the writer, so a slow destination, or a blackhole, pushes
+// back on the source, as it would without the proxy, instead of the proxy
+// buffering the difference.
+func (p *Proxy) pipe(ctx context.Context, dst, src net.Conn) {
+	chunks := make(chan chunk, 2)
+
+	go func() {
+		defer close(chunks)
+
+		var lastDue time.Time
+
+		for {
+			buf := make([]byte, 32*1024)
+
+			n, err := src.Read(buf)
+			if n > 0 {
+				due := time.Now().Add(p.cfg.Latency)
+				if p.cfg.Jitter > 0 {
+					due = due.Add(time.Duration(rand.Int63n(int64(p.cfg.Jitter))))
+				}
+
+				// jitter must not reorder the stream
+				if due.Before(lastDue) {
+					due = lastDue
+				}
+				lastDue = due
+
+				select {
+				case chunks <- chunk{data: buf[:n], due: due}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					p.logger.Debug(fmt.Errorf("error reading from connection -> %w", err).Error())
+				}
+				return
+			}
+		}
+	}()
+
+	// next is when the bandwidth limit allows the next write
+	var next time.Time
+
+	for c := range chunks {
+		sleepUntil(ctx, c.due)
+
+		if end := p.blackholeEnd(time.Now()); end.After(time.Now()) {
+			p.held.Add(int64(len(c.data)))
+			sleepUntil(ctx, end)
+		}
+
+		if p.cfg.Bandwidth > 0 {
+			next = maxTime(next, time.Now())
+			sleepUntil(ctx, next)
+			next = next.Add(time.Duration(float64(len(c.data)) / float64(p.cfg.Bandwidth) * float64(time.Second)))
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		_, err := dst.Write(c.data)
+		if err != nil {
+			return
+		}
+
+		p.bytes.Add(int64(len(c.data)))
+	}
+}
+
+// Stats is what the proxy has done so far.
+type Stats struct {
+	Connections int64
+	Drops       int64
+	Resets      int64
+	Bytes       int64
+	// BlackholedBytes were held back until a blackhole ended
+	BlackholedBytes int64
+}
+
+func (p *Proxy) Stats() Stats {
+	return Stats{
+		Connections:     p.connections.Load(),
+		Drops:           p.drops.Load(),
+		Resets:          p.resets.Load(),
+		Bytes:           p.bytes.Load(),
+		BlackholedBytes: p.held.Load(),
+	}
+}
+
+func sleepUntil(ctx context.Context, t time.Time) {
+	d := time.Until(t)
+	if d <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startEcho starts a server on loopback that echoes back whatever it reads.
+func startEcho(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// startProxy starts a proxy to target with cfg and connects to it.
+func startProxy(t *testing.T, cfg Config) (*Proxy, net.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := New(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Serve(ctx, listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		cancel()
+		<-done
+	})
+
+	return p, conn
+}
+
+// echo writes payload and reads it back, returning how long that took.
+func echo(t *testing.T, conn net.Conn, payload []byte) time.Duration {
+	t.Helper()
+
+	start := time.Now()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		errs <- err
+	}()
+
+	got := make([]byte, len(payload))
+
+	_, err := io.ReadFull(conn, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, payload) {
+		t.Fatal("echoed data doesn't match what was sent")
+	}
+
+	return time.Since(start)
+}
+
+func TestLatency(t *testing.T) {
+	latency := 50 * time.Millisecond
+
+	_, conn := startProxy(t, Config{Target: startEcho(t), Latency: latency})
+
+	// the latency is added in each direction
+	for range 3 {
+		d := echo(t, conn, []byte("ping"))
+		if d < 2*latency {
+			t.Fatalf("round trip took %v, want at least %v", d, 2*latency)
+		}
+		if d > 10*latency {
+			t.Fatalf("round trip took %v, want about %v", d, 2*latency)
+		}
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	bandwidth := int64(256 * 1024)
+
+	p, conn := startProxy(t, Config{Target: startEcho(t), Bandwidth: bandwidth})
+
+	payload := bytes.Repeat([]byte("reserva"), 128*1024/7)
+
+	d := echo(t, conn, payload)
+
+	// the first chunk goes straight away, so allow for one being free
+	want := time.Duration(float64(len(payload)-32*1024) / float64(bandwidth) * float64(time.Second))
+	if d < want {
+		t.Fatalf("echoing %v bytes took %v, want at least %v", len(payload), d, want)
+	}
+
+	// the proxy counts a chunk once it has been written, which may be just
+	// after it has been read
+	deadline := time.Now().Add(time.Second)
+	for p.Stats().Bytes < 2*int64(len(payload)) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if got := p.Stats().Bytes; got != 2*int64(len(payload)) {
+		t.Fatalf("proxied %v bytes, want %v", got, 2*len(payload))
+	}
+}
+
+func TestReset(t *testing.T) {
+	// certain to reset at the first fault check
+	p, conn := startProxy(t, Config{Target: startEcho(t), ResetRate: 1 / faultInterval.Seconds()})
+
+	echo(t, conn, []byte("ping"))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, err := conn.Read(make([]byte, 1))
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("read returned %v, want a connection reset", err)
+	}
+
+	if got := p.Stats().Resets; got != 1 {
+		t.Fatalf("counted %v resets, want 1", got)
+	}
+}
+
+func TestBlackhole(t *testing.T) {
+	after, length := 100*time.Millisecond, 300*time.Millisecond
+
+	p, conn := startProxy(t, Config{Target: startEcho(t), BlackholeAfter: after, BlackholeFor: length})
+
+	echo(t, conn, []byte("ping"))
+
+	time.Sleep(after + 50*time.Millisecond)
+
+	// the payload is sent during the blackhole, and has to come back intact
+	// once it ends, rather than be lost or corrupt the stream
+	payload := bytes.Repeat([]byte("reserva"), 64*1024/7)
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	d := echo(t, conn, payload)
+	if want := length - 100*time.Millisecond; d < want {
+		t.Fatalf("echo across the blackhole took %v, want at least %v", d, want)
+	}
+
+	if got := p.Stats().BlackholedBytes; got == 0 {
+		t.Fatal("counted no bytes held back by the blackhole")
+	}
+
+	// and the connection still works afterwards
+	echo(t, conn, []byte("pong"))
+}
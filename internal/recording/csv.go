@@ -0,0 +1,138 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Transaction is one row of a CSV file of real transactions. Accounts are
+// opaque, usually anonymised, identifiers, which are mapped onto the target's
+// users when the transactions are replayed.
+type Transaction struct {
+	// At is when the transaction happened, from the first transaction
+	At          time.Duration
+	FromAccount string
+	ToAccount   string
+	Amount      int64
+}
+
+// csvColumns are the columns a transactions file must have, in any order.
+// Other columns are ignored.
+var csvColumns = []string{"timestamp", "from_account", "to_account", "amount"}
+
+// CSVReader reads the transactions of a CSV file one at a time.
+type CSVReader struct {
+	f       *os.File
+	r       *csv.Reader
+	columns map[string]int
+	first   time.Time
+	line    int
+}
+
+// OpenCSV opens a CSV file of transactions, whose header names the
+// timestamp, from_account, to_account and amount columns. Timestamps are
+// RFC 3339 or Unix seconds, and amounts are whole numbers in the units of
+// the accounts' balances.
+func OpenCSV(path string) (*CSVReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := csv.NewReader(bufio.NewReader(f))
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err != nil {
+		f.Close()
+		if err == io.EOF {
+			return nil, errors.New("the file is empty")
+		}
+		return nil, fmt.Errorf("error reading header -> %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	for _, name := range csvColumns {
+		if _, ok := columns[name]; !ok {
+			f.Close()
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+
+	return &CSVReader{f: f, r: r, columns: columns, line: 1}, nil
+}
+
+// Next returns the next transaction, or io.EOF once there are none left.
+func (r *CSVReader) Next() (Transaction, error) {
+	var t Transaction
+
+	record, err := r.r.Read()
+	if err == io.EOF {
+		return t, err
+	}
+
+	r.line++
+
+	if err != nil {
+		return t, fmt.Errorf("line %d -> %w", r.line, err)
+	}
+
+	field := func(name string) string {
+		return strings.TrimSpace(record[r.columns[name]])
+	}
+
+	at, err := parseTimestamp(field("timestamp"))
+	if err != nil {
+		return t, fmt.Errorf("line %d has an invalid timestamp -> %w", r.line, err)
+	}
+
+	if r.first.IsZero() {
+		r.first = at
+	}
+
+	t.At = at.Sub(r.first)
+	t.FromAccount = field("from_account")
+	t.ToAccount = field("to_account")
+
+	t.Amount, err = strconv.ParseInt(field("amount"), 10, 64)
+	if err != nil {
+		return t, fmt.Errorf("line %d has an invalid amount -> %w", r.line, err)
+	}
+
+	if t.FromAccount == "" || t.ToAccount == "" {
+		return t, fmt.Errorf("line %d is missing an account", r.line)
+	}
+
+	return t, nil
+}
+
+func (r *CSVReader) Close() error {
+	return r.f.Close()
+}
+
+func parseTimestamp(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither RFC 3339 nor Unix seconds", s)
+	}
+
+	whole, frac := math.Modf(seconds)
+
+	return time.Unix(int64(whole), int64(frac*1e9)), nil
+}
@@ -0,0 +1,128 @@
+// Package recording reads and writes recordings of the operations a run
+// issued, so the same sequence can be replayed against another target, and
+// reads CSV files of real transactions to replay in their place.
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// TypeTransfer is the type of an operation that transfers funds from the
+// issuing user's account to the acquiring user's.
+const TypeTransfer = "transfer"
+
+// Op is one recorded operation, written as a line of JSON.
+type Op struct {
+	// At is when the operation was meant to start, from the start of the run
+	At                 time.Duration `json:"at_ns"`
+	Type               string        `json:"type"`
+	Amount             int64         `json:"amount"`
+	AcquiringUserID    int64         `json:"acquiring_user_id"`
+	AcquiringAccountID int64         `json:"acquiring_account_id"`
+	IssuingUserID      int64         `json:"issuing_user_id"`
+	IssuingAccountID   int64         `json:"issuing_account_id"`
+	IssuingCardID      int64         `json:"issuing_card_id"`
+}
+
+// Writer writes operations to a recording. It is not safe for concurrent use.
+type Writer struct {
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+	n   int64
+	err error
+}
+
+// Create creates a recording at path.
+func Create(path string) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+
+	return &Writer{f: f, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+// Write writes an operation. Once a write fails, later writes do nothing, and
+// Close returns the error.
+func (w *Writer) Write(op Op) {
+	if w.err != nil {
+		return
+	}
+
+	w.err = w.enc.Encode(op)
+	if w.err == nil {
+		w.n++
+	}
+}
+
+// Len returns how many operations have been written.
+func (w *Writer) Len() int64 {
+	return w.n
+}
+
+// Close flushes and closes the recording, and returns the first error
+// writing it ran into.
+func (w *Writer) Close() error {
+	err := w.w.Flush()
+	if w.err != nil {
+		err = w.err
+	}
+	if err != nil {
+		w.f.Close()
+		return err
+	}
+
+	return w.f.Close()
+}
+
+// Reader reads the operations of a recording one at a time, so recordings
+// of long runs needn't fit in memory.
+type Reader struct {
+	f   *os.File
+	dec *json.Decoder
+	n   int64
+}
+
+// Open opens the recording at path.
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{f: f, dec: json.NewDecoder(bufio.NewReader(f))}, nil
+}
+
+// Next returns the next operation, or io.EOF once there are none left.
+func (r *Reader) Next() (Op, error) {
+	var op Op
+
+	err := r.dec.Decode(&op)
+	if err == io.EOF {
+		return op, err
+	}
+
+	r.n++
+
+	if err != nil {
+		return op, fmt.Errorf("operation %d -> %w", r.n, err)
+	}
+
+	if op.Type != TypeTransfer {
+		return op, fmt.Errorf("operation %d has unsupported type %q", r.n, op.Type)
+	}
+
+	return op, nil
+}
+
+func (r *Reader) Close() error {
+	return r.f.Close()
+}
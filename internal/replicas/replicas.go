@@ -0,0 +1,340 @@
+package replicas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/data"
+	"github.com/calmitchell617/reserva/internal/stats"
+)
+
+const (
+	RoundRobin      = "round-robin"
+	LeastInFlight   = "least-in-flight"
+	LatencyWeighted = "latency-weighted"
+)
+
+// Replica is one read replica in a Set.
+type Replica struct {
+	Name string
+	Pool *sql.DB
+
+	set     *Set
+	db      data.DB
+	healthy atomic.Bool
+
+	inFlight atomic.Int64
+	ewmaUs   atomic.Int64
+
+	queries atomic.Int64
+	errors  atomic.Int64
+	latency stats.Histogram
+
+	lag atomic.Pointer[stats.LagRecorder]
+	ryw stats.ReadYourWritesRecorder
+}
+
+// Set spreads reads over several read replicas according to a routing
+// policy. Replicas that fail their health check are taken out of rotation
+// until they pass it again. Set implements data.DB.
+type Set struct {
+	replicas []*Replica
+	policy   string
+	logger   *slog.Logger
+	next     atomic.Uint64
+	window   atomic.Pointer[stats.Window]
+}
+
+func New(policy string, logger *slog.Logger) (*Set, error) {
+	switch policy {
+	case RoundRobin, LeastInFlight, LatencyWeighted:
+	default:
+		return nil, fmt.Errorf("unsupported replica policy %q", policy)
+	}
+
+	return &Set{policy: policy, logger: logger}, nil
+}
+
+// Add adds a replica. Queries routed to it are run through db, which is
+// usually pool itself, or pool with prepared statements.
+func (s *Set) Add(name string, pool *sql.DB, db data.DB) *Replica {
+	r := &Replica{Name: name, Pool: pool, set: s, db: db}
+	r.healthy.Store(true)
+
+	s.replicas = append(s.replicas, r)
+
+	return r
+}
+
+func (s *Set) Replicas() []*Replica {
+	return s.replicas
+}
+
+// Start starts recording per-replica statistics for the measurement window.
+func (s *Set) Start(window stats.Window) {
+	for _, r := range s.replicas {
+		r.lag.Store(stats.NewLagRecorder(window))
+	}
+
+	s.window.Store(&window)
+}
+
+// RecordLag records a measurement of how far this replica is behind the
+// primary.
+func (r *Replica) RecordLag(sample stats.LagSample) {
+	if lag := r.lag.Load(); lag != nil {
+		lag.Record(sample)
+	}
+}
+
+// ReadYourWrites records a check of whether a write could be read back from
+// this replica straight after it was committed.
+func (r *Replica) ReadYourWrites(stale, timedOut bool, delay time.Duration) {
+	window := r.set.window.Load()
+	if window == nil || window.Phase(time.Now()) != stats.PhaseMeasure {
+		return
+	}
+
+	r.ryw.Record(stale, timedOut, delay)
+}
+
+// Pick chooses the replica to send the next read to.
+func (s *Set) Pick() *Replica {
+	candidates := make([]*Replica, 0, len(s.replicas))
+	for _, r := range s.replicas {
+		if r.healthy.Load() {
+			candidates = append(candidates, r)
+		}
+	}
+
+	// with every replica out of rotation, keep sending reads to all of them
+	// so the errors show up in the results
+	if len(candidates) == 0 {
+		candidates = s.replicas
+	}
+
+	offset := int(s.next.Add(1) % uint64(len(candidates)))
+
+	switch s.policy {
+	case LeastInFlight:
+		// start at a rotating offset so ties don't all go to the first replica
+		best := candidates[offset]
+		for i := range candidates {
+			r := candidates[(offset+i)%len(candidates)]
+			if r.inFlight.Load() < best.inFlight.Load() {
+				best = r
+			}
+		}
+		return best
+
+	case LatencyWeighted:
+		// pick replicas with a probability inversely proportional to their
+		// recent latency
+		weights := make([]float64, len(candidates))
+		var total float64
+		for i, r := range candidates {
+			weights[i] = 1 / float64(max(r.ewmaUs.Load(), 1))
+			total += weights[i]
+		}
+
+		n := rand.Float64() * total
+		for i, w := range weights {
+			n -= w
+			if n <= 0 {
+				return candidates[i]
+			}
+		}
+		return candidates[len(candidates)-1]
+	}
+
+	return candidates[offset]
+}
+
+// CheckHealth pings every replica each interval until ctx is done, taking
+// replicas that fail out of rotation and putting them back once they recover.
+func (s *Set) CheckHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, r := range s.replicas {
+			pingCtx, cancel := context.WithTimeout(ctx, interval)
+			err := r.Pool.PingContext(pingCtx)
+			cancel()
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			healthy := err == nil
+			if r.healthy.Swap(healthy) != healthy {
+				if healthy {
+					s.logger.Info(fmt.Sprintf("%v is healthy again, back in rotation", r.Name))
+				} else {
+					s.logger.Warn(fmt.Sprintf("%v failed its health check, out of rotation -> %v", r.Name, err))
+				}
+			}
+		}
+	}
+}
+
+func (s *Set) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return s.Pick().Track(nil).QueryContext(ctx, query, args...)
+}
+
+func (s *Set) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return s.Pick().Track(nil).QueryRowContext(ctx, query, args...)
+}
+
+func (s *Set) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return s.Pick().Track(nil).ExecContext(ctx, query, args...)
+}
+
+func (s *Set) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return s.Pick().Track(nil).BeginTx(ctx, opts)
+}
+
+// Track returns a DB that runs queries through db and counts them towards
+// this replica's statistics. If db is nil, the replica's own DB is used.
+func (r *Replica) Track(db data.DB) data.DB {
+	if db == nil {
+		db = r.db
+	}
+	return &tracked{replica: r, db: db}
+}
+
+func (r *Replica) begin() time.Time {
+	r.inFlight.Add(1)
+	return time.Now()
+}
+
+func (r *Replica) end(start time.Time, err error) {
+	r.inFlight.Add(-1)
+
+	d := time.Since(start)
+
+	// exponentially weighted moving average for latency-weighted routing
+	for {
+		old := r.ewmaUs.Load()
+		ewma := d.Microseconds()
+		if old != 0 {
+			ewma = old + (ewma-old)/10
+		}
+		if r.ewmaUs.CompareAndSwap(old, ewma) {
+			break
+		}
+	}
+
+	window := r.set.window.Load()
+	if window == nil || window.Phase(time.Now()) != stats.PhaseMeasure {
+		return
+	}
+
+	r.queries.Add(1)
+	if err != nil {
+		r.errors.Add(1)
+		return
+	}
+	r.latency.Record(d)
+}
+
+type tracked struct {
+	replica *Replica
+	db      data.DB
+}
+
+// QueryContext counts the query as running on the replica until ctx is done,
+// rather than until it returns, as its rows are only read after that. The
+// models cancel the context of every query once they have closed its rows,
+// and database/sql closes the rows of a query whose context is done, so that
+// is when the replica has finished with it.
+func (t *tracked) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	start := t.replica.begin()
+
+	rows, err := t.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		t.replica.end(start, err)
+		return nil, err
+	}
+
+	context.AfterFunc(ctx, func() {
+		t.replica.end(start, nil)
+	})
+
+	return rows, nil
+}
+
+// QueryRowContext is timed like QueryContext, as the row is only read when
+// it is scanned.
+func (t *tracked) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	start := t.replica.begin()
+
+	row := t.db.QueryRowContext(ctx, query, args...)
+	if err := row.Err(); err != nil {
+		t.replica.end(start, err)
+		return row
+	}
+
+	context.AfterFunc(ctx, func() {
+		t.replica.end(start, nil)
+	})
+
+	return row
+}
+
+func (t *tracked) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	start := t.replica.begin()
+	result, err := t.db.ExecContext(ctx, query, args...)
+	t.replica.end(start, err)
+	return result, err
+}
+
+func (t *tracked) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return t.db.BeginTx(ctx, opts)
+}
+
+// Summary is the per-replica part of the results.
+type Summary struct {
+	Name    string              `json:"name"`
+	Queries int64               `json:"queries"`
+	Errors  int64               `json:"errors"`
+	Healthy bool                `json:"healthy"`
+	Latency *stats.Distribution `json:"latency"`
+
+	Lag            *stats.LagSummary            `json:"lag,omitempty"`
+	ReadYourWrites *stats.ReadYourWritesSummary `json:"read_your_writes,omitempty"`
+}
+
+func (s *Set) Summary() []Summary {
+	summaries := make([]Summary, 0, len(s.replicas))
+
+	for _, r := range s.replicas {
+		summary := Summary{
+			Name:           r.Name,
+			Queries:        r.queries.Load(),
+			Errors:         r.errors.Load(),
+			Healthy:        r.healthy.Load(),
+			Latency:        r.latency.Distribution(),
+			ReadYourWrites: r.ryw.Summary(),
+		}
+
+		if lag := r.lag.Load(); lag != nil && lag.Len() > 0 {
+			summary.Lag = lag.Summary()
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	return summaries
+}
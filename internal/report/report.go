@@ -0,0 +1,250 @@
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/results"
+	"github.com/calmitchell617/reserva/internal/stats"
+)
+
+// binsPerDoubling is how finely latency histograms are drawn.
+const binsPerDoubling = 4
+
+type row struct {
+	Name          string
+	Color         string
+	Engine        string
+	EngineVersion string
+	StartedAt     string
+	Duration      time.Duration
+	Concurrency   int
+	Rate          string
+	P50           time.Duration
+	P99           time.Duration
+	ErrorRate     string
+	Error         string
+}
+
+type section struct {
+	Title  string
+	Charts []template.HTML
+}
+
+type page struct {
+	Title     string
+	Generated string
+	Rows      []row
+	Sections  []section
+}
+
+// HTML writes a self-contained HTML report of one or more results, with the
+// results of several targets overlaid on the same charts.
+func HTML(w io.Writer, rs []*results.Result) error {
+	p := page{
+		Title:     "Reserva report",
+		Generated: time.Now().Format(time.RFC1123),
+	}
+
+	for i, r := range rs {
+		total := r.Summary.Latencies["total"]
+
+		p.Rows = append(p.Rows, row{
+			Name:          r.Name,
+			Color:         color(i),
+			Engine:        r.Engine,
+			EngineVersion: r.EngineVersion,
+			StartedAt:     r.StartedAt.Format(time.RFC3339),
+			Duration:      r.Summary.Elapsed.Round(time.Second),
+			Concurrency:   r.Concurrency,
+			Rate:          fmt.Sprintf("%.0f/s", r.Summary.Rate),
+			P50:           total.Quantile(0.5),
+			P99:           total.Quantile(0.99),
+			ErrorRate:     percent(errorRate(r.Summary.Transfers, r.Summary.Failures)),
+			Error:         r.Error,
+		})
+	}
+
+	p.Sections = append(p.Sections, section{
+		Title:  "Throughput and errors",
+		Charts: []template.HTML{throughputChart(rs).svg(), errorRateChart(rs).svg()},
+	})
+
+	for _, step := range steps(rs) {
+		p.Sections = append(p.Sections, section{
+			Title:  step,
+			Charts: []template.HTML{latencyChart(rs, step).svg(), histogramChart(rs, step).svg()},
+		})
+	}
+
+	return tmpl.Execute(w, p)
+}
+
+func throughputChart(rs []*results.Result) chart {
+	c := chart{
+		title:   "Throughput",
+		xLabel:  "seconds into the measurement",
+		xFormat: seconds,
+		yFormat: func(v float64) string { return fmt.Sprintf("%.0f/s", v) },
+	}
+
+	for i, r := range rs {
+		s := series{name: r.Name, color: color(i)}
+		for j, n := range r.Summary.Throughput {
+			s.points = append(s.points, point{float64(j + 1), float64(n)})
+		}
+		c.series = append(c.series, s)
+	}
+
+	return c
+}
+
+func errorRateChart(rs []*results.Result) chart {
+	c := chart{
+		title:   "Error rate",
+		xLabel:  "seconds into the measurement",
+		xFormat: seconds,
+		yFormat: percent,
+	}
+
+	for i, r := range rs {
+		s := series{name: r.Name, color: color(i)}
+		for _, in := range r.Summary.Intervals {
+			s.points = append(s.points, point{elapsed(r, in), errorRate(in.Transfers, in.Failures)})
+		}
+		c.series = append(c.series, s)
+	}
+
+	return c
+}
+
+func latencyChart(rs []*results.Result, step string) chart {
+	c := chart{
+		title:   fmt.Sprintf("%v latency over time (p50 solid, p99 dashed)", step),
+		xLabel:  "seconds into the measurement",
+		xFormat: seconds,
+		yFormat: duration,
+	}
+
+	for i, r := range rs {
+		p50 := series{name: r.Name + " p50", color: color(i)}
+		p99 := series{name: r.Name + " p99", color: color(i), dashed: true}
+
+		for _, in := range r.Summary.Intervals {
+			l, ok := in.Latencies[step]
+			if !ok {
+				continue
+			}
+
+			x := elapsed(r, in)
+			p50.points = append(p50.points, point{x, float64(l.P50)})
+			p99.points = append(p99.points, point{x, float64(l.P99)})
+		}
+
+		c.series = append(c.series, p50, p99)
+	}
+
+	return c
+}
+
+// histogramChart draws the share of each step's latencies that fell in each
+// bin, on a log scale so that the tail is visible.
+func histogramChart(rs []*results.Result, step string) chart {
+	c := chart{
+		title:   fmt.Sprintf("%v latency distribution", step),
+		xLabel:  "latency",
+		logX:    true,
+		xFormat: func(v float64) string { return duration(v * float64(time.Microsecond)) },
+		yFormat: percent,
+	}
+
+	for i, r := range rs {
+		s := series{name: r.Name, color: color(i)}
+
+		d := r.Summary.Latencies[step]
+		if d == nil || d.Count == 0 {
+			c.series = append(c.series, s)
+			continue
+		}
+
+		bins := make(map[int]int64)
+		for j, n := range d.Counts {
+			if n == 0 {
+				continue
+			}
+			us := float64(stats.BucketValue(j))
+			bins[int(math.Floor(math.Log2(us+1)*binsPerDoubling))] += n
+		}
+
+		keys := make([]int, 0, len(bins))
+		for k := range bins {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		for _, k := range keys {
+			us := math.Pow(2, float64(k)/binsPerDoubling)
+			s.points = append(s.points, point{us, float64(bins[k]) / float64(d.Count)})
+		}
+
+		c.series = append(c.series, s)
+	}
+
+	return c
+}
+
+// steps returns every step with latencies in any of the results, total first.
+func steps(rs []*results.Result) []string {
+	var steps []string
+
+	for _, r := range rs {
+		for step := range r.Summary.Latencies {
+			if step != "total" && !slices.Contains(steps, step) {
+				steps = append(steps, step)
+			}
+		}
+	}
+
+	slices.Sort(steps)
+
+	return append([]string{"total"}, steps...)
+}
+
+func elapsed(r *results.Result, in stats.Interval) float64 {
+	if len(r.Summary.Intervals) == 0 {
+		return 0
+	}
+	start := r.Summary.Intervals[0].At.Add(-r.Summary.Intervals[0].Length)
+	return in.At.Sub(start).Seconds()
+}
+
+func errorRate(transfers int64, failures map[string]int64) float64 {
+	var n int64
+	for _, c := range failures {
+		n += c
+	}
+	if n == 0 {
+		return 0
+	}
+	return float64(n) / float64(transfers+n)
+}
+
+func color(i int) string {
+	return palette[i%len(palette)]
+}
+
+func seconds(v float64) string {
+	return fmt.Sprintf("%.0fs", v)
+}
+
+func percent(v float64) string {
+	return fmt.Sprintf("%.2f%%", v*100)
+}
+
+func duration(v float64) string {
+	return time.Duration(v).Round(time.Microsecond).String()
+}
@@ -0,0 +1,184 @@
+package report
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"math"
+	"strings"
+)
+
+const (
+	chartWidth   = 860
+	chartHeight  = 280
+	marginLeft   = 80
+	marginRight  = 20
+	marginTop    = 30
+	marginBottom = 40
+)
+
+// palette gives each target its own colour, in the order they are reported.
+var palette = []string{"#1f77b4", "#d62728", "#2ca02c", "#ff7f0e", "#9467bd", "#8c564b", "#e377c2", "#17becf"}
+
+type point struct {
+	x, y float64
+}
+
+type series struct {
+	name   string
+	color  string
+	dashed bool
+	points []point
+}
+
+// chart is a line chart. With logX, the x axis is logarithmic, and x values
+// must be positive.
+type chart struct {
+	title   string
+	xLabel  string
+	logX    bool
+	xFormat func(float64) string
+	yFormat func(float64) string
+	series  []series
+}
+
+// svg renders the chart as an inline SVG element.
+func (c chart) svg() template.HTML {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `<svg viewBox="0 0 %d %d" width="%d" height="%d" xmlns="http://www.w3.org/2000/svg" font-family="sans-serif" font-size="11">`, chartWidth, chartHeight, chartWidth, chartHeight)
+	fmt.Fprintf(&b, `<text x="%d" y="18" font-size="14" font-weight="bold">%v</text>`, marginLeft, html.EscapeString(c.title))
+
+	xMin, xMax := math.Inf(1), math.Inf(-1)
+	yMax := 0.0
+
+	for _, s := range c.series {
+		for _, p := range s.points {
+			x := c.x(p.x)
+			xMin, xMax = math.Min(xMin, x), math.Max(xMax, x)
+			yMax = math.Max(yMax, p.y)
+		}
+	}
+
+	if math.IsInf(xMin, 0) {
+		b.WriteString(`<text x="50%" y="50%" text-anchor="middle">no data</text></svg>`)
+		return template.HTML(b.String())
+	}
+
+	if xMax == xMin {
+		xMax = xMin + 1
+	}
+	if yMax == 0 {
+		yMax = 1
+	}
+	yMax = niceCeil(yMax)
+
+	plotWidth := float64(chartWidth - marginLeft - marginRight)
+	plotHeight := float64(chartHeight - marginTop - marginBottom)
+
+	px := func(x float64) float64 {
+		return marginLeft + (c.x(x)-xMin)/(xMax-xMin)*plotWidth
+	}
+	py := func(y float64) float64 {
+		return marginTop + plotHeight - y/yMax*plotHeight
+	}
+
+	// y grid and labels
+	for i := 0; i <= 4; i++ {
+		y := yMax * float64(i) / 4
+		fmt.Fprintf(&b, `<line x1="%d" x2="%d" y1="%.1f" y2="%.1f" stroke="#ddd"/>`, marginLeft, chartWidth-marginRight, py(y), py(y))
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end" dominant-baseline="middle">%v</text>`, marginLeft-6, py(y), html.EscapeString(c.yFormat(y)))
+	}
+
+	// x ticks
+	for _, x := range c.xTicks(xMin, xMax) {
+		fmt.Fprintf(&b, `<line x1="%.1f" x2="%.1f" y1="%d" y2="%d" stroke="#999"/>`, px(x), px(x), chartHeight-marginBottom, chartHeight-marginBottom+4)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">%v</text>`, px(x), chartHeight-marginBottom+16, html.EscapeString(c.xFormat(x)))
+	}
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="middle">%v</text>`, marginLeft+int(plotWidth/2), chartHeight-6, html.EscapeString(c.xLabel))
+	fmt.Fprintf(&b, `<line x1="%d" x2="%d" y1="%d" y2="%d" stroke="#333"/>`, marginLeft, chartWidth-marginRight, chartHeight-marginBottom, chartHeight-marginBottom)
+
+	for _, s := range c.series {
+		if len(s.points) == 0 {
+			continue
+		}
+
+		var path strings.Builder
+		for i, p := range s.points {
+			cmd := "L"
+			if i == 0 {
+				cmd = "M"
+			}
+			fmt.Fprintf(&path, "%v%.1f,%.1f ", cmd, px(p.x), py(p.y))
+		}
+
+		dash := ""
+		if s.dashed {
+			dash = ` stroke-dasharray="5,3"`
+		}
+
+		fmt.Fprintf(&b, `<path d="%v" fill="none" stroke="%v" stroke-width="1.5"%v><title>%v</title></path>`, strings.TrimSpace(path.String()), s.color, dash, html.EscapeString(s.name))
+	}
+
+	// legend
+	for i, s := range c.series {
+		x := marginLeft + 10 + (i%4)*190
+		y := marginTop + 10 + (i/4)*14
+
+		dash := ""
+		if s.dashed {
+			dash = ` stroke-dasharray="5,3"`
+		}
+
+		fmt.Fprintf(&b, `<line x1="%d" x2="%d" y1="%d" y2="%d" stroke="%v" stroke-width="2"%v/>`, x, x+20, y, y, s.color, dash)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" dominant-baseline="middle">%v</text>`, x+25, y, html.EscapeString(s.name))
+	}
+
+	b.WriteString(`</svg>`)
+
+	return template.HTML(b.String())
+}
+
+func (c chart) x(x float64) float64 {
+	if c.logX {
+		return math.Log10(x)
+	}
+	return x
+}
+
+// xTicks returns the tick positions, in data units. Log axes get a tick per
+// power of ten.
+func (c chart) xTicks(min, max float64) []float64 {
+	var ticks []float64
+
+	if c.logX {
+		for e := math.Ceil(min); e <= max; e++ {
+			ticks = append(ticks, math.Pow(10, e))
+		}
+		return ticks
+	}
+
+	step := niceCeil((max - min) / 6)
+	for x := math.Ceil(min/step) * step; x <= max; x += step {
+		ticks = append(ticks, x)
+	}
+
+	return ticks
+}
+
+// niceCeil rounds v up to 1, 2 or 5 times a power of ten.
+func niceCeil(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+
+	p := math.Pow(10, math.Floor(math.Log10(v)))
+
+	for _, m := range []float64{1, 2, 5, 10} {
+		if v <= m*p {
+			return m * p
+		}
+	}
+
+	return 10 * p
+}
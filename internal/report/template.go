@@ -0,0 +1,42 @@
+package report
+
+import "html/template"
+
+var tmpl = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 900px; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 4px 10px; border-bottom: 1px solid #ddd; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.swatch { display: inline-block; width: 10px; height: 10px; margin-right: 6px; }
+.error { color: #d62728; }
+svg { display: block; margin-bottom: 1.5em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated {{.Generated}}</p>
+<table>
+<tr><th>target</th><th>engine</th><th>started</th><th>measured</th><th>concurrency</th><th>throughput</th><th>p50</th><th>p99</th><th>error rate</th></tr>
+{{range .Rows}}<tr>
+<td><span class="swatch" style="background: {{.Color}}"></span>{{.Name}}</td>
+<td>{{.Engine}} {{.EngineVersion}}</td>
+<td>{{.StartedAt}}</td>
+<td>{{.Duration}}</td>
+<td>{{.Concurrency}}</td>
+<td>{{.Rate}}</td>
+<td>{{.P50}}</td>
+<td>{{.P99}}</td>
+<td>{{.ErrorRate}}</td>
+</tr>{{if .Error}}
+<tr><td colspan="9" class="error">{{.Name}}: {{.Error}}</td></tr>{{end}}
+{{end}}</table>
+{{range .Sections}}<h2>{{.Title}}</h2>
+{{range .Charts}}{{.}}
+{{end}}{{end}}</body>
+</html>
+`))
@@ -0,0 +1,135 @@
+package results
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/stats"
+)
+
+// Agent is one of the load generators of a distributed run.
+type Agent struct {
+	Name        string  `json:"name"`
+	Seed        int64   `json:"seed"`
+	Concurrency int     `json:"concurrency"`
+	Actions     int64   `json:"actions"`
+	Rate        float64 `json:"rate"`
+	ClientBound bool    `json:"client_bound"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// Merge combines the results of the agents of a distributed run into one, as
+// if a single load generator with all their concurrency had run. Settings are
+// taken from the first agent that started, along with what only it measures:
+// replica lag, failover, server stats and query plans.
+func Merge(name string, seed int64, agents []string, rs []*Result) *Result {
+	m := &Result{Name: name, Seed: seed}
+
+	var started []*Result
+	var summaries []stats.Summary
+	var errs, reasons []string
+
+	for i, r := range rs {
+		if r == nil {
+			errs = append(errs, fmt.Sprintf("%v: no result", agents[i]))
+			m.Agents = append(m.Agents, Agent{Name: agents[i], Error: "no result"})
+			continue
+		}
+
+		agent := Agent{
+			Name:        agents[i],
+			Seed:        r.Seed,
+			Concurrency: r.Concurrency,
+			Actions:     r.Summary.Actions,
+			Rate:        r.Summary.Rate,
+			Error:       r.Error,
+		}
+
+		if r.Client != nil && r.Client.ClientBound {
+			agent.ClientBound = true
+			for _, reason := range r.Client.Reasons {
+				reasons = append(reasons, fmt.Sprintf("%v: %v", agents[i], reason))
+			}
+		}
+
+		m.Agents = append(m.Agents, agent)
+
+		if r.Error != "" {
+			errs = append(errs, fmt.Sprintf("%v: %v", agents[i], r.Error))
+		}
+
+		// agents that failed to start have nothing to merge
+		if r.StartedAt.IsZero() {
+			continue
+		}
+
+		started = append(started, r)
+		summaries = append(summaries, r.Summary)
+	}
+
+	if len(started) == 0 {
+		m.Error = "no agent started"
+		if len(errs) > 0 {
+			m.Error = strings.Join(errs, "; ")
+		}
+		return m
+	}
+
+	base := *started[0]
+	agentList := m.Agents
+
+	*m = base
+	m.Name = name
+	m.Seed = seed
+	m.Agents = agentList
+	m.Summary = stats.MergeSummaries(summaries)
+	m.Concurrency = 0
+	m.Client = nil
+
+	if len(errs) > 0 {
+		m.Error = strings.Join(errs, "; ")
+	}
+
+	for _, r := range started {
+		m.Concurrency += r.Concurrency
+		m.StartedAt = earliest(m.StartedAt, r.StartedAt)
+		m.FinishedAt = latest(m.FinishedAt, r.FinishedAt)
+		m.Interrupted = m.Interrupted || r.Interrupted
+	}
+
+	if len(reasons) > 0 {
+		m.Client = &stats.ClientSummary{ClientBound: true, Reasons: reasons}
+	}
+
+	if m.Sharding != nil {
+		var shards []*stats.ShardSummary
+		for _, r := range started {
+			if r.Sharding != nil && r.Sharding.Summary != nil {
+				shards = append(shards, r.Sharding.Summary)
+			}
+		}
+
+		sharding := *m.Sharding
+		sharding.Summary = stats.MergeShardSummaries(shards)
+		m.Sharding = &sharding
+	}
+
+	m.ScenarioHash = m.Scenario()
+
+	return m
+}
+
+func earliest(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
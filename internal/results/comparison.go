@@ -0,0 +1,120 @@
+package results
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// metric is one row of the comparison table.
+type metric struct {
+	name           string
+	higherIsBetter bool
+	value          func(*Result) float64
+	format         func(float64) string
+}
+
+func latencyMetric(name, step string, q float64) metric {
+	return metric{
+		name: name,
+		value: func(r *Result) float64 {
+			return float64(r.Summary.Latencies[step].Quantile(q))
+		},
+		format: func(v float64) string {
+			return time.Duration(v).Round(time.Microsecond).String()
+		},
+	}
+}
+
+func sum(m map[string]int64) int64 {
+	var n int64
+	for _, c := range m {
+		n += c
+	}
+	return n
+}
+
+var metrics = []metric{
+	{
+		name:           "throughput (actions/s)",
+		higherIsBetter: true,
+		value:          func(r *Result) float64 { return r.Summary.Rate },
+		format:         func(v float64) string { return fmt.Sprintf("%.0f", v) },
+	},
+	latencyMetric("total p50", "total", 0.5),
+	latencyMetric("total p90", "total", 0.9),
+	latencyMetric("total p99", "total", 0.99),
+	latencyMetric("total p99.9", "total", 0.999),
+	latencyMetric("transfer_funds p99", "transfer_funds", 0.99),
+	{
+		name: "error rate",
+		value: func(r *Result) float64 {
+			failures := sum(r.Summary.Failures)
+			if failures == 0 {
+				return 0
+			}
+			return float64(failures) / float64(r.Summary.Transfers+failures)
+		},
+		format: func(v float64) string { return fmt.Sprintf("%.2f%%", v*100) },
+	},
+	{
+		name: "retries per transfer",
+		value: func(r *Result) float64 {
+			if r.Summary.Transfers == 0 {
+				return 0
+			}
+			return float64(sum(r.Summary.Retries)) / float64(r.Summary.Transfers)
+		},
+		format: func(v float64) string { return fmt.Sprintf("%.3f", v) },
+	},
+}
+
+// WriteComparison writes a table comparing the results of several targets
+// side by side, with the winner of each metric. Targets that failed are left
+// out of the running.
+func WriteComparison(w io.Writer, rs []*Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	fmt.Fprint(tw, "metric\t")
+	for _, r := range rs {
+		fmt.Fprintf(tw, "%v\t", r.Name)
+	}
+	fmt.Fprint(tw, "winner\t\n")
+
+	for _, m := range metrics {
+		fmt.Fprintf(tw, "%v\t", m.name)
+
+		var winner *Result
+		var best float64
+		tie := false
+
+		for _, r := range rs {
+			if r.Error != "" || r.Summary.Transfers == 0 {
+				fmt.Fprint(tw, "-\t")
+				continue
+			}
+
+			v := m.value(r)
+			fmt.Fprintf(tw, "%v\t", m.format(v))
+
+			switch {
+			case winner == nil, m.higherIsBetter && v > best, !m.higherIsBetter && v < best:
+				winner, best, tie = r, v, false
+			case v == best:
+				tie = true
+			}
+		}
+
+		switch {
+		case winner == nil || len(rs) < 2:
+			fmt.Fprint(tw, "-\t\n")
+		case tie:
+			fmt.Fprint(tw, "tie\t\n")
+		default:
+			fmt.Fprintf(tw, "%v\t\n", winner.Name)
+		}
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,191 @@
+package results
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/stats"
+)
+
+const (
+	Regression  = "regression"
+	Improvement = "improvement"
+)
+
+// Change is the difference in one metric between two runs.
+type Change struct {
+	Metric  string
+	A       float64
+	B       float64
+	Change  float64
+	P       float64
+	Verdict string
+
+	format func(float64) string
+}
+
+// Compare compares run b against run a. A metric has regressed or improved if
+// the difference is significant at alpha and at least threshold, relative to
+// a. Throughput is compared with Welch's t-test over the per-second counts,
+// each step's p50 with the Mann-Whitney U test over its whole distribution,
+// its p99 with a test of the tail beyond it, and error rates with a
+// two-proportion z-test.
+func Compare(a, b *Result, alpha, threshold float64) []Change {
+	var changes []Change
+
+	add := func(metric string, va, vb, p float64, higherIsBetter bool, format func(float64) string) {
+		c := Change{Metric: metric, A: va, B: vb, P: p, format: format}
+
+		if va != 0 {
+			c.Change = (vb - va) / va
+		}
+
+		worse := vb < va
+		if !higherIsBetter {
+			worse = vb > va
+		}
+
+		if p < alpha && (abs(c.Change) >= threshold || va == 0 && vb != 0) {
+			c.Verdict = Improvement
+			if worse {
+				c.Verdict = Regression
+			}
+		}
+
+		changes = append(changes, c)
+	}
+
+	rate := func(v float64) string { return fmt.Sprintf("%.0f/s", v) }
+	duration := func(v float64) string { return time.Duration(v).Round(time.Microsecond).String() }
+	percent := func(v float64) string { return fmt.Sprintf("%.2f%%", v*100) }
+
+	add("throughput", a.Summary.Rate, b.Summary.Rate, stats.WelchT(floats(a.Summary.Throughput), floats(b.Summary.Throughput)), true, rate)
+
+	var steps []string
+	for step := range a.Summary.Latencies {
+		if _, ok := b.Summary.Latencies[step]; ok {
+			steps = append(steps, step)
+		}
+	}
+	slices.Sort(steps)
+
+	for _, step := range steps {
+		da, db := a.Summary.Latencies[step], b.Summary.Latencies[step]
+		add(step+" p50", float64(da.Quantile(0.5)), float64(db.Quantile(0.5)), stats.MannWhitney(da, db), false, duration)
+		add(step+" p99", float64(da.Quantile(0.99)), float64(db.Quantile(0.99)), stats.QuantileTest(da, db, 0.99), false, duration)
+	}
+
+	failuresA, failuresB := sum(a.Summary.Failures), sum(b.Summary.Failures)
+	attemptsA, attemptsB := a.Summary.Transfers+failuresA, b.Summary.Transfers+failuresB
+
+	add("error rate", ratio(failuresA, attemptsA), ratio(failuresB, attemptsB), stats.TwoProportion(failuresA, attemptsA, failuresB, attemptsB), false, percent)
+
+	return changes
+}
+
+// Warnings lists the reasons two runs may not be comparable.
+func Warnings(a, b *Result) []string {
+	var warnings []string
+
+	if a.ScenarioHash != b.ScenarioHash {
+		warnings = append(warnings, fmt.Sprintf("scenarios differ (%v vs %v)", a.ScenarioHash, b.ScenarioHash))
+	}
+	if a.Engine != b.Engine {
+		warnings = append(warnings, fmt.Sprintf("engines differ (%v vs %v)", a.Engine, b.Engine))
+	}
+	if a.Interrupted || b.Interrupted {
+		warnings = append(warnings, "a run was interrupted")
+	}
+	for _, r := range []*Result{a, b} {
+		if r.Client != nil && r.Client.ClientBound {
+			warnings = append(warnings, fmt.Sprintf("%v was client-bound: %v", r.Name, strings.Join(r.Client.Reasons, ", ")))
+		}
+	}
+
+	shapes := make(map[string]string, len(a.Plans))
+	for _, plan := range a.Plans {
+		shapes[plan.Name] = plan.Shape
+	}
+
+	for _, plan := range b.Plans {
+		if shape, ok := shapes[plan.Name]; ok && shape != plan.Shape {
+			warnings = append(warnings, fmt.Sprintf("the plan of %v changed:\n%v\nbecame:\n%v", plan.Name, indent(shape), indent(plan.Shape)))
+		}
+	}
+
+	return warnings
+}
+
+// WriteChanges writes the changes between two runs as a table.
+func WriteChanges(w io.Writer, a, b *Result, changes []Change) error {
+	fmt.Fprintf(w, "A: %v\n", describe(a))
+	fmt.Fprintf(w, "B: %v\n", describe(b))
+
+	for _, warning := range Warnings(a, b) {
+		fmt.Fprintf(w, "warning: %v\n", warning)
+	}
+
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprint(tw, "metric\tA\tB\tchange\tp\tverdict\n")
+
+	for _, c := range changes {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%+.1f%%\t%.3g\t%v\n", c.Metric, c.format(c.A), c.format(c.B), c.Change*100, c.P, c.Verdict)
+	}
+
+	return tw.Flush()
+}
+
+// Regressed reports whether any of the changes is a regression.
+func Regressed(changes []Change) bool {
+	for _, c := range changes {
+		if c.Verdict == Regression {
+			return true
+		}
+	}
+	return false
+}
+
+func indent(s string) string {
+	return "    " + strings.ReplaceAll(s, "\n", "\n    ")
+}
+
+func describe(r *Result) string {
+	s := r.Name
+	if r.EngineVersion != "" {
+		s += " " + r.EngineVersion
+	}
+	s += " started " + r.StartedAt.Format(time.RFC3339)
+	if r.Commit != "" {
+		s += " at commit " + r.Commit
+	}
+	return s
+}
+
+func floats(xs []int64) []float64 {
+	fs := make([]float64, len(xs))
+	for i, x := range xs {
+		fs[i] = float64(x)
+	}
+	return fs
+}
+
+func ratio(x, n int64) float64 {
+	if n == 0 {
+		return 0
+	}
+	return float64(x) / float64(n)
+}
+
+func abs(x float64) float64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
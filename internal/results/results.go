@@ -0,0 +1,239 @@
+package results
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/data"
+	"github.com/calmitchell617/reserva/internal/replicas"
+	"github.com/calmitchell617/reserva/internal/stats"
+)
+
+// Result is the final report of a single benchmark run, as printed at the
+// end of the run and written to the results file.
+type Result struct {
+	Name            string        `json:"name"`
+	Engine          string        `json:"engine"`
+	EngineVersion   string        `json:"engine_version,omitempty"`
+	Commit          string        `json:"commit,omitempty"`
+	ScenarioHash    string        `json:"scenario_hash,omitempty"`
+	Driver          string        `json:"driver"`
+	TxMode          string        `json:"tx_mode"`
+	Isolation       string        `json:"isolation"`
+	Prepared        bool          `json:"prepared"`
+	ConnMode        string        `json:"conn_mode"`
+	ConsistentReads bool          `json:"consistent_reads"`
+	RYWSample       float64       `json:"ryw_sample,omitempty"`
+	StartedAt       time.Time     `json:"started_at"`
+	FinishedAt      time.Time     `json:"finished_at"`
+	Duration        time.Duration `json:"duration"`
+	Warmup          time.Duration `json:"warmup"`
+	Cooldown        time.Duration `json:"cooldown"`
+	Concurrency     int           `json:"concurrency"`
+	Seed            int64         `json:"seed"`
+	Deletes         bool          `json:"deletes"`
+	KindaRandom     bool          `json:"kinda_random"`
+	ReadReplicas    int           `json:"read_replicas"`
+	ReadPolicy      string        `json:"read_policy,omitempty"`
+	Interrupted     bool          `json:"interrupted"`
+	Error           string        `json:"error,omitempty"`
+	Summary         stats.Summary `json:"summary"`
+
+	ReplicaLag *stats.LagSummary      `json:"replica_lag,omitempty"`
+	Replicas   []replicas.Summary     `json:"replicas,omitempty"`
+	Failover   *stats.FailoverSummary `json:"failover,omitempty"`
+	Client     *stats.ClientSummary   `json:"client,omitempty"`
+	Server     *ServerStats           `json:"server,omitempty"`
+	Plans      []data.Plan            `json:"plans,omitempty"`
+	Agents     []Agent                `json:"agents,omitempty"`
+	Replay     *Replay                `json:"replay,omitempty"`
+	Sharding   *Sharding              `json:"sharding,omitempty"`
+}
+
+// Sharding describes a run whose accounts were split across several
+// databases.
+type Sharding struct {
+	Shards int `json:"shards"`
+
+	// By is how accounts were split: hash or range
+	By string `json:"by"`
+
+	// CrossShard is how transfers between shards were run: saga or xa
+	CrossShard string `json:"cross_shard"`
+
+	Summary *stats.ShardSummary `json:"summary"`
+}
+
+// Replay describes a run that replayed recorded operations or real
+// transactions instead of choosing transfers at random.
+type Replay struct {
+	Source string `json:"source"`
+	Format string `json:"format"`
+	Timing string `json:"timing"`
+
+	// Operations is how many operations were issued
+	Operations int64 `json:"operations"`
+
+	// MaxBehind is how far behind the recorded timing an operation started,
+	// at worst, when the timing was preserved
+	MaxBehind time.Duration `json:"max_behind,omitempty"`
+}
+
+func Write(path string, result *Result) error {
+	js, err := json.MarshalIndent(result, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	js = append(js, '\n')
+
+	return os.WriteFile(path, js, 0644)
+}
+
+// WriteAll writes the results of several targets run together.
+func WriteAll(path string, rs []*Result) error {
+	js, err := json.MarshalIndent(rs, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	js = append(js, '\n')
+
+	return os.WriteFile(path, js, 0644)
+}
+
+// Read reads a results file, which holds either a single result or the
+// results of several targets run together.
+func Read(path string) ([]*Result, error) {
+	js, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rs []*Result
+
+	if trimmed := bytes.TrimSpace(js); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(js, &rs)
+		if err != nil {
+			return nil, err
+		}
+		return rs, nil
+	}
+
+	var result Result
+
+	err = json.Unmarshal(js, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*Result{&result}, nil
+}
+
+// scenario is everything about a run that shapes the workload, and the
+// engine and driver it ran on. Runs with the same scenario hash can be
+// compared with each other.
+type scenario struct {
+	Engine          string        `json:"engine"`
+	Driver          string        `json:"driver"`
+	TxMode          string        `json:"tx_mode"`
+	Isolation       string        `json:"isolation"`
+	Prepared        bool          `json:"prepared"`
+	ConnMode        string        `json:"conn_mode"`
+	ConsistentReads bool          `json:"consistent_reads"`
+	RYWSample       float64       `json:"ryw_sample"`
+	Duration        time.Duration `json:"duration"`
+	Warmup          time.Duration `json:"warmup"`
+	Cooldown        time.Duration `json:"cooldown"`
+	Concurrency     int           `json:"concurrency"`
+	Deletes         bool          `json:"deletes"`
+	KindaRandom     bool          `json:"kinda_random"`
+	ReadReplicas    int           `json:"read_replicas"`
+	ReadPolicy      string        `json:"read_policy"`
+	Failover        bool          `json:"failover"`
+	Replay          string        `json:"replay,omitempty"`
+	Shards          string        `json:"shards,omitempty"`
+}
+
+// Scenario returns a short hash of the engine, the driver and the settings
+// that shape the workload.
+func (r *Result) Scenario() string {
+	js, _ := json.Marshal(scenario{
+		Engine:          r.Engine,
+		Driver:          r.Driver,
+		TxMode:          r.TxMode,
+		Isolation:       r.Isolation,
+		Prepared:        r.Prepared,
+		ConnMode:        r.ConnMode,
+		ConsistentReads: r.ConsistentReads,
+		RYWSample:       r.RYWSample,
+		Duration:        r.Duration,
+		Warmup:          r.Warmup,
+		Cooldown:        r.Cooldown,
+		Concurrency:     r.Concurrency,
+		Deletes:         r.Deletes,
+		KindaRandom:     r.KindaRandom,
+		ReadReplicas:    r.ReadReplicas,
+		ReadPolicy:      r.ReadPolicy,
+		Failover:        r.Failover != nil,
+		Replay:          r.replayScenario(),
+		Shards:          r.shardsScenario(),
+	})
+
+	sum := sha256.Sum256(js)
+
+	return hex.EncodeToString(sum[:6])
+}
+
+// replayScenario identifies what a replay replayed, and how, so replays of
+// the same file can be compared wherever it was stored.
+func (r *Result) replayScenario() string {
+	if r.Replay == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%v %v %v", filepath.Base(r.Replay.Source), r.Replay.Format, r.Replay.Timing)
+}
+
+// shardsScenario identifies how a sharded run split its accounts and ran
+// transfers between shards.
+func (r *Result) shardsScenario() string {
+	if r.Sharding == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%v %v %v", r.Sharding.Shards, r.Sharding.By, r.Sharding.CrossShard)
+}
+
+// Commit returns the git commit reserva was built from, if the build recorded
+// it, with a -dirty suffix if there were uncommitted changes.
+func Commit() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+
+	var revision, modified string
+
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+
+	if revision != "" && modified == "true" {
+		revision += "-dirty"
+	}
+
+	return revision
+}
@@ -0,0 +1,102 @@
+package results
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/calmitchell617/reserva/internal/data"
+)
+
+// maxStatements caps how many pg_stat_statements entries are kept, busiest
+// first.
+const maxStatements = 25
+
+// ServerStats is what the database server's own statistics say happened
+// during the run: the change in every counter between the snapshots taken
+// before and after it, and samples of the change during it.
+type ServerStats struct {
+	Start    time.Time        `json:"start"`
+	End      time.Time        `json:"end"`
+	Counters map[string]int64 `json:"counters"`
+
+	// CacheHitRatio is the share of block reads served from postgresql's
+	// shared buffers, or of page reads served from the innodb buffer pool.
+	CacheHitRatio *float64 `json:"cache_hit_ratio,omitempty"`
+
+	Statements []Statement    `json:"statements,omitempty"`
+	Samples    []ServerSample `json:"samples,omitempty"`
+}
+
+type Statement struct {
+	ID string `json:"id"`
+	data.StatementStats
+}
+
+// ServerSample is the change in the counters that moved during one sampling
+// interval, ending at At.
+type ServerSample struct {
+	At       time.Time        `json:"at"`
+	Counters map[string]int64 `json:"counters"`
+}
+
+// NewServerStats summarises the change between two snapshots.
+func NewServerStats(before, after data.ServerSnapshot, samples []ServerSample) *ServerStats {
+	delta := after.Sub(before)
+
+	s := &ServerStats{
+		Start:    before.At,
+		End:      after.At,
+		Counters: delta.Counters,
+		Samples:  samples,
+	}
+
+	ratio := func(hits, misses int64) *float64 {
+		if hits+misses <= 0 {
+			return nil
+		}
+		r := float64(hits) / float64(hits+misses)
+		return &r
+	}
+
+	if hit, ok := delta.Counters["pg_stat_database.blks_hit"]; ok {
+		s.CacheHitRatio = ratio(hit, delta.Counters["pg_stat_database.blks_read"])
+	}
+
+	if requests, ok := delta.Counters["global_status.Innodb_buffer_pool_read_requests"]; ok {
+		reads := delta.Counters["global_status.Innodb_buffer_pool_reads"]
+		s.CacheHitRatio = ratio(requests-reads, reads)
+	}
+
+	for id, st := range delta.Statements {
+		if st.Calls > 0 {
+			s.Statements = append(s.Statements, Statement{ID: id, StatementStats: st})
+		}
+	}
+
+	slices.SortFunc(s.Statements, func(a, b Statement) int {
+		return cmp.Compare(b.TotalTimeMs, a.TotalTimeMs)
+	})
+
+	if len(s.Statements) > maxStatements {
+		s.Statements = s.Statements[:maxStatements]
+	}
+
+	return s
+}
+
+// Changed returns the counters that moved between two snapshots.
+func Changed(before, after data.ServerSnapshot) ServerSample {
+	sample := ServerSample{
+		At:       after.At,
+		Counters: make(map[string]int64),
+	}
+
+	for name, v := range after.Sub(before).Counters {
+		if v != 0 {
+			sample.Counters[name] = v
+		}
+	}
+
+	return sample
+}
@@ -0,0 +1,133 @@
+package stats
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ClientSample is the load generator's own health over one interval. CPU is
+// the share of GOMAXPROCS the process used, where the platform can tell, and
+// LoopLag is how late a goroutine that sleeps between ticks woke up at worst.
+type ClientSample struct {
+	At              time.Time     `json:"at"`
+	CPU             *float64      `json:"cpu,omitempty"`
+	Goroutines      int64         `json:"goroutines"`
+	SchedLatencyP99 time.Duration `json:"sched_latency_p99"`
+	LoopLag         time.Duration `json:"loop_lag"`
+}
+
+// ClientLimits are the thresholds past which the load generator, rather than
+// the database, is taken to be the bottleneck.
+type ClientLimits struct {
+	CPU     float64
+	Latency time.Duration
+}
+
+type ClientSummary struct {
+	Samples       []ClientSample `json:"samples"`
+	CPU           *float64       `json:"cpu,omitempty"`
+	MaxGoroutines int64          `json:"max_goroutines"`
+	SchedLatency  *Distribution  `json:"sched_latency"`
+	GCPauses      *Distribution  `json:"gc_pauses"`
+	LoopLag       *Distribution  `json:"loop_lag"`
+
+	// ClientBound is set if any of the limits was crossed during the
+	// measurement, for the reasons given.
+	ClientBound bool     `json:"client_bound"`
+	Reasons     []string `json:"reasons,omitempty"`
+}
+
+// ClientRecorder collects the load generator's health during the measurement
+// window.
+type ClientRecorder struct {
+	Window Window
+	Limits ClientLimits
+
+	mu       sync.Mutex
+	samples  []ClientSample
+	sched    Histogram
+	gcPauses Histogram
+	loopLag  Histogram
+}
+
+func NewClientRecorder(window Window, limits ClientLimits) *ClientRecorder {
+	return &ClientRecorder{Window: window, Limits: limits}
+}
+
+func (r *ClientRecorder) Record(sample ClientSample) {
+	if r.Window.Phase(sample.At) != PhaseMeasure {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.samples = append(r.samples, sample)
+}
+
+// SchedLatency records n goroutines that waited d to be scheduled.
+func (r *ClientRecorder) SchedLatency(t time.Time, d time.Duration, n int64) {
+	if r.Window.Phase(t) == PhaseMeasure {
+		r.sched.RecordN(d, n)
+	}
+}
+
+// GCPause records n stop-the-world pauses of d.
+func (r *ClientRecorder) GCPause(t time.Time, d time.Duration, n int64) {
+	if r.Window.Phase(t) == PhaseMeasure {
+		r.gcPauses.RecordN(d, n)
+	}
+}
+
+// LoopLag records how late a tick was.
+func (r *ClientRecorder) LoopLag(t time.Time, d time.Duration) {
+	if r.Window.Phase(t) == PhaseMeasure {
+		r.loopLag.Record(d)
+	}
+}
+
+func (r *ClientRecorder) Summary() *ClientSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := &ClientSummary{
+		Samples:      append([]ClientSample(nil), r.samples...),
+		SchedLatency: r.sched.Distribution(),
+		GCPauses:     r.gcPauses.Distribution(),
+		LoopLag:      r.loopLag.Distribution(),
+	}
+
+	var cpu float64
+	var cpuSamples int
+
+	for _, sample := range r.samples {
+		s.MaxGoroutines = max(s.MaxGoroutines, sample.Goroutines)
+
+		if sample.CPU != nil {
+			cpu += *sample.CPU
+			cpuSamples++
+		}
+	}
+
+	if cpuSamples > 0 {
+		cpu /= float64(cpuSamples)
+		s.CPU = &cpu
+
+		if cpu >= r.Limits.CPU {
+			s.Reasons = append(s.Reasons, fmt.Sprintf("the client used %.0f%% of its CPU", cpu*100))
+		}
+	}
+
+	if p99 := s.SchedLatency.Quantile(0.99); s.SchedLatency.Count > 0 && p99 >= r.Limits.Latency {
+		s.Reasons = append(s.Reasons, fmt.Sprintf("goroutines waited %v to be scheduled at p99", p99))
+	}
+
+	if p99 := s.LoopLag.Quantile(0.99); s.LoopLag.Count > 0 && p99 >= r.Limits.Latency {
+		s.Reasons = append(s.Reasons, fmt.Sprintf("the client's timers fired %v late at p99", p99))
+	}
+
+	s.ClientBound = len(s.Reasons) > 0
+
+	return s
+}
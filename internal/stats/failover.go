@@ -0,0 +1,221 @@
+package stats
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FailoverResolution is the granularity at which successes and errors are
+// bucketed to find outages.
+const FailoverResolution = 100 * time.Millisecond
+
+// connectionClass is the error class of broken or refused connections, whose
+// last occurrence after an outage marks the connection pools as recovered.
+// Writes that lose their connection fail in doubt instead, inDoubtClass.
+const (
+	connectionClass = "connection"
+	inDoubtClass    = "in_doubt"
+)
+
+type failoverBucket struct {
+	successes   atomic.Int64
+	connErrors  atomic.Int64
+	errorsMu    sync.Mutex
+	errorCounts map[string]int64
+}
+
+// FailoverRecorder keeps a timeline of successful transfers and errors over
+// the measurement window, from which periods with no successful transfers
+// are found.
+type FailoverRecorder struct {
+	Window Window
+
+	// Threshold is the shortest period without successful transfers that
+	// counts as an outage.
+	Threshold time.Duration
+
+	buckets []failoverBucket
+
+	mu       sync.Mutex
+	examples map[string]string
+	hook     *HookRun
+}
+
+// HookRun describes the run of the command that triggered the failover.
+type HookRun struct {
+	Command    string    `json:"command"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Output     string    `json:"output,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func NewFailoverRecorder(window Window, threshold time.Duration) *FailoverRecorder {
+	n := int(window.End.Sub(window.Start)/FailoverResolution) + 1
+
+	return &FailoverRecorder{
+		Window:    window,
+		Threshold: threshold,
+		buckets:   make([]failoverBucket, n),
+		examples:  make(map[string]string),
+	}
+}
+
+func (r *FailoverRecorder) bucket(t time.Time) *failoverBucket {
+	if r.Window.Phase(t) != PhaseMeasure {
+		return nil
+	}
+
+	i := int(t.Sub(r.Window.Start) / FailoverResolution)
+	if i >= len(r.buckets) {
+		return nil
+	}
+
+	return &r.buckets[i]
+}
+
+// Success records a transfer that committed at t.
+func (r *FailoverRecorder) Success(t time.Time) {
+	if b := r.bucket(t); b != nil {
+		b.successes.Add(1)
+	}
+}
+
+// Error records a transfer that failed at t with an error of the given class.
+// The first message seen of each class is kept as an example.
+func (r *FailoverRecorder) Error(t time.Time, class string, err error) {
+	b := r.bucket(t)
+	if b == nil {
+		return
+	}
+
+	if class == connectionClass || class == inDoubtClass {
+		b.connErrors.Add(1)
+	}
+
+	b.errorsMu.Lock()
+	if b.errorCounts == nil {
+		b.errorCounts = make(map[string]int64)
+	}
+	b.errorCounts[class]++
+	b.errorsMu.Unlock()
+
+	r.mu.Lock()
+	if _, ok := r.examples[class]; !ok {
+		r.examples[class] = err.Error()
+	}
+	r.mu.Unlock()
+}
+
+func (r *FailoverRecorder) Hook(run HookRun) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.hook = &run
+}
+
+// Outage is a period with no successful transfers. PoolRecovery is how long
+// after the start of the outage connection errors were still seen, which is
+// how long it took the connection pools to get rid of broken connections.
+type Outage struct {
+	Start        time.Time        `json:"start"`
+	End          time.Time        `json:"end"`
+	Duration     time.Duration    `json:"duration"`
+	Recovered    bool             `json:"recovered"`
+	PoolRecovery time.Duration    `json:"pool_recovery"`
+	Errors       map[string]int64 `json:"errors,omitempty"`
+}
+
+type FailoverSummary struct {
+	Downtime      time.Duration     `json:"downtime"`
+	Outages       []Outage          `json:"outages"`
+	ErrorExamples map[string]string `json:"error_examples,omitempty"`
+	Hook          *HookRun          `json:"hook,omitempty"`
+
+	// filled in by the acknowledged transfer check after the run
+	Acknowledged int64   `json:"acknowledged"`
+	Checked      bool    `json:"checked"`
+	Missing      int64   `json:"missing"`
+	MissingIds   []int64 `json:"missing_ids,omitempty"`
+}
+
+// Summary finds the outages in the timeline up to t.
+func (r *FailoverRecorder) Summary(t time.Time) *FailoverSummary {
+	s := &FailoverSummary{}
+
+	r.mu.Lock()
+	if len(r.examples) > 0 {
+		s.ErrorExamples = make(map[string]string, len(r.examples))
+		for class, example := range r.examples {
+			s.ErrorExamples[class] = example
+		}
+	}
+	s.Hook = r.hook
+	r.mu.Unlock()
+
+	n := min(len(r.buckets), int(r.Window.Elapsed(t)/FailoverResolution)+1)
+	timeAt := func(i int) time.Time {
+		return r.Window.Start.Add(time.Duration(i) * FailoverResolution)
+	}
+
+	// find runs of buckets without successes that are long enough
+	type span struct{ start, end int }
+	var spans []span
+
+	for i := 0; i < n; {
+		if r.buckets[i].successes.Load() > 0 {
+			i++
+			continue
+		}
+
+		j := i
+		for j < n && r.buckets[j].successes.Load() == 0 {
+			j++
+		}
+
+		if time.Duration(j-i)*FailoverResolution >= r.Threshold {
+			spans = append(spans, span{i, j})
+		}
+
+		i = j
+	}
+
+	for k, sp := range spans {
+		o := Outage{
+			Start:     timeAt(sp.start),
+			End:       timeAt(sp.end),
+			Recovered: sp.end < n,
+			Errors:    make(map[string]int64),
+		}
+		o.Duration = o.End.Sub(o.Start)
+
+		for i := sp.start; i < sp.end; i++ {
+			b := &r.buckets[i]
+			b.errorsMu.Lock()
+			for class, c := range b.errorCounts {
+				o.Errors[class] += c
+			}
+			b.errorsMu.Unlock()
+		}
+
+		// connection errors after the outage, up to the next one, still
+		// count towards the pool recovery
+		next := n
+		if k+1 < len(spans) {
+			next = spans[k+1].start
+		}
+
+		for i := next - 1; i >= sp.start; i-- {
+			if r.buckets[i].connErrors.Load() > 0 {
+				o.PoolRecovery = timeAt(i + 1).Sub(o.Start)
+				break
+			}
+		}
+
+		s.Downtime += o.Duration
+		s.Outages = append(s.Outages, o)
+	}
+
+	return s
+}
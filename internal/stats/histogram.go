@@ -0,0 +1,204 @@
+package stats
+
+import (
+	"encoding/json"
+	"math/bits"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Latencies are recorded in microseconds into log-linear buckets: values
+// below 64µs get a bucket each, and every power of two above that is split
+// into 32 buckets, which keeps the relative error of any quantile under
+// about 3%.
+const (
+	subBucketBits  = 5
+	subBucketCount = 1 << subBucketBits
+	numBuckets     = (64 - subBucketBits + 1) * subBucketCount
+)
+
+func bucketOf(us uint64) int {
+	e := max(0, bits.Len64(us)-(subBucketBits+1))
+	return e*subBucketCount + int(us>>e)
+}
+
+// BucketValue returns the lowest value, in microseconds, that falls in the
+// given bucket.
+func BucketValue(i int) uint64 {
+	if i < 2*subBucketCount {
+		return uint64(i)
+	}
+	e := i/subBucketCount - 1
+	return uint64(i-e*subBucketCount) << e
+}
+
+// Histogram records latencies. It is safe for concurrent use.
+type Histogram struct {
+	counts [numBuckets]atomic.Int64
+	sum    atomic.Int64
+	max    atomic.Int64
+}
+
+func (h *Histogram) Record(d time.Duration) {
+	h.RecordN(d, 1)
+}
+
+// RecordN records n latencies of d, such as a bucket of another histogram.
+func (h *Histogram) RecordN(d time.Duration, n int64) {
+	if n <= 0 {
+		return
+	}
+
+	us := max(0, d.Microseconds())
+
+	h.counts[bucketOf(uint64(us))].Add(n)
+	h.sum.Add(us * n)
+
+	for {
+		m := h.max.Load()
+		if us <= m || h.max.CompareAndSwap(m, us) {
+			break
+		}
+	}
+}
+
+// Distribution returns a copy of the latencies recorded so far.
+func (h *Histogram) Distribution() *Distribution {
+	d := &Distribution{
+		Counts: make([]int64, numBuckets),
+		SumUs:  h.sum.Load(),
+		MaxUs:  h.max.Load(),
+	}
+
+	for i := range h.counts {
+		d.Counts[i] = h.counts[i].Load()
+		d.Count += d.Counts[i]
+	}
+
+	return d
+}
+
+// Distribution is a point-in-time copy of a Histogram. Distributions from
+// different runs or agents can be merged.
+type Distribution struct {
+	Counts []int64
+	Count  int64
+	SumUs  int64
+	MaxUs  int64
+}
+
+// Quantile returns the latency below which the fraction q of the recorded
+// latencies fall.
+func (d *Distribution) Quantile(q float64) time.Duration {
+	if d == nil || d.Count == 0 {
+		return 0
+	}
+
+	rank := int64(q * float64(d.Count))
+	rank = min(max(rank, 1), d.Count)
+
+	var seen int64
+	for i, c := range d.Counts {
+		seen += c
+		if seen >= rank {
+			return min(time.Duration(BucketValue(i))*time.Microsecond, d.Max())
+		}
+	}
+
+	return d.Max()
+}
+
+func (d *Distribution) Mean() time.Duration {
+	if d == nil || d.Count == 0 {
+		return 0
+	}
+	return time.Duration(d.SumUs/d.Count) * time.Microsecond
+}
+
+func (d *Distribution) Max() time.Duration {
+	if d == nil {
+		return 0
+	}
+	return time.Duration(d.MaxUs) * time.Microsecond
+}
+
+// Merge adds the latencies in o to d.
+func (d *Distribution) Merge(o *Distribution) {
+	if o == nil {
+		return
+	}
+
+	if d.Counts == nil {
+		d.Counts = make([]int64, numBuckets)
+	}
+
+	for i, c := range o.Counts {
+		d.Counts[i] += c
+	}
+
+	d.Count += o.Count
+	d.SumUs += o.SumUs
+	d.MaxUs = max(d.MaxUs, o.MaxUs)
+}
+
+type distributionJSON struct {
+	Count   int64            `json:"count"`
+	MeanUs  int64            `json:"mean_us"`
+	P50Us   int64            `json:"p50_us"`
+	P90Us   int64            `json:"p90_us"`
+	P99Us   int64            `json:"p99_us"`
+	P999Us  int64            `json:"p999_us"`
+	MaxUs   int64            `json:"max_us"`
+	SumUs   int64            `json:"sum_us"`
+	Buckets map[string]int64 `json:"buckets"`
+}
+
+// MarshalJSON writes the headline percentiles for people reading the file,
+// followed by the non-empty buckets, which is what is read back.
+func (d *Distribution) MarshalJSON() ([]byte, error) {
+	js := distributionJSON{
+		Count:   d.Count,
+		MeanUs:  d.Mean().Microseconds(),
+		P50Us:   d.Quantile(0.5).Microseconds(),
+		P90Us:   d.Quantile(0.9).Microseconds(),
+		P99Us:   d.Quantile(0.99).Microseconds(),
+		P999Us:  d.Quantile(0.999).Microseconds(),
+		MaxUs:   d.MaxUs,
+		SumUs:   d.SumUs,
+		Buckets: make(map[string]int64),
+	}
+
+	for i, c := range d.Counts {
+		if c != 0 {
+			js.Buckets[strconv.FormatUint(BucketValue(i), 10)] = c
+		}
+	}
+
+	return json.Marshal(js)
+}
+
+func (d *Distribution) UnmarshalJSON(b []byte) error {
+	var js distributionJSON
+
+	err := json.Unmarshal(b, &js)
+	if err != nil {
+		return err
+	}
+
+	d.Counts = make([]int64, numBuckets)
+	d.Count = 0
+	d.SumUs = js.SumUs
+	d.MaxUs = js.MaxUs
+
+	for k, c := range js.Buckets {
+		us, err := strconv.ParseUint(k, 10, 64)
+		if err != nil {
+			return err
+		}
+		d.Counts[bucketOf(us)] += c
+		d.Count += c
+	}
+
+	return nil
+}
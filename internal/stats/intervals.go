@@ -0,0 +1,154 @@
+package stats
+
+import (
+	"maps"
+	"time"
+)
+
+// Interval is what happened during one interval of the measurement window.
+// At is the end of the interval.
+type Interval struct {
+	At        time.Time                  `json:"at"`
+	Length    time.Duration              `json:"length"`
+	Transfers int64                      `json:"transfers"`
+	Deletes   int64                      `json:"deletes"`
+	Failures  map[string]int64           `json:"failures,omitempty"`
+	Latencies map[string]IntervalLatency `json:"latencies,omitempty"`
+	Pool      *PoolStats                 `json:"pool,omitempty"`
+}
+
+// PoolStats describes the primary's connection pool at the end of an
+// interval. Waits are those that started during the interval.
+type PoolStats struct {
+	Open         int           `json:"open"`
+	InUse        int           `json:"in_use"`
+	Idle         int           `json:"idle"`
+	WaitCount    int64         `json:"wait_count"`
+	WaitDuration time.Duration `json:"wait_duration"`
+}
+
+// IntervalLatency summarises the latencies of one step during an interval.
+// Max is only accurate to the histogram bucket.
+type IntervalLatency struct {
+	Count int64         `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// intervalState is what the counters were at the end of the last interval.
+type intervalState struct {
+	at        time.Time
+	transfers int64
+	deletes   int64
+	failures  map[string]int64
+	latencies map[string]*Distribution
+}
+
+// Sample records the interval since the previous sample, or since the start
+// of the measurement window, and returns it. pool may be nil.
+func (r *Recorder) Sample(t time.Time, pool *PoolStats) Interval {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prev := r.last
+	if prev.at.IsZero() {
+		prev.at = r.Window.Start
+	}
+
+	end := t
+	if end.After(r.Window.End) {
+		end = r.Window.End
+	}
+
+	cur := intervalState{
+		at:        end,
+		transfers: r.measuredTransfers.Load(),
+		deletes:   r.measuredDeletes.Load(),
+		failures:  maps.Clone(r.failures),
+		latencies: make(map[string]*Distribution, len(r.latencies)),
+	}
+
+	for step, h := range r.latencies {
+		cur.latencies[step] = h.Distribution()
+	}
+
+	interval := Interval{
+		At:        end,
+		Length:    end.Sub(prev.at),
+		Transfers: cur.transfers - prev.transfers,
+		Deletes:   cur.deletes - prev.deletes,
+		Failures:  make(map[string]int64),
+		Latencies: make(map[string]IntervalLatency),
+		Pool:      pool,
+	}
+
+	for class, c := range cur.failures {
+		if n := c - prev.failures[class]; n > 0 {
+			interval.Failures[class] = n
+		}
+	}
+
+	for step, d := range cur.latencies {
+		delta := d.Sub(prev.latencies[step])
+		if delta.Count == 0 {
+			continue
+		}
+
+		interval.Latencies[step] = IntervalLatency{
+			Count: delta.Count,
+			P50:   delta.Quantile(0.5),
+			P90:   delta.Quantile(0.9),
+			P99:   delta.Quantile(0.99),
+			Max:   delta.Max(),
+		}
+	}
+
+	r.last = cur
+	r.intervals = append(r.intervals, interval)
+
+	return interval
+}
+
+// LastInterval returns the most recently sampled interval, if any.
+func (r *Recorder) LastInterval() (Interval, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.intervals) == 0 {
+		return Interval{}, false
+	}
+
+	return r.intervals[len(r.intervals)-1], true
+}
+
+// Sub returns the latencies in d that are not in o, where o is an earlier
+// copy of the same histogram. The max is that of the highest non-empty
+// bucket.
+func (d *Distribution) Sub(o *Distribution) *Distribution {
+	delta := &Distribution{
+		Counts: make([]int64, numBuckets),
+		Count:  d.Count,
+		SumUs:  d.SumUs,
+	}
+
+	copy(delta.Counts, d.Counts)
+
+	if o != nil {
+		for i, c := range o.Counts {
+			delta.Counts[i] -= c
+		}
+		delta.Count -= o.Count
+		delta.SumUs -= o.SumUs
+	}
+
+	for i := len(delta.Counts) - 1; i >= 0; i-- {
+		if delta.Counts[i] > 0 {
+			delta.MaxUs = min(int64(BucketValue(i+1)-1), d.MaxUs)
+			break
+		}
+	}
+
+	return delta
+}
@@ -0,0 +1,79 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// LagSample is one measurement of how far a read replica is behind the
+// primary. Heartbeat is how long a heartbeat written to the primary took to
+// show up on the replica, and Server is the lag the replica reports itself,
+// where the engine supports it.
+type LagSample struct {
+	At        time.Time      `json:"at"`
+	Heartbeat time.Duration  `json:"heartbeat"`
+	Server    *time.Duration `json:"server,omitempty"`
+}
+
+type LagSummary struct {
+	Samples   []LagSample   `json:"samples"`
+	Heartbeat *Distribution `json:"heartbeat"`
+	Server    *Distribution `json:"server,omitempty"`
+}
+
+// LagRecorder collects the replica lag samples taken during the measurement
+// window.
+type LagRecorder struct {
+	Window Window
+
+	mu        sync.Mutex
+	samples   []LagSample
+	heartbeat Histogram
+	server    Histogram
+	hasServer bool
+}
+
+func NewLagRecorder(window Window) *LagRecorder {
+	return &LagRecorder{Window: window}
+}
+
+func (r *LagRecorder) Record(sample LagSample) {
+	if r.Window.Phase(sample.At) != PhaseMeasure {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.samples = append(r.samples, sample)
+	r.heartbeat.Record(sample.Heartbeat)
+
+	if sample.Server != nil {
+		r.server.Record(*sample.Server)
+		r.hasServer = true
+	}
+}
+
+// Len returns the number of samples recorded.
+func (r *LagRecorder) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.samples)
+}
+
+func (r *LagRecorder) Summary() *LagSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := &LagSummary{
+		Samples:   append([]LagSample(nil), r.samples...),
+		Heartbeat: r.heartbeat.Distribution(),
+	}
+
+	if r.hasServer {
+		s.Server = r.server.Distribution()
+	}
+
+	return s
+}
@@ -0,0 +1,134 @@
+package stats
+
+import "time"
+
+// MergeSummaries combines the summaries of several load generators that ran
+// the same measurement window against the same database, as if one had run
+// all their transfers. Latency distributions are merged exactly, while the
+// percentiles of merged intervals are those of the worst load generator.
+func MergeSummaries(summaries []Summary) Summary {
+	var s Summary
+
+	var rywDelay *Distribution
+
+	for _, o := range summaries {
+		s.Transfers += o.Transfers
+		s.Deletes += o.Deletes
+		s.Actions += o.Actions
+		s.Connections += o.Connections
+		s.Elapsed = max(s.Elapsed, o.Elapsed)
+
+		s.Retries = addCounts(s.Retries, o.Retries)
+		s.Failures = addCounts(s.Failures, o.Failures)
+
+		for step, d := range o.Latencies {
+			if s.Latencies == nil {
+				s.Latencies = make(map[string]*Distribution)
+			}
+			if s.Latencies[step] == nil {
+				s.Latencies[step] = &Distribution{}
+			}
+			s.Latencies[step].Merge(d)
+		}
+
+		for i, n := range o.Throughput {
+			if i == len(s.Throughput) {
+				s.Throughput = append(s.Throughput, 0)
+			}
+			s.Throughput[i] += n
+		}
+
+		for i, interval := range o.Intervals {
+			if i == len(s.Intervals) {
+				s.Intervals = append(s.Intervals, Interval{At: interval.At, Length: interval.Length})
+			}
+			s.Intervals[i] = MergeIntervals(s.Intervals[i], interval)
+		}
+
+		if o.ReadYourWrites != nil {
+			if s.ReadYourWrites == nil {
+				s.ReadYourWrites = &ReadYourWritesSummary{}
+				rywDelay = &Distribution{}
+			}
+			s.ReadYourWrites.Checks += o.ReadYourWrites.Checks
+			s.ReadYourWrites.Stale += o.ReadYourWrites.Stale
+			s.ReadYourWrites.TimedOut += o.ReadYourWrites.TimedOut
+			rywDelay.Merge(o.ReadYourWrites.Delay)
+		}
+	}
+
+	if s.ReadYourWrites != nil {
+		s.ReadYourWrites.Delay = rywDelay
+		if s.ReadYourWrites.Checks > 0 {
+			s.ReadYourWrites.StaleRate = float64(s.ReadYourWrites.Stale) / float64(s.ReadYourWrites.Checks)
+		}
+	}
+
+	if s.Elapsed > 0 {
+		s.Rate = float64(s.Actions) / s.Elapsed.Seconds()
+		s.ConnectionRate = float64(s.Connections) / s.Elapsed.Seconds()
+	}
+
+	return s
+}
+
+// MergeIntervals combines the same interval of two load generators. Counts
+// and pool stats are added up, and each latency percentile is the higher of
+// the two.
+func MergeIntervals(a, b Interval) Interval {
+	m := Interval{
+		At:        latest(a.At, b.At),
+		Length:    max(a.Length, b.Length),
+		Transfers: a.Transfers + b.Transfers,
+		Deletes:   a.Deletes + b.Deletes,
+		Failures:  addCounts(addCounts(nil, a.Failures), b.Failures),
+		Latencies: make(map[string]IntervalLatency, len(a.Latencies)),
+	}
+
+	for _, latencies := range []map[string]IntervalLatency{a.Latencies, b.Latencies} {
+		for step, l := range latencies {
+			cur := m.Latencies[step]
+			m.Latencies[step] = IntervalLatency{
+				Count: cur.Count + l.Count,
+				P50:   max(cur.P50, l.P50),
+				P90:   max(cur.P90, l.P90),
+				P99:   max(cur.P99, l.P99),
+				Max:   max(cur.Max, l.Max),
+			}
+		}
+	}
+
+	for _, pool := range []*PoolStats{a.Pool, b.Pool} {
+		if pool == nil {
+			continue
+		}
+		if m.Pool == nil {
+			m.Pool = &PoolStats{}
+		}
+		m.Pool.Open += pool.Open
+		m.Pool.InUse += pool.InUse
+		m.Pool.Idle += pool.Idle
+		m.Pool.WaitCount += pool.WaitCount
+		m.Pool.WaitDuration += pool.WaitDuration
+	}
+
+	return m
+}
+
+func addCounts(m, o map[string]int64) map[string]int64 {
+	for class, n := range o {
+		if m == nil {
+			m = make(map[string]int64)
+		}
+		m[class] += n
+	}
+	return m
+}
+
+// latest returns the later of two times.
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,129 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// ShardSummary is how the transfers of a sharded run were spread over the
+// shards, and how the transfers between accounts on different shards went.
+type ShardSummary struct {
+	// Transfers is how many transfers debited an account on each shard
+	Transfers []int64 `json:"transfers"`
+
+	CrossShard     int64   `json:"cross_shard"`
+	CrossShardRate float64 `json:"cross_shard_rate"`
+
+	// Compensations is how many cross-shard transfers were refunded because
+	// the credit failed after the debit had committed
+	Compensations int64 `json:"compensations"`
+
+	// InDoubt is how many cross-shard transfers may have been left half done,
+	// because a refund or a commit of a prepared transaction failed
+	InDoubt int64 `json:"in_doubt"`
+}
+
+// ShardRecorder counts the transfers of a sharded run during the
+// measurement window.
+type ShardRecorder struct {
+	Window Window
+
+	mu            sync.Mutex
+	transfers     []int64
+	crossShard    int64
+	compensations int64
+	inDoubt       int64
+}
+
+func NewShardRecorder(window Window, shards int) *ShardRecorder {
+	return &ShardRecorder{Window: window, transfers: make([]int64, shards)}
+}
+
+// Transfer records a transfer that committed at t, debiting an account on
+// shard, and whether it credited an account on another shard.
+func (r *ShardRecorder) Transfer(t time.Time, shard int, crossShard bool) {
+	if r.Window.Phase(t) != PhaseMeasure {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.transfers[shard]++
+	if crossShard {
+		r.crossShard++
+	}
+}
+
+func (r *ShardRecorder) Compensation(t time.Time) {
+	if r.Window.Phase(t) != PhaseMeasure {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.compensations++
+}
+
+func (r *ShardRecorder) InDoubt(t time.Time) {
+	if r.Window.Phase(t) != PhaseMeasure {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.inDoubt++
+}
+
+func (r *ShardRecorder) Summary() *ShardSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := &ShardSummary{
+		Transfers:     append([]int64(nil), r.transfers...),
+		CrossShard:    r.crossShard,
+		Compensations: r.compensations,
+		InDoubt:       r.inDoubt,
+	}
+	s.CrossShardRate = crossShardRate(s)
+
+	return s
+}
+
+func crossShardRate(s *ShardSummary) float64 {
+	var total int64
+	for _, n := range s.Transfers {
+		total += n
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	return float64(s.CrossShard) / float64(total)
+}
+
+// MergeShardSummaries combines the shard summaries of several load
+// generators that ran against the same shards.
+func MergeShardSummaries(summaries []*ShardSummary) *ShardSummary {
+	s := &ShardSummary{}
+
+	for _, o := range summaries {
+		for i, n := range o.Transfers {
+			if i == len(s.Transfers) {
+				s.Transfers = append(s.Transfers, 0)
+			}
+			s.Transfers[i] += n
+		}
+
+		s.CrossShard += o.CrossShard
+		s.Compensations += o.Compensations
+		s.InDoubt += o.InDoubt
+	}
+
+	s.CrossShardRate = crossShardRate(s)
+
+	return s
+}
@@ -0,0 +1,203 @@
+package stats
+
+import "math"
+
+// MannWhitney returns the two-sided p-value of the Mann-Whitney U test of
+// whether latencies in a and b come from the same distribution. Latencies in
+// the same bucket count as ties. It returns 1 if either is empty.
+func MannWhitney(a, b *Distribution) float64 {
+	if a == nil || b == nil || a.Count == 0 || b.Count == 0 {
+		return 1
+	}
+
+	n1, n2 := float64(a.Count), float64(b.Count)
+	n := n1 + n2
+
+	var u, ties, below float64
+
+	for i := range max(len(a.Counts), len(b.Counts)) {
+		var ca, cb float64
+		if i < len(a.Counts) {
+			ca = float64(a.Counts[i])
+		}
+		if i < len(b.Counts) {
+			cb = float64(b.Counts[i])
+		}
+
+		u += ca * (below + cb/2)
+		below += cb
+
+		t := ca + cb
+		ties += t*t*t - t
+	}
+
+	mean := n1 * n2 / 2
+	variance := n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1)))
+	if variance <= 0 {
+		return 1
+	}
+
+	z := (u - mean) / math.Sqrt(variance)
+
+	return math.Erfc(math.Abs(z) / math.Sqrt2)
+}
+
+// QuantileTest returns the two-sided p-value of a test of whether latencies in
+// a and b have the same q quantile: Mood's median test, for any quantile. The
+// shares of a and b at or above the quantile of both together are compared
+// with a two-proportion z-test, so unlike MannWhitney, it only looks at the
+// tail beyond the quantile. It returns 1 if either is empty.
+func QuantileTest(a, b *Distribution, q float64) float64 {
+	if a == nil || b == nil || a.Count == 0 || b.Count == 0 {
+		return 1
+	}
+
+	var pooled Distribution
+	pooled.Merge(a)
+	pooled.Merge(b)
+
+	threshold := bucketOf(uint64(pooled.Quantile(q).Microseconds()))
+
+	above := func(d *Distribution) int64 {
+		var n int64
+		for i := threshold; i < len(d.Counts); i++ {
+			n += d.Counts[i]
+		}
+		return n
+	}
+
+	return TwoProportion(above(a), a.Count, above(b), b.Count)
+}
+
+// WelchT returns the two-sided p-value of Welch's t-test of whether a and b
+// have the same mean. It returns 1 if either has fewer than two samples.
+func WelchT(a, b []float64) float64 {
+	if len(a) < 2 || len(b) < 2 {
+		return 1
+	}
+
+	ma, va := meanVariance(a)
+	mb, vb := meanVariance(b)
+
+	sa, sb := va/float64(len(a)), vb/float64(len(b))
+	if sa+sb == 0 {
+		if ma == mb {
+			return 1
+		}
+		return 0
+	}
+
+	t := (ma - mb) / math.Sqrt(sa+sb)
+	df := (sa + sb) * (sa + sb) / (sa*sa/float64(len(a)-1) + sb*sb/float64(len(b)-1))
+
+	return incompleteBeta(df/2, 0.5, df/(df+t*t))
+}
+
+func meanVariance(xs []float64) (float64, float64) {
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	mean := sum / float64(len(xs))
+
+	var squares float64
+	for _, x := range xs {
+		squares += (x - mean) * (x - mean)
+	}
+
+	return mean, squares / float64(len(xs)-1)
+}
+
+// incompleteBeta returns the regularized incomplete beta function I_x(a, b),
+// evaluated with a continued fraction.
+func incompleteBeta(a, b, x float64) float64 {
+	switch {
+	case x <= 0:
+		return 0
+	case x >= 1:
+		return 1
+	}
+
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log(1-x))
+
+	// the continued fraction converges quickly below this point, and the
+	// symmetry I_x(a, b) = 1 - I_1-x(b, a) covers the rest
+	if x > (a+1)/(a+b+2) {
+		return 1 - front*betaFraction(b, a, 1-x)/b
+	}
+
+	return front * betaFraction(a, b, x) / a
+}
+
+func betaFraction(a, b, x float64) float64 {
+	const (
+		maxIterations = 200
+		epsilon       = 1e-12
+		tiny          = 1e-300
+	)
+
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+
+	for m := 1; m <= maxIterations; m++ {
+		fm := float64(m)
+
+		// even step
+		num := fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+
+		// odd step
+		num = -(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+
+		if math.Abs(delta-1) < epsilon {
+			break
+		}
+	}
+
+	return h
+}
+
+// TwoProportion returns the two-sided p-value of the z-test of whether x1 out
+// of n1 and x2 out of n2 come from the same proportion.
+func TwoProportion(x1, n1, x2, n2 int64) float64 {
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+
+	p := float64(x1+x2) / float64(n1+n2)
+	se := math.Sqrt(p * (1 - p) * (1/float64(n1) + 1/float64(n2)))
+	if se == 0 {
+		return 1
+	}
+
+	z := (float64(x1)/float64(n1) - float64(x2)/float64(n2)) / se
+
+	return math.Erfc(math.Abs(z) / math.Sqrt2)
+}
@@ -0,0 +1,134 @@
+package stats
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// distribution records latencies, in microseconds. Values below 64µs each get
+// their own bucket, so the test sees them exactly.
+func distribution(us ...int) *Distribution {
+	var h Histogram
+	for _, v := range us {
+		h.Record(time.Duration(v) * time.Microsecond)
+	}
+	return h.Distribution()
+}
+
+func TestIncompleteBeta(t *testing.T) {
+	tests := []struct {
+		a, b, x float64
+		want    float64
+	}{
+		{1, 1, 0.3, 0.3},
+		{3, 1, 0.5, 0.125},
+		{5, 5, 0.5, 0.5},
+		{20, 20, 0.5, 0.5},
+		// the binomial tail P(X >= 2) for X ~ B(4, 0.4)
+		{2, 3, 0.4, 0.5248},
+		// the symmetry I_x(a, b) = 1 - I_1-x(b, a)
+		{3, 2, 0.6, 1 - 0.5248},
+		{2, 3, 0, 0},
+		{2, 3, 1, 1},
+	}
+
+	for _, tt := range tests {
+		got := incompleteBeta(tt.a, tt.b, tt.x)
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("incompleteBeta(%v, %v, %v) = %v, want %v", tt.a, tt.b, tt.x, got, tt.want)
+		}
+	}
+}
+
+func TestWelchT(t *testing.T) {
+	// the first example in the Wikipedia article on Welch's t-test, where
+	// t = -2.46 with 24.99 degrees of freedom
+	a := []float64{27.5, 21.0, 19.0, 23.6, 17.0, 17.9, 16.9, 20.1, 21.9, 22.6, 23.1, 19.6, 19.0, 21.7, 21.4}
+	b := []float64{27.1, 22.0, 20.8, 23.4, 23.4, 23.5, 25.8, 22.0, 24.8, 20.2, 21.9, 22.1, 22.9, 20.5, 24.4}
+
+	if got, want := WelchT(a, b), 0.021378; math.Abs(got-want) > 1e-5 {
+		t.Errorf("WelchT = %v, want %v", got, want)
+	}
+
+	if got := WelchT(b, a); math.Abs(got-0.021378) > 1e-5 {
+		t.Errorf("WelchT with the samples swapped = %v, want the same p-value", got)
+	}
+
+	if got := WelchT(a, a); got != 1 {
+		t.Errorf("WelchT of a sample against itself = %v, want 1", got)
+	}
+
+	if got := WelchT([]float64{1}, b); got != 1 {
+		t.Errorf("WelchT with a single sample = %v, want 1", got)
+	}
+}
+
+func TestMannWhitney(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []int
+		want float64
+	}{
+		{
+			name: "no ties",
+			a:    []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			b:    []int{6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+			want: 0.004510,
+		},
+		{
+			name: "ties",
+			a:    []int{3, 3, 5, 7, 7, 7, 9, 12},
+			b:    []int{4, 6, 7, 8, 10, 10, 11, 13, 13, 14},
+			want: 0.066681,
+		},
+		{
+			name: "same",
+			a:    []int{1, 2, 3, 4, 5},
+			b:    []int{1, 2, 3, 4, 5},
+			want: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		a, b := distribution(tt.a...), distribution(tt.b...)
+
+		if got := MannWhitney(a, b); math.Abs(got-tt.want) > 1e-5 {
+			t.Errorf("%v: MannWhitney = %v, want %v", tt.name, got, tt.want)
+		}
+
+		if got := MannWhitney(b, a); math.Abs(got-tt.want) > 1e-5 {
+			t.Errorf("%v: MannWhitney with the samples swapped = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if got := MannWhitney(distribution(1, 2, 3), nil); got != 1 {
+		t.Errorf("MannWhitney against no samples = %v, want 1", got)
+	}
+}
+
+func TestQuantileTest(t *testing.T) {
+	repeat := func(v, n int) []int {
+		us := make([]int, n)
+		for i := range us {
+			us[i] = v
+		}
+		return us
+	}
+
+	// the same body, with a tail only in b
+	a := distribution(append(repeat(10, 990), repeat(20, 10)...)...)
+	b := distribution(append(repeat(10, 950), repeat(50, 50)...)...)
+
+	if got := QuantileTest(a, b, 0.99); got > 1e-6 {
+		t.Errorf("QuantileTest of a longer tail = %v, want about 0", got)
+	}
+
+	if got := QuantileTest(a, a, 0.99); got != 1 {
+		t.Errorf("QuantileTest of the same latencies = %v, want 1", got)
+	}
+
+	if got := QuantileTest(a, nil, 0.99); got != 1 {
+		t.Errorf("QuantileTest against no samples = %v, want 1", got)
+	}
+}
@@ -0,0 +1,309 @@
+package stats
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Phase int
+
+const (
+	PhaseWarmup Phase = iota
+	PhaseMeasure
+	PhaseCooldown
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseWarmup:
+		return "warming up"
+	case PhaseMeasure:
+		return "measuring"
+	case PhaseCooldown:
+		return "cooling down"
+	}
+	return "unknown"
+}
+
+// Window is the part of a run that counts towards the reported statistics.
+// Work completed before Start (warmup) or after End (cooldown) is still
+// performed, but is left out of the measured counters.
+type Window struct {
+	Start time.Time
+	End   time.Time
+}
+
+func NewWindow(start time.Time, warmup, duration time.Duration) Window {
+	return Window{
+		Start: start.Add(warmup),
+		End:   start.Add(warmup + duration),
+	}
+}
+
+func (w Window) Phase(t time.Time) Phase {
+	switch {
+	case t.Before(w.Start):
+		return PhaseWarmup
+	case t.After(w.End):
+		return PhaseCooldown
+	}
+	return PhaseMeasure
+}
+
+// Elapsed returns how much of the window had passed at t.
+func (w Window) Elapsed(t time.Time) time.Duration {
+	switch w.Phase(t) {
+	case PhaseWarmup:
+		return 0
+	case PhaseCooldown:
+		return w.End.Sub(w.Start)
+	}
+	return t.Sub(w.Start)
+}
+
+type Recorder struct {
+	Window Window
+
+	transfers atomic.Int64
+	deletes   atomic.Int64
+
+	measuredTransfers   atomic.Int64
+	measuredDeletes     atomic.Int64
+	measuredConnections atomic.Int64
+
+	ryw ReadYourWritesRecorder
+
+	// measured actions completed in each second of the window
+	perSecond []atomic.Int64
+
+	mu        sync.Mutex
+	retries   map[string]int64
+	failures  map[string]int64
+	latencies map[string]*Histogram
+	last      intervalState
+	intervals []Interval
+}
+
+func NewRecorder(window Window) *Recorder {
+	return &Recorder{
+		Window:    window,
+		perSecond: make([]atomic.Int64, int(window.End.Sub(window.Start)/time.Second)+1),
+		retries:   make(map[string]int64),
+		failures:  make(map[string]int64),
+		latencies: make(map[string]*Histogram),
+	}
+}
+
+// Transfer records a completed transfer and returns the total number of
+// transfers completed so far, measured or not.
+func (r *Recorder) Transfer() int64 {
+	if now := time.Now(); r.Window.Phase(now) == PhaseMeasure {
+		r.measuredTransfers.Add(1)
+		r.second(now).Add(1)
+	}
+	return r.transfers.Add(1)
+}
+
+func (r *Recorder) Delete() int64 {
+	if now := time.Now(); r.Window.Phase(now) == PhaseMeasure {
+		r.measuredDeletes.Add(1)
+		r.second(now).Add(1)
+	}
+	return r.deletes.Add(1)
+}
+
+func (r *Recorder) second(t time.Time) *atomic.Int64 {
+	i := min(int(t.Sub(r.Window.Start)/time.Second), len(r.perSecond)-1)
+	return &r.perSecond[i]
+}
+
+// Connection records a newly opened database connection and how long it took
+// to open.
+func (r *Recorder) Connection(d time.Duration) {
+	if r.Window.Phase(time.Now()) != PhaseMeasure {
+		return
+	}
+
+	r.measuredConnections.Add(1)
+	r.Latency("connect", d)
+}
+
+// ReadYourWrites records a check of whether a write could be read back from
+// the read replica straight after it was committed. If it couldn't, delay is
+// how long it took to show up, or timedOut is set if it never did.
+func (r *Recorder) ReadYourWrites(stale, timedOut bool, delay time.Duration) {
+	if r.Window.Phase(time.Now()) != PhaseMeasure {
+		return
+	}
+
+	r.ryw.Record(stale, timedOut, delay)
+}
+
+// ReadYourWritesRecorder counts read-your-writes checks, such as those of one
+// read replica. It records every check, so the caller decides which count.
+type ReadYourWritesRecorder struct {
+	checks   atomic.Int64
+	stale    atomic.Int64
+	timeouts atomic.Int64
+	delay    Histogram
+}
+
+func (r *ReadYourWritesRecorder) Record(stale, timedOut bool, delay time.Duration) {
+	r.checks.Add(1)
+
+	switch {
+	case timedOut:
+		r.stale.Add(1)
+		r.timeouts.Add(1)
+	case stale:
+		r.stale.Add(1)
+		r.delay.Record(delay)
+	}
+}
+
+// Summary returns nil if no checks were recorded.
+func (r *ReadYourWritesRecorder) Summary() *ReadYourWritesSummary {
+	checks := r.checks.Load()
+	if checks == 0 {
+		return nil
+	}
+
+	return &ReadYourWritesSummary{
+		Checks:    checks,
+		Stale:     r.stale.Load(),
+		TimedOut:  r.timeouts.Load(),
+		StaleRate: float64(r.stale.Load()) / float64(checks),
+		Delay:     r.delay.Distribution(),
+	}
+}
+
+// Latency records how long a step of the workload took.
+func (r *Recorder) Latency(step string, d time.Duration) {
+	if r.Window.Phase(time.Now()) != PhaseMeasure {
+		return
+	}
+
+	r.mu.Lock()
+	h, ok := r.latencies[step]
+	if !ok {
+		h = &Histogram{}
+		r.latencies[step] = h
+	}
+	r.mu.Unlock()
+
+	h.Record(d)
+}
+
+// Retry records an operation that failed with an error of the given class
+// and is about to be tried again.
+func (r *Recorder) Retry(class string) {
+	r.count(r.retries, class)
+}
+
+// Failure records an operation that failed for good with an error of the
+// given class.
+func (r *Recorder) Failure(class string) {
+	r.count(r.failures, class)
+}
+
+func (r *Recorder) count(m map[string]int64, class string) {
+	if r.Window.Phase(time.Now()) != PhaseMeasure {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m[class]++
+}
+
+// Failures returns the measured failures so far, by error class.
+func (r *Recorder) Failures() map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return maps.Clone(r.failures)
+}
+
+// Actions returns the total number of transfers plus deletes, including
+// those completed during warmup and cooldown.
+func (r *Recorder) Actions() int64 {
+	return r.transfers.Load() + r.deletes.Load()
+}
+
+type Summary struct {
+	Transfers int64         `json:"transfers"`
+	Deletes   int64         `json:"deletes"`
+	Actions   int64         `json:"actions"`
+	Elapsed   time.Duration `json:"elapsed"`
+	Rate      float64       `json:"rate"`
+
+	Connections    int64   `json:"connections"`
+	ConnectionRate float64 `json:"connection_rate"`
+
+	Retries  map[string]int64 `json:"retries,omitempty"`
+	Failures map[string]int64 `json:"failures,omitempty"`
+
+	Latencies map[string]*Distribution `json:"latencies,omitempty"`
+
+	// Throughput is the number of actions completed in each whole second of
+	// the measurement window.
+	Throughput []int64 `json:"throughput,omitempty"`
+
+	// Intervals are sampled over the measurement window while it runs.
+	Intervals []Interval `json:"intervals,omitempty"`
+
+	ReadYourWrites *ReadYourWritesSummary `json:"read_your_writes,omitempty"`
+}
+
+// ReadYourWritesSummary describes how often a write could not be read back
+// from the read replica straight away, and how long it took to show up when
+// it couldn't.
+type ReadYourWritesSummary struct {
+	Checks    int64         `json:"checks"`
+	Stale     int64         `json:"stale"`
+	TimedOut  int64         `json:"timed_out"`
+	StaleRate float64       `json:"stale_rate"`
+	Delay     *Distribution `json:"delay"`
+}
+
+// Summary returns the measured statistics as of t.
+func (r *Recorder) Summary(t time.Time) Summary {
+	s := Summary{
+		Transfers:   r.measuredTransfers.Load(),
+		Deletes:     r.measuredDeletes.Load(),
+		Connections: r.measuredConnections.Load(),
+		Elapsed:     r.Window.Elapsed(t),
+	}
+
+	s.Actions = s.Transfers + s.Deletes
+
+	r.mu.Lock()
+	s.Retries = maps.Clone(r.retries)
+	s.Failures = maps.Clone(r.failures)
+	s.Latencies = make(map[string]*Distribution, len(r.latencies))
+	for step, h := range r.latencies {
+		s.Latencies[step] = h.Distribution()
+	}
+	s.Intervals = slices.Clone(r.intervals)
+	r.mu.Unlock()
+
+	// the last, partial second is left out
+	seconds := min(int(s.Elapsed/time.Second), len(r.perSecond))
+	s.Throughput = make([]int64, seconds)
+	for i := range seconds {
+		s.Throughput[i] = r.perSecond[i].Load()
+	}
+
+	s.ReadYourWrites = r.ryw.Summary()
+
+	if s.Elapsed > 0 {
+		s.Rate = float64(s.Actions) / s.Elapsed.Seconds()
+		s.ConnectionRate = float64(s.Connections) / s.Elapsed.Seconds()
+	}
+
+	return s
+}
@@ -0,0 +1,213 @@
+package tracing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exporter sends a batch of spans, encoded as an OTLP JSON export request.
+type Exporter interface {
+	Export(request []byte) error
+	Close() error
+}
+
+// NewExporter returns an exporter for dest: an http:// or https:// collector
+// address, to which spans are posted as OTLP/HTTP JSON, or else a file, in
+// which each export request is written as a line.
+func NewExporter(dest string) (Exporter, error) {
+	if strings.HasPrefix(dest, "http://") || strings.HasPrefix(dest, "https://") {
+		url := strings.TrimSuffix(dest, "/")
+		if !strings.HasSuffix(url, "/v1/traces") {
+			url += "/v1/traces"
+		}
+
+		return &httpExporter{
+			url:    url,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileExporter{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+type fileExporter struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func (e *fileExporter) Export(request []byte) error {
+	_, err := e.w.Write(append(request, '\n'))
+	return err
+}
+
+func (e *fileExporter) Close() error {
+	err := e.w.Flush()
+	if err != nil {
+		e.f.Close()
+		return err
+	}
+
+	return e.f.Close()
+}
+
+type httpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func (e *httpExporter) Export(request []byte) error {
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(request))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %v", resp.Status)
+	}
+
+	return nil
+}
+
+func (e *httpExporter) Close() error {
+	return nil
+}
+
+// the OTLP JSON encoding of an export request, in which IDs are hex and
+// 64-bit integers are strings
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+const (
+	statusOk    = 1
+	statusError = 2
+)
+
+func encode(resource []Attribute, spans []span) []byte {
+	out := make([]otlpSpan, len(spans))
+
+	for i, s := range spans {
+		out[i] = otlpSpan{
+			TraceId:           hexId(s.traceId[0], s.traceId[1]),
+			SpanId:            hexId(s.id),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        keyValues(s.attrs),
+			Status:            otlpStatus{Code: statusOk},
+		}
+
+		if s.parent != 0 {
+			out[i].ParentSpanId = hexId(s.parent)
+		}
+
+		if s.err != nil {
+			out[i].Status = otlpStatus{Code: statusError, Message: s.err.Error()}
+		}
+	}
+
+	js, _ := json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: keyValues(resource)},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "reserva"},
+				Spans: out,
+			}},
+		}},
+	})
+
+	return js
+}
+
+func hexId(ids ...uint64) string {
+	b := make([]byte, 0, 8*len(ids))
+	for _, id := range ids {
+		b = binary.BigEndian.AppendUint64(b, id)
+	}
+	return hex.EncodeToString(b)
+}
+
+func keyValues(attrs []Attribute) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+
+	for _, a := range attrs {
+		var value map[string]any
+
+		switch v := a.Value.(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+
+		kvs = append(kvs, otlpKeyValue{Key: a.Key, Value: value})
+	}
+
+	return kvs
+}
@@ -0,0 +1,295 @@
+// Package tracing records a trace of every transfer, with a span per step,
+// and exports the sampled traces as OTLP JSON, either to a file with one
+// export request per line or to a collector's OTLP/HTTP endpoint.
+package tracing
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	kindInternal = 1
+	kindClient   = 3
+)
+
+// Attribute is a key and a string, int64, float64 or bool value.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Int(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+type span struct {
+	traceId [2]uint64
+	id      uint64
+	parent  uint64
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   []Attribute
+	err     error
+}
+
+// Tracer starts traces and exports the ones that are sampled. A trace is
+// kept if it was picked at random when it started, at the sample rate, or if
+// it took at least as long as slow.
+type Tracer struct {
+	exporter Exporter
+	sample   float64
+	slow     time.Duration
+	resource []Attribute
+
+	// closed is guarded by mu, so transfers that outlive the run can't send
+	// on a closed channel
+	mu     sync.RWMutex
+	closed bool
+	traces chan []span
+	done   chan struct{}
+
+	dropped atomic.Int64
+	err     error
+}
+
+// batchSize is how many spans are exported at once, unless a second passes
+// first.
+const batchSize = 1000
+
+// New starts a tracer that exports to exporter. A slow of 0 turns tail
+// sampling off.
+func New(exporter Exporter, sample float64, slow time.Duration, resource ...Attribute) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		sample:   sample,
+		slow:     slow,
+		resource: resource,
+		traces:   make(chan []span, 1024),
+		done:     make(chan struct{}),
+	}
+
+	go t.export()
+
+	return t
+}
+
+func (t *Tracer) export() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var batch []span
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		err := t.exporter.Export(encode(t.resource, batch))
+		if err != nil && t.err == nil {
+			t.err = err
+		}
+
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case spans, ok := <-t.traces:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, spans...)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close exports the remaining traces and closes the exporter. It returns the
+// first error the exporter ran into.
+func (t *Tracer) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	close(t.traces)
+	t.mu.Unlock()
+
+	<-t.done
+
+	err := t.exporter.Close()
+	if t.err != nil {
+		return t.err
+	}
+
+	return err
+}
+
+// Dropped returns how many sampled traces were dropped because the exporter
+// couldn't keep up.
+func (t *Tracer) Dropped() int64 {
+	return t.dropped.Load()
+}
+
+// Start starts a trace, whose root span is named name. The trace is carried
+// by the returned context. Start on a nil tracer returns a nil trace, which
+// records nothing.
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Trace) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	tr := &Trace{
+		tracer:  t,
+		traceId: [2]uint64{nonZero(), nonZero()},
+		sampled: rand.Float64() < t.sample,
+		root: span{
+			id:    nonZero(),
+			name:  name,
+			kind:  kindInternal,
+			start: time.Now(),
+			attrs: attrs,
+		},
+	}
+
+	return context.WithValue(ctx, traceKey{}, tr), tr
+}
+
+func nonZero() uint64 {
+	for {
+		if id := rand.Uint64(); id != 0 {
+			return id
+		}
+	}
+}
+
+type traceKey struct{}
+
+// FromContext returns the trace carried by ctx, or nil.
+func FromContext(ctx context.Context) *Trace {
+	tr, _ := ctx.Value(traceKey{}).(*Trace)
+	return tr
+}
+
+// Trace is the trace of one transfer. Its methods can be called on a nil
+// trace, and do nothing.
+type Trace struct {
+	tracer  *Tracer
+	traceId [2]uint64
+	sampled bool
+
+	mu    sync.Mutex
+	root  span
+	spans []span
+}
+
+// SetAttributes adds attributes to the root span.
+func (tr *Trace) SetAttributes(attrs ...Attribute) {
+	if tr == nil {
+		return
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.root.attrs = append(tr.root.attrs, attrs...)
+}
+
+// Span starts a child of the root span.
+func (tr *Trace) Span(name string, attrs ...Attribute) *Span {
+	if tr == nil {
+		return nil
+	}
+
+	return &Span{
+		trace: tr,
+		span: span{
+			id:     nonZero(),
+			parent: tr.root.id,
+			name:   name,
+			kind:   kindClient,
+			start:  time.Now(),
+			attrs:  attrs,
+		},
+	}
+}
+
+// End ends the root span, marking it as failed if err is not nil, and hands
+// the trace to the exporter if it is sampled.
+func (tr *Trace) End(err error, attrs ...Attribute) {
+	if tr == nil {
+		return
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.root.end = time.Now()
+	tr.root.err = err
+	tr.root.attrs = append(tr.root.attrs, attrs...)
+
+	slow := tr.tracer.slow > 0 && tr.root.end.Sub(tr.root.start) >= tr.tracer.slow
+	if !tr.sampled && !slow {
+		return
+	}
+
+	spans := append([]span{tr.root}, tr.spans...)
+	for i := range spans {
+		spans[i].traceId = tr.traceId
+	}
+
+	tr.tracer.mu.RLock()
+	defer tr.tracer.mu.RUnlock()
+
+	if tr.tracer.closed {
+		return
+	}
+
+	select {
+	case tr.tracer.traces <- spans:
+	default:
+		tr.tracer.dropped.Add(1)
+	}
+}
+
+// Span is a step of a transfer. Its methods can be called on a nil span, and
+// do nothing.
+type Span struct {
+	trace *Trace
+	span
+}
+
+// End ends the span, marking it as failed if err is not nil.
+func (s *Span) End(err error, attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+
+	s.end = time.Now()
+	s.err = err
+	s.attrs = append(s.attrs, attrs...)
+
+	s.trace.mu.Lock()
+	defer s.trace.mu.Unlock()
+
+	s.trace.spans = append(s.trace.spans, s.span)
+}
@@ -0,0 +1,25 @@
+-- Keeps only the accounts of one shard, after mysql_init.sql has loaded all
+-- of them. Run it on every shard, in the order the shards are given to
+-- reserva with -write-dsn, with @shards, @shard and @shard_by set first:
+--
+--   mysql ... -e "SET @shards = 4, @shard = 0, @shard_by = 'hash'; source migrations/mysql_shard.sql"
+--
+-- Organizations, users and tokens are kept on every shard.
+
+USE reserva;
+
+-- a transfer is recorded on the shard of the account it debits, which isn't
+-- always the shard of the account it credits
+ALTER TABLE transfers DROP FOREIGN KEY fk_transfers_to_account_id;
+
+SELECT max(id) INTO @max_account FROM accounts;
+
+-- must match how reserva maps accounts to shards
+DELETE FROM accounts
+WHERE
+    CASE @shard_by
+        WHEN 'hash' THEN (id * 2654435761) % 4294967296 % @shards
+        WHEN 'range' THEN (id - 1) * @shards DIV @max_account
+    END <> @shard;
+
+ANALYZE TABLE accounts, cards, transfers;
@@ -0,0 +1,23 @@
+-- Keeps only the accounts of one shard, after postgresql_init.sql has loaded
+-- all of them. Run it on every shard, in the order the shards are given to
+-- reserva with -write-dsn:
+--
+--   psql $DSN -v shards=4 -v shard=0 -v shard_by=hash -f migrations/postgresql_shard.sql
+--
+-- Organizations, users and tokens are kept on every shard.
+
+\c reserva;
+
+-- a transfer is recorded on the shard of the account it debits, which isn't
+-- always the shard of the account it credits
+ALTER TABLE transfers DROP CONSTRAINT IF EXISTS fk_transfers_to_account;
+
+-- must match how reserva maps accounts to shards
+DELETE FROM accounts
+WHERE
+    CASE :'shard_by'
+        WHEN 'hash' THEN (id::bigint * 2654435761) % 4294967296 % :shards
+        WHEN 'range' THEN (id::bigint - 1) * :shards / (SELECT max(id) FROM accounts)
+    END <> :shard;
+
+VACUUM ANALYZE;